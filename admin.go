@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// adminCommand is an admin API request. Each of args fills the {arg}
+// placeholder in path, except optional ones written as [arg], which are sent
+// as query parameters when given.
+type adminCommand struct {
+	method      string
+	path        string
+	args        []string
+	description string
+}
+
+var adminCommands = map[string]adminCommand{
+	"reapply-export-clients": {
+		method:      "POST",
+		path:        "/admin/export-clients",
+		description: "set the client lists of every instance's export from the current catalog",
+	},
+	"usage": {
+		method:      "GET",
+		path:        "/admin/usage",
+		args:        []string{"[format]"},
+		description: "report the quota usage of every instance, as json (the default) or csv",
+	},
+	"list-snapshots": {
+		method:      "GET",
+		path:        "/admin/instances/{instance}/snapshots",
+		args:        []string{"instance"},
+		description: "list the snapshots of an instance",
+	},
+	"create-snapshot": {
+		method:      "POST",
+		path:        "/admin/instances/{instance}/snapshots",
+		args:        []string{"instance", "[name]"},
+		description: "snapshot an instance now",
+	},
+	"delete-snapshot": {
+		method:      "DELETE",
+		path:        "/admin/instances/{instance}/snapshots/{snapshot}",
+		args:        []string{"instance", "snapshot"},
+		description: "delete a snapshot of an instance by its id",
+	},
+	"reconcile": {
+		method:      "POST",
+		path:        "/admin/reconcile",
+		args:        []string{"[mode]"},
+		description: "report how the clusters differ from the broker's instances, or with repair also re-create missing exports and quotas",
+	},
+	"metrics": {
+		method:      "GET",
+		path:        "/admin/metrics",
+		description: "report the counters and gauges of reconciliation, such as the differences of each kind the last run found",
+	},
+	"list-trash": {
+		method:      "GET",
+		path:        "/admin/trash",
+		description: "list the deleted instances that can still be undeleted",
+	},
+	"undelete": {
+		method:      "POST",
+		path:        "/admin/trash/{deleted-instance}/undelete/{instance}",
+		args:        []string{"deleted-instance", "instance"},
+		description: "restore the directory of a deleted instance into a new, empty instance",
+	},
+}
+
+// runAdminCommand sends an admin subcommand to the running broker's admin API
+// and copies the response to stdout. It returns the process exit code.
+func runAdminCommand(stdout, stderr io.Writer, args []string) int {
+	if len(args) == 0 {
+		adminUsage(stderr)
+		return 2
+	}
+	command, ok := adminCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown admin command %q\n\n", args[0])
+		adminUsage(stderr)
+		return 2
+	}
+
+	path, err := command.requestPath(args[1:])
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n\n", err)
+		adminUsage(stderr)
+		return 2
+	}
+
+	req, err := http.NewRequest(command.method, adminBaseURL()+path, nil)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	req.SetBasicAuth(username, password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to reach the broker: %s\n", err)
+		return 1
+	}
+	defer resp.Body.Close()
+
+	if _, err := io.Copy(stdout, resp.Body); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if resp.StatusCode >= 300 {
+		fmt.Fprintf(stderr, "broker responded with %s\n", resp.Status)
+		return 1
+	}
+	return 0
+}
+
+func (c adminCommand) requestPath(args []string) (string, error) {
+	if len(args) > len(c.args) {
+		return "", fmt.Errorf("too many arguments, expected %s", strings.Join(c.args, " "))
+	}
+
+	path := c.path
+	query := url.Values{}
+	for i, name := range c.args {
+		if strings.HasPrefix(name, "[") {
+			if i < len(args) {
+				query.Set(strings.Trim(name, "[]"), args[i])
+			}
+			continue
+		}
+		if i >= len(args) || args[i] == "" {
+			return "", fmt.Errorf("missing argument <%s>", name)
+		}
+		path = strings.Replace(path, "{"+name+"}", url.PathEscape(args[i]), 1)
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	return path, nil
+}
+
+func adminBaseURL() string {
+	if *adminURL != "" {
+		return strings.TrimSuffix(*adminURL, "/")
+	}
+	return "http://" + strings.Replace(*atAddress, "0.0.0.0", "127.0.0.1", 1)
+}
+
+func adminUsage(w io.Writer) {
+	fmt.Fprintln(w, "usage: isilon-nfs-broker [flags] admin <command> [args]")
+	fmt.Fprintln(w, "\ncommands:")
+
+	names := []string{}
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		usage := name
+		for _, arg := range adminCommands[name].args {
+			if !strings.HasPrefix(arg, "[") {
+				arg = "<" + arg + ">"
+			}
+			usage += " " + arg
+		}
+		fmt.Fprintf(w, "  %-40s %s\n", usage, adminCommands[name].description)
+	}
+}
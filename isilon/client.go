@@ -0,0 +1,662 @@
+package isilon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thecodeteam/goisilon"
+	"github.com/thecodeteam/goisilon/api"
+	apiv2 "github.com/thecodeteam/goisilon/api/v2"
+)
+
+var (
+	// ErrDirectoryNotFound is returned when moving a directory that does not
+	// exist.
+	ErrDirectoryNotFound = errors.New("directory not found")
+	// ErrQuotaNotFound is returned when reading the quota of a volume that
+	// has none.
+	ErrQuotaNotFound = errors.New("quota not found")
+	// ErrVolumeExists is returned when copying into a volume that already
+	// exists.
+	ErrVolumeExists = errors.New("volume already exists")
+)
+
+// The security flavors of an NFS export. SecurityUnix is the AUTH_SYS
+// flavor every export has by default; the others are Kerberos flavors.
+const (
+	SecurityUnix  = "unix"
+	SecurityKrb5  = "krb5"
+	SecurityKrb5i = "krb5i"
+	SecurityKrb5p = "krb5p"
+)
+
+const (
+	namespacePath = "namespace"
+	exportsPath   = "platform/2/protocols/nfs/exports"
+	quotasPath    = "platform/1/quota/quotas"
+)
+
+// Client is the set of OneFS operations the broker needs to manage the
+// directory, NFS export, SMB share and SmartQuota behind a service instance.
+type Client interface {
+	// At returns a client for the same cluster and credentials whose volumes
+	// are in volumePath, sharing this client's connection.
+	At(volumePath string) Client
+
+	CreateVolume(ctx context.Context, name string) error
+	// CopyVolume creates a volume as a copy of the directory at source, an
+	// absolute path on the cluster such as a snapshot's ContentPath. The copy
+	// is made at CopyingVolume(name), under a quota with a hard limit of
+	// limit bytes so that a source holding more fails to copy, and only
+	// moved into place once it is complete, without the quota. A copy that
+	// fails leaves nothing behind. It returns ErrVolumeExists, and copies
+	// nothing, when the volume already exists.
+	CopyVolume(ctx context.Context, name string, source string, limit int64) error
+	// DeleteVolume, UnexportVolume and ClearQuota succeed when there is
+	// nothing left to remove, so that an instance whose resources were
+	// removed by hand can still be deleted.
+	DeleteVolume(ctx context.Context, name string) error
+	// SetOwnership changes the owner, group and mode of the root directory
+	// of a volume.
+	SetOwnership(ctx context.Context, name string, ownership Ownership) error
+	// MoveDirectory moves the directory at source to dest, both absolute
+	// paths on the cluster, creating the parent of dest if need be. It
+	// returns ErrDirectoryNotFound when there is nothing at source.
+	MoveDirectory(ctx context.Context, source string, dest string) error
+	// CreateDirectory creates a directory, given as an absolute path, along
+	// with any of its parents that are missing. A directory that already
+	// exists is not an error.
+	CreateDirectory(ctx context.Context, dir string) error
+	// DeleteDirectory removes a directory, given as an absolute path, and
+	// everything in it. A directory that does not exist is not an error.
+	DeleteDirectory(ctx context.Context, dir string) error
+	// ListVolumes returns the names of the directories in the volume path.
+	ListVolumes(ctx context.Context) ([]string, error)
+	// ExportVolume creates the NFS export of a volume in an access zone. An
+	// empty zone is the System zone.
+	ExportVolume(ctx context.Context, name string, zone string) (int, error)
+	UnexportVolume(ctx context.Context, name string, zone string) error
+	IsExported(ctx context.Context, name string, zone string) (bool, error)
+	// SetExportClients replaces the client lists on the export of a volume.
+	SetExportClients(ctx context.Context, name string, zone string, clients ExportClients) error
+	// SetExportSecurityFlavors replaces the security flavors, such as
+	// SecurityUnix or SecurityKrb5p, that clients may mount the export of a
+	// volume with.
+	SetExportSecurityFlavors(ctx context.Context, name string, zone string, flavors []string) error
+	// CreateShare creates an SMB share of a volume in an access zone, named
+	// after the volume. DeleteShare succeeds when there is no share, and
+	// leaves a share of the same name for another directory alone, which
+	// IsShared does not count either.
+	CreateShare(ctx context.Context, name string, zone string) error
+	DeleteShare(ctx context.Context, name string, zone string) error
+	IsShared(ctx context.Context, name string, zone string) (bool, error)
+	// SetQuota sets the thresholds of the directory quota on a volume,
+	// creating the quota if there is none yet.
+	SetQuota(ctx context.Context, name string, limits QuotaLimits) error
+	ClearQuota(ctx context.Context, name string) error
+	// QuotaUsage returns the logical number of bytes the quota on a volume
+	// is currently accounting for.
+	QuotaUsage(ctx context.Context, name string) (int64, error)
+	// Quota returns the thresholds and usage of the quota on a volume, or
+	// ErrQuotaNotFound if it has none.
+	Quota(ctx context.Context, name string) (Quota, error)
+
+	// SetSnapshotSchedule creates or replaces the snapshot schedule of a
+	// volume, and ClearSnapshotSchedule removes it if there is one. Both
+	// leave alone a schedule of the same name for another directory.
+	SetSnapshotSchedule(ctx context.Context, name string, schedule SnapshotSchedule) error
+	ClearSnapshotSchedule(ctx context.Context, name string) error
+	ListSnapshots(ctx context.Context, name string) ([]Snapshot, error)
+	CreateSnapshot(ctx context.Context, name string, snapshotName string) (Snapshot, error)
+	// DeleteSnapshot removes a snapshot, provided it is a snapshot of the
+	// volume.
+	DeleteSnapshot(ctx context.Context, name string, id int64) error
+
+	// SetStoragePool makes SmartPools store the files of a volume in a node
+	// pool or tier, and ClearStoragePool leaves them to the cluster default
+	// again. Data already in the volume only moves when the SmartPools job
+	// next runs, unless MoveToStoragePool starts a job for the volume. Both
+	// leave alone a policy of the same name for another directory.
+	SetStoragePool(ctx context.Context, name string, pool string) error
+	ClearStoragePool(ctx context.Context, name string) error
+	MoveToStoragePool(ctx context.Context, name string) error
+
+	// SetReplicationPolicy creates or updates the SyncIQ policy of a volume,
+	// and ClearReplicationPolicy removes it if there is one. Data already
+	// copied to the target is left there, and so is a policy of the same
+	// name for another directory.
+	SetReplicationPolicy(ctx context.Context, name string, policy ReplicationPolicy) error
+	ClearReplicationPolicy(ctx context.Context, name string) error
+	// ReplicationStatus returns the outcome of the latest replication of a
+	// volume, or ErrReplicationPolicyNotFound if it has no policy.
+	ReplicationStatus(ctx context.Context, name string) (ReplicationStatus, error)
+}
+
+// ExportClients are the hosts allowed to mount an export, as IP addresses or
+// CIDR networks. An export with no clients at all may be mounted by anyone.
+type ExportClients struct {
+	Clients         []string
+	RootClients     []string
+	ReadOnlyClients []string
+}
+
+// Ownership is the owner and group of a directory, as a numeric uid and gid,
+// and its mode in octal, such as "0775". Those that are nil or empty are left
+// as they are.
+type Ownership struct {
+	UID  *int
+	GID  *int
+	Mode string
+}
+
+// QuotaLimits are the thresholds of a directory quota in bytes. Advisory and
+// Soft are left unset when zero, and a soft threshold needs a grace period.
+type QuotaLimits struct {
+	Hard      int64
+	Advisory  int64
+	Soft      int64
+	SoftGrace time.Duration
+}
+
+// Quota is the state of a directory quota. Usage is in bytes, apart from
+// Files, which counts inodes.
+type Quota struct {
+	Limits   QuotaLimits
+	Logical  int64
+	Physical int64
+	Files    int64
+}
+
+type Config struct {
+	Endpoint   string
+	Insecure   bool
+	Username   string
+	Password   string
+	Group      string
+	VolumePath string
+}
+
+type client struct {
+	config Config
+}
+
+// NewClient returns a client for the cluster and volume path of config. It
+// does not connect until it is first used, and then shares its connection
+// with every other client for the same cluster and credentials, reconnecting
+// as the session expires or the cluster becomes reachable again.
+func NewClient(config Config) Client {
+	return &client{config: config}
+}
+
+func (c *client) At(volumePath string) Client {
+	config := c.config
+	config.VolumePath = volumePath
+	return &client{config: config}
+}
+
+func (c *client) connect(ctx context.Context) (*goisilon.Client, error) {
+	s, err := sessionFor(ctx, c.config)
+	if err != nil {
+		return nil, err
+	}
+	return &goisilon.Client{API: volumes{session: s, volumePath: c.config.VolumePath}}, nil
+}
+
+func (c *client) CreateVolume(ctx context.Context, name string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = cli.CreateVolume(ctx, name)
+	return err
+}
+
+func (c *client) CopyVolume(ctx context.Context, name string, source string, limit int64) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	target := strings.TrimPrefix(cli.API.VolumePath(name), "/")
+	var metadata interface{}
+	err = cli.API.Get(ctx, namespacePath, target, api.OrderedValues{{[]byte("metadata")}}, nil, &metadata)
+	if err == nil {
+		return ErrVolumeExists
+	}
+	if !isNotFound(err) {
+		return err
+	}
+
+	// a copy left behind by a broker that stopped part way through one is
+	// started over
+	copying := strings.TrimPrefix(cli.API.VolumePath(CopyingVolume(name)), "/")
+	recursive := api.NewOrderedValues([][]string{{"recursive", "true"}})
+	discard := func() error {
+		if err := cli.API.Delete(ctx, namespacePath, copying, recursive, nil, nil); err != nil && !isNotFound(err) {
+			return err
+		}
+		return c.ClearQuota(ctx, CopyingVolume(name))
+	}
+	if err := discard(); err != nil {
+		return err
+	}
+
+	// the quota is in place before anything is copied, as the copy cannot
+	// be sized beforehand: a snapshot's size is the space it takes up, not
+	// the data it holds
+	err = cli.API.Put(ctx, namespacePath, copying, nil, nil, nil, nil)
+	if err == nil {
+		err = c.SetQuota(ctx, CopyingVolume(name), QuotaLimits{Hard: limit})
+	}
+	if err == nil {
+		// goisilon can only copy between volumes, so the copy goes straight
+		// to the namespace API, which also reaches into snapshots
+		merge := api.NewOrderedValues([][]string{{"merge", "true"}})
+		headers := map[string]string{"x-isi-ifs-copy-source": path.Join("/", namespacePath, source)}
+		err = cli.API.Put(ctx, namespacePath, copying, merge, headers, nil, nil)
+	}
+	if err == nil {
+		err = c.ClearQuota(ctx, CopyingVolume(name))
+	}
+	if err == nil {
+		headers := map[string]string{"x-isi-ifs-set-location": path.Join("/", namespacePath, target)}
+		err = cli.API.Post(ctx, namespacePath, copying, nil, headers, nil, nil)
+	}
+	if err != nil {
+		// the copy may have got part of the way, or not started at all
+		discard()
+		return err
+	}
+	return nil
+}
+
+// CopyingVolume is where CopyVolume makes the copy of a volume: a hidden
+// directory beside it, which only exists while the copy is being made.
+func CopyingVolume(name string) string {
+	return path.Join(path.Dir(name), "."+path.Base(name)+".copying")
+}
+
+func (c *client) DeleteVolume(ctx context.Context, name string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = cli.DeleteVolume(ctx, name)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *client) SetOwnership(ctx context.Context, name string, ownership Ownership) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	type persona struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	body := struct {
+		Authoritative string   `json:"authoritative"`
+		Action        string   `json:"action,omitempty"`
+		Mode          string   `json:"mode,omitempty"`
+		Owner         *persona `json:"owner,omitempty"`
+		Group         *persona `json:"group,omitempty"`
+	}{Authoritative: "mode", Mode: ownership.Mode}
+	// without a mode only the owner and group of the ACL are updated
+	if ownership.Mode == "" {
+		body.Authoritative, body.Action = "acl", "update"
+	}
+	if ownership.UID != nil {
+		body.Owner = &persona{ID: fmt.Sprintf("UID:%d", *ownership.UID), Type: "user"}
+	}
+	if ownership.GID != nil {
+		body.Group = &persona{ID: fmt.Sprintf("GID:%d", *ownership.GID), Type: "group"}
+	}
+
+	params := api.OrderedValues{{[]byte("acl")}}
+	return cli.API.Put(ctx, namespacePath, strings.TrimPrefix(cli.API.VolumePath(name), "/"), params, nil, body, nil)
+}
+
+func (c *client) MoveDirectory(ctx context.Context, source string, dest string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	// goisilon only works within the volume path, so moves go straight to the
+	// namespace API
+	parent := strings.TrimPrefix(path.Dir(dest), "/")
+	headers := map[string]string{"x-isi-ifs-target-type": "container"}
+	if err := cli.API.Put(ctx, namespacePath, parent, nil, headers, nil, nil); err != nil {
+		return err
+	}
+	headers = map[string]string{"x-isi-ifs-set-location": path.Join("/", namespacePath, dest)}
+	err = cli.API.Post(ctx, namespacePath, strings.TrimPrefix(source, "/"), nil, headers, nil, nil)
+	if isNotFound(err) {
+		return ErrDirectoryNotFound
+	}
+	return err
+}
+
+func (c *client) CreateDirectory(ctx context.Context, dir string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{"x-isi-ifs-target-type": "container"}
+	params := api.NewOrderedValues([][]string{{"recursive", "true"}})
+	return cli.API.Put(ctx, namespacePath, strings.TrimPrefix(dir, "/"), params, headers, nil, nil)
+}
+
+func (c *client) DeleteDirectory(ctx context.Context, dir string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	params := api.NewOrderedValues([][]string{{"recursive", "true"}})
+	err = cli.API.Delete(ctx, namespacePath, strings.TrimPrefix(dir, "/"), params, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *client) ListVolumes(ctx context.Context) ([]string, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := cli.GetVolumes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, volume := range volumes {
+		names = append(names, volume.Name)
+	}
+	return names, nil
+}
+
+func (c *client) ExportVolume(ctx context.Context, name string, zone string) (int, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if zone == "" {
+		return cli.ExportVolume(ctx, name)
+	}
+
+	// goisilon only knows about the System zone, so exports in other zones
+	// go straight to the platform API with the zone as a query parameter
+	export, err := findExport(ctx, cli, name, zone)
+	if err != nil {
+		return 0, err
+	}
+	if export != nil {
+		return export.ID, nil
+	}
+
+	paths := []string{cli.API.VolumePath(name)}
+	var resp apiv2.Export
+	if err := cli.API.Post(ctx, exportsPath, "", zoneParams(zone), nil, &apiv2.Export{Paths: &paths}, &resp); err != nil {
+		return 0, err
+	}
+	return resp.ID, nil
+}
+
+func (c *client) UnexportVolume(ctx context.Context, name string, zone string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the export is looked up in the System zone too, as goisilon fails
+	// when the volume has no export
+	export, err := findExport(ctx, cli, name, zone)
+	if err != nil || export == nil {
+		return err
+	}
+	err = cli.API.Delete(ctx, exportsPath, strconv.Itoa(export.ID), zoneParams(zone), nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *client) IsExported(ctx context.Context, name string, zone string) (bool, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	export, err := findExport(ctx, cli, name, zone)
+	if err != nil {
+		return false, err
+	}
+	return export != nil, nil
+}
+
+func (c *client) SetExportClients(ctx context.Context, name string, zone string, clients ExportClients) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	export, err := findExport(ctx, cli, name, zone)
+	if err != nil {
+		return err
+	}
+	if export == nil {
+		return fmt.Errorf("volume %s is not exported", name)
+	}
+
+	// OneFS rejects null lists, so empty ones are sent as []
+	body := struct {
+		Clients         []string `json:"clients"`
+		RootClients     []string `json:"root_clients"`
+		ReadOnlyClients []string `json:"read_only_clients"`
+	}{
+		Clients:         append([]string{}, clients.Clients...),
+		RootClients:     append([]string{}, clients.RootClients...),
+		ReadOnlyClients: append([]string{}, clients.ReadOnlyClients...),
+	}
+	return cli.API.Put(ctx, exportsPath, strconv.Itoa(export.ID), zoneParams(zone), nil, body, nil)
+}
+
+func (c *client) SetExportSecurityFlavors(ctx context.Context, name string, zone string, flavors []string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	export, err := findExport(ctx, cli, name, zone)
+	if err != nil {
+		return err
+	}
+	if export == nil {
+		return fmt.Errorf("volume %s is not exported", name)
+	}
+
+	body := struct {
+		SecurityFlavors []string `json:"security_flavors"`
+	}{
+		SecurityFlavors: append([]string{}, flavors...),
+	}
+	return cli.API.Put(ctx, exportsPath, strconv.Itoa(export.ID), zoneParams(zone), nil, body, nil)
+}
+
+func findExport(ctx context.Context, cli *goisilon.Client, name string, zone string) (*apiv2.Export, error) {
+	var exports apiv2.ExportList
+	if err := cli.API.Get(ctx, exportsPath, "", zoneParams(zone), nil, &exports); err != nil {
+		return nil, err
+	}
+
+	volumePath := path.Clean(cli.API.VolumePath(name))
+	for _, export := range exports {
+		if export.Paths == nil {
+			continue
+		}
+		for _, p := range *export.Paths {
+			if path.Clean(p) == volumePath {
+				return export, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// zoneParams are the query parameters addressing an access zone; none are
+// needed for the System zone.
+func zoneParams(zone string) api.OrderedValues {
+	if zone == "" {
+		return nil
+	}
+	return api.NewOrderedValues([][]string{{"zone", zone}})
+}
+
+type quotaThresholds struct {
+	Advisory  interface{} `json:"advisory"`
+	Hard      int64       `json:"hard"`
+	Soft      interface{} `json:"soft"`
+	SoftGrace interface{} `json:"soft_grace"`
+}
+
+type quotaRequest struct {
+	Path                      string          `json:"path,omitempty"`
+	Type                      string          `json:"type,omitempty"`
+	IncludeSnapshots          *bool           `json:"include_snapshots,omitempty"`
+	Enforced                  bool            `json:"enforced"`
+	ThresholdsIncludeOverhead bool            `json:"thresholds_include_overhead"`
+	Thresholds                quotaThresholds `json:"thresholds"`
+}
+
+func (c *client) SetQuota(ctx context.Context, name string, limits QuotaLimits) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	// goisilon only sets hard thresholds, so the quota goes straight to the
+	// platform API; unset thresholds are sent as null to clear them
+	thresholds := quotaThresholds{Hard: limits.Hard}
+	if limits.Advisory > 0 {
+		thresholds.Advisory = limits.Advisory
+	}
+	if limits.Soft > 0 {
+		thresholds.Soft = limits.Soft
+		thresholds.SoftGrace = int64(limits.SoftGrace / time.Second)
+	}
+	req := quotaRequest{Enforced: true, Thresholds: thresholds}
+
+	quota, err := findQuota(ctx, cli, name)
+	if err != nil {
+		return err
+	}
+	if quota != nil {
+		return cli.API.Put(ctx, quotasPath, quota.ID, nil, nil, req, nil)
+	}
+
+	includeSnapshots := false
+	req.Path = cli.API.VolumePath(name)
+	req.Type = "directory"
+	req.IncludeSnapshots = &includeSnapshots
+	return cli.API.Post(ctx, quotasPath, "", nil, nil, req, nil)
+}
+
+func (c *client) ClearQuota(ctx context.Context, name string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	err = cli.ClearQuota(ctx, name)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *client) QuotaUsage(ctx context.Context, name string) (int64, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return 0, err
+	}
+	quota, err := findQuota(ctx, cli, name)
+	if err != nil {
+		return 0, err
+	}
+	if quota == nil {
+		return 0, ErrQuotaNotFound
+	}
+	return quota.Usage.Logical, nil
+}
+
+func (c *client) Quota(ctx context.Context, name string) (Quota, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return Quota{}, err
+	}
+	quota, err := findQuota(ctx, cli, name)
+	if err != nil {
+		return Quota{}, err
+	}
+	if quota == nil {
+		return Quota{}, ErrQuotaNotFound
+	}
+	return Quota{
+		Limits: QuotaLimits{
+			Hard:      quota.Thresholds.Hard,
+			Advisory:  quota.Thresholds.Advisory,
+			Soft:      quota.Thresholds.Soft,
+			SoftGrace: time.Duration(quota.Thresholds.SoftGrace) * time.Second,
+		},
+		Logical:  quota.Usage.Logical,
+		Physical: quota.Usage.Physical,
+		Files:    quota.Usage.Inodes,
+	}, nil
+}
+
+// isiQuota is a directory quota as the platform API reports it. Thresholds that
+// are not set come back as null, and are read as zero.
+type isiQuota struct {
+	ID         string `json:"id"`
+	Path       string `json:"path"`
+	Thresholds struct {
+		Advisory  int64 `json:"advisory"`
+		Hard      int64 `json:"hard"`
+		Soft      int64 `json:"soft"`
+		SoftGrace int64 `json:"soft_grace"`
+	} `json:"thresholds"`
+	Usage struct {
+		Inodes   int64 `json:"inodes"`
+		Logical  int64 `json:"logical"`
+		Physical int64 `json:"physical"`
+	} `json:"usage"`
+}
+
+// findQuota looks up the directory quota on a volume, returning nil if there
+// is none. Unlike goisilon's GetQuota it tells a missing quota apart from a
+// failed request, and it reads the soft grace period, which goisilon leaves
+// out.
+func findQuota(ctx context.Context, cli *goisilon.Client, name string) (*isiQuota, error) {
+	var resp struct {
+		Quotas []isiQuota `json:"quotas"`
+	}
+	if err := cli.API.Get(ctx, quotasPath, "", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	volumePath := cli.API.VolumePath(name)
+	for i := range resp.Quotas {
+		if resp.Quotas[i].Path == volumePath {
+			return &resp.Quotas[i], nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,1443 @@
+package isilonfakes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FakeOneFS is an in-process stand-in for the OneFS platform API. It models
+// the namespace, NFS export, SMB share, SmartQuota, SnapshotIQ, SyncIQ and
+// SmartPools endpoints closely enough for the goisilon client to drive a full
+// provision/deprovision lifecycle against it.
+type FakeOneFS struct {
+	*httptest.Server
+
+	username string
+	password string
+
+	mutex        sync.Mutex
+	dirs         map[string]*FakeDirectory
+	exports      map[int]*FakeExport
+	shares       map[string]*FakeShare
+	quotas       map[string]*FakeQuota
+	snapshots    map[int64]*FakeSnapshot
+	schedules    map[string]*FakeSnapshotSchedule
+	policies     map[string]*FakeSyncPolicy
+	filePools    map[string]*FakeFilePoolPolicy
+	jobs         []FakeJob
+	nextExportID int
+	nextQuotaID  int
+	nextSnapID   int64
+	nextPolicyID int
+	failures     []failure
+	holds        []*hold
+	connections  int
+	expired      bool
+	unreachable  bool
+}
+
+// FakeDirectory is the owner and group of a directory, by name or, when set
+// by id, as "UID:<uid>" and "GID:<gid>", and its mode, when one was set.
+type FakeDirectory struct {
+	Owner string
+	Group string
+	Mode  string
+}
+
+type FakeExport struct {
+	ID              int      `json:"id"`
+	Zone            string   `json:"zone"`
+	Paths           []string `json:"paths"`
+	Clients         []string `json:"clients"`
+	RootClients     []string `json:"root_clients"`
+	ReadOnlyClients []string `json:"read_only_clients"`
+	SecurityFlavors []string `json:"security_flavors"`
+}
+
+type FakeSharePermission struct {
+	Permission     string `json:"permission"`
+	PermissionType string `json:"permission_type"`
+	Trustee        struct {
+		ID string `json:"id"`
+	} `json:"trustee"`
+}
+
+type FakeShare struct {
+	Name        string                `json:"name"`
+	Zone        string                `json:"zone"`
+	Path        string                `json:"path"`
+	Permissions []FakeSharePermission `json:"permissions"`
+}
+
+type FakeQuotaThresholds struct {
+	Advisory  *int64 `json:"advisory"`
+	Hard      *int64 `json:"hard"`
+	Soft      *int64 `json:"soft"`
+	SoftGrace *int64 `json:"soft_grace"`
+}
+
+type FakeQuotaUsage struct {
+	Inodes   int64 `json:"inodes"`
+	Logical  int64 `json:"logical"`
+	Physical int64 `json:"physical"`
+}
+
+type FakeQuota struct {
+	ID                        string              `json:"id"`
+	Path                      string              `json:"path"`
+	Type                      string              `json:"type"`
+	Enforced                  bool                `json:"enforced"`
+	IncludeSnapshots          bool                `json:"include_snapshots"`
+	ThresholdsIncludeOverhead bool                `json:"thresholds_include_overhead"`
+	Thresholds                FakeQuotaThresholds `json:"thresholds"`
+	Usage                     FakeQuotaUsage      `json:"usage"`
+}
+
+type FakeSnapshot struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires,omitempty"`
+	Size     int64  `json:"size"`
+	State    string `json:"state"`
+	Schedule string `json:"schedule,omitempty"`
+
+	// contents are the directories under Path when the snapshot was taken,
+	// keyed by their path relative to it, and data is the logical usage of
+	// the quota on Path then; Size is the space the snapshot takes up, which
+	// the fake leaves at zero as if nothing had changed since
+	contents map[string]FakeDirectory
+	data     int64
+}
+
+type FakeSnapshotSchedule struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Pattern  string `json:"pattern"`
+	Schedule string `json:"schedule"`
+	Duration int64  `json:"duration,omitempty"`
+}
+
+// FakeSyncPolicy is a SyncIQ policy. Its jobs never run on their own; use
+// RunSyncPolicy to record the outcome of one.
+type FakeSyncPolicy struct {
+	ID             string `json:"id"`
+	Name           string `json:"name"`
+	Action         string `json:"action"`
+	SourceRootPath string `json:"source_root_path"`
+	TargetHost     string `json:"target_host"`
+	TargetPath     string `json:"target_path"`
+	Schedule       string `json:"schedule"`
+	Enabled        bool   `json:"enabled"`
+	LastJobState   string `json:"last_job_state,omitempty"`
+	LastSuccess    int64  `json:"last_success,omitempty"`
+}
+
+// FakeFilePoolPolicy is a SmartPools file pool policy. Only policies that
+// match a single path pattern and set a storage target are modelled.
+type FakeFilePoolPolicy struct {
+	Name                string `json:"name"`
+	FileMatchingPattern struct {
+		OrCriteria []struct {
+			AndCriteria []struct {
+				Type     string `json:"type"`
+				Operator string `json:"operator"`
+				Value    string `json:"value"`
+			} `json:"and_criteria"`
+		} `json:"or_criteria"`
+	} `json:"file_matching_pattern"`
+	Actions []struct {
+		ActionType  string `json:"action_type"`
+		ActionParam string `json:"action_param"`
+	} `json:"actions"`
+}
+
+// Path is the path pattern the policy matches.
+func (p FakeFilePoolPolicy) Path() string {
+	if len(p.FileMatchingPattern.OrCriteria) == 0 || len(p.FileMatchingPattern.OrCriteria[0].AndCriteria) == 0 {
+		return ""
+	}
+	return p.FileMatchingPattern.OrCriteria[0].AndCriteria[0].Value
+}
+
+// StorageTarget is the node pool or tier the policy stores files in.
+func (p FakeFilePoolPolicy) StorageTarget() string {
+	for _, action := range p.Actions {
+		if action.ActionType == "set_data_storage_target" {
+			return action.ActionParam
+		}
+	}
+	return ""
+}
+
+// FakeJob is a job started through the job engine. Jobs never run.
+type FakeJob struct {
+	Type  string   `json:"type"`
+	Paths []string `json:"paths"`
+}
+
+type failure struct {
+	method string
+	prefix string
+}
+
+type hold struct {
+	method   string
+	prefix   string
+	held     chan struct{}
+	released chan struct{}
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	namespacePrefix = "/namespace"
+	exportsSuffix   = "/protocols/nfs/exports"
+	sharesSuffix    = "/protocols/smb/shares"
+	quotasSuffix    = "/quota/quotas"
+	snapshotsSuffix = "/snapshot/snapshots"
+	schedulesSuffix = "/snapshot/schedules"
+	policiesSuffix  = "/sync/policies"
+	filePoolsSuffix = "/filepool/policies"
+	jobsSuffix      = "/job/jobs"
+
+	systemZone = "System"
+)
+
+// NewFakeOneFS starts a fake cluster that accepts the given basic auth
+// credentials. Only /ifs exists initially; use MkdirAll to create the
+// volume path the broker is configured with.
+func NewFakeOneFS(username, password string) *FakeOneFS {
+	fake := &FakeOneFS{
+		username:     username,
+		password:     password,
+		dirs:         map[string]*FakeDirectory{"/ifs": {Owner: "root"}},
+		exports:      map[int]*FakeExport{},
+		shares:       map[string]*FakeShare{},
+		quotas:       map[string]*FakeQuota{},
+		snapshots:    map[int64]*FakeSnapshot{},
+		schedules:    map[string]*FakeSnapshotSchedule{},
+		policies:     map[string]*FakeSyncPolicy{},
+		filePools:    map[string]*FakeFilePoolPolicy{},
+		nextExportID: 1,
+		nextQuotaID:  1,
+		nextSnapID:   1,
+		nextPolicyID: 1,
+	}
+	fake.Server = httptest.NewServer(http.HandlerFunc(fake.serveHTTP))
+	return fake
+}
+
+// MkdirAll creates a directory and any missing parents.
+func (f *FakeOneFS) MkdirAll(dir string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for p := path.Clean(dir); p != "/" && p != "."; p = path.Dir(p) {
+		if _, ok := f.dirs[p]; !ok {
+			f.dirs[p] = &FakeDirectory{Owner: "root"}
+		}
+	}
+}
+
+func (f *FakeOneFS) DirectoryExists(dir string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	_, ok := f.dirs[path.Clean(dir)]
+	return ok
+}
+
+func (f *FakeOneFS) Directory(dir string) (FakeDirectory, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	d, ok := f.dirs[path.Clean(dir)]
+	if !ok {
+		return FakeDirectory{}, false
+	}
+	return *d, true
+}
+
+// Export returns the export that lists dir among its paths.
+func (f *FakeOneFS) Export(dir string) (FakeExport, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if e := f.exportForPath(path.Clean(dir)); e != nil {
+		return *e, true
+	}
+	return FakeExport{}, false
+}
+
+func (f *FakeOneFS) ExportCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.exports)
+}
+
+// Quota returns the directory quota on dir.
+// Share returns the SMB share named name in an access zone, where "" is the
+// System zone.
+func (f *FakeOneFS) Share(zone, name string) (FakeShare, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if zone == "" {
+		zone = systemZone
+	}
+	if s, ok := f.shares[shareKey(zone, name)]; ok {
+		return *s, true
+	}
+	return FakeShare{}, false
+}
+
+func (f *FakeOneFS) ShareCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.shares)
+}
+
+func (f *FakeOneFS) Quota(dir string) (FakeQuota, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if q := f.quotaForPath(path.Clean(dir)); q != nil {
+		return *q, true
+	}
+	return FakeQuota{}, false
+}
+
+func (f *FakeOneFS) QuotaCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.quotas)
+}
+
+// SetQuotaUsage records usage against the quota on dir, as if an app had
+// written data into it.
+func (f *FakeOneFS) SetQuotaUsage(dir string, usage FakeQuotaUsage) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if q := f.quotaForPath(path.Clean(dir)); q != nil {
+		q.Usage = usage
+	}
+}
+
+// SnapshotSchedule returns the snapshot schedule on dir.
+func (f *FakeOneFS) SnapshotSchedule(dir string) (FakeSnapshotSchedule, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, s := range f.schedules {
+		if s.Path == path.Clean(dir) {
+			return *s, true
+		}
+	}
+	return FakeSnapshotSchedule{}, false
+}
+
+func (f *FakeOneFS) SnapshotScheduleCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.schedules)
+}
+
+// Snapshots returns the snapshots of dir, oldest first.
+func (f *FakeOneFS) Snapshots(dir string) []FakeSnapshot {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	list := []FakeSnapshot{}
+	for _, s := range f.sortedSnapshots() {
+		if s.Path == path.Clean(dir) {
+			list = append(list, *s)
+		}
+	}
+	return list
+}
+
+// TakeSnapshot snapshots dir as a schedule would, returning the new
+// snapshot's ID. The snapshot names the schedule of dir, if it has one.
+func (f *FakeOneFS) TakeSnapshot(dir, name string) int64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	snapshot := f.takeSnapshot(path.Clean(dir), name)
+	for _, s := range f.schedules {
+		if s.Path == snapshot.Path {
+			snapshot.Schedule = s.Name
+		}
+	}
+	return snapshot.ID
+}
+
+// SyncPolicy returns the SyncIQ policy replicating dir.
+func (f *FakeOneFS) SyncPolicy(dir string) (FakeSyncPolicy, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if p := f.policyForPath(path.Clean(dir)); p != nil {
+		return *p, true
+	}
+	return FakeSyncPolicy{}, false
+}
+
+func (f *FakeOneFS) SyncPolicyCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.policies)
+}
+
+// RunSyncPolicy records a job of the policy replicating dir that ended in
+// state, as if its schedule had run it. A "finished" job is a success.
+func (f *FakeOneFS) RunSyncPolicy(dir, state string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if p := f.policyForPath(path.Clean(dir)); p != nil {
+		p.LastJobState = state
+		if state == "finished" {
+			p.LastSuccess = time.Now().Unix()
+		}
+	}
+}
+
+// FilePoolPolicy returns the file pool policy named name.
+func (f *FakeOneFS) FilePoolPolicy(name string) (FakeFilePoolPolicy, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if p, ok := f.filePools[name]; ok {
+		return *p, true
+	}
+	return FakeFilePoolPolicy{}, false
+}
+
+func (f *FakeOneFS) FilePoolPolicyCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.filePools)
+}
+
+// Jobs returns the jobs started so far, oldest first.
+func (f *FakeOneFS) Jobs() []FakeJob {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([]FakeJob{}, f.jobs...)
+}
+
+// FailRequests makes every request with the given method whose URL path
+// starts with prefix fail with a 500 until ClearFailures is called.
+func (f *FakeOneFS) FailRequests(method, prefix string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failures = append(f.failures, failure{method: method, prefix: prefix})
+}
+
+func (f *FakeOneFS) ClearFailures() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.failures = nil
+}
+
+// HoldRequest makes the next request with the given method whose URL path
+// starts with prefix wait until release is called. held is closed once the
+// request is waiting.
+func (f *FakeOneFS) HoldRequest(method, prefix string) (held <-chan struct{}, release func()) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	h := &hold{method: method, prefix: prefix, held: make(chan struct{}), released: make(chan struct{})}
+	f.holds = append(f.holds, h)
+	return h.held, func() { close(h.released) }
+}
+
+// takeHold removes and returns the hold that matches r, if there is one.
+func (f *FakeOneFS) takeHold(r *http.Request) *hold {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i, h := range f.holds {
+		if r.Method == h.method && strings.HasPrefix(r.URL.Path, h.prefix) {
+			f.holds = append(f.holds[:i], f.holds[i+1:]...)
+			return h
+		}
+	}
+	return nil
+}
+
+// Connections returns how many times a client has connected, which goisilon
+// does by reading the latest version of the platform API.
+func (f *FakeOneFS) Connections() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.connections
+}
+
+// ExpireSession makes the next request that is not a client connecting fail
+// with a 401, as it does once the session of a client has expired.
+func (f *FakeOneFS) ExpireSession() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.expired = true
+}
+
+// SetUnreachable makes the cluster close every connection without answering,
+// or answer again.
+func (f *FakeOneFS) SetUnreachable(unreachable bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.unreachable = unreachable
+}
+
+func (f *FakeOneFS) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if h := f.takeHold(r); h != nil {
+		close(h.held)
+		<-h.released
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.unreachable {
+		if conn, _, err := w.(http.Hijacker).Hijack(); err == nil {
+			conn.Close()
+		}
+		return
+	}
+
+	if user, pass, ok := r.BasicAuth(); !ok || user != f.username || pass != f.password {
+		writeError(w, http.StatusUnauthorized, "AEC_UNAUTHORIZED", "authorization required")
+		return
+	}
+
+	connecting := strings.TrimSuffix(r.URL.Path, "/") == "/platform/latest"
+	if connecting {
+		f.connections++
+	} else if f.expired {
+		f.expired = false
+		writeError(w, http.StatusUnauthorized, "AEC_UNAUTHORIZED", "session expired")
+		return
+	}
+
+	for _, fail := range f.failures {
+		if r.Method == fail.method && strings.HasPrefix(r.URL.Path, fail.prefix) {
+			writeError(w, http.StatusInternalServerError, "AEC_SYSTEM_INTERNAL_ERROR", "injected failure")
+			return
+		}
+	}
+
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	switch {
+	case p == "/platform/latest":
+		writeJSON(w, http.StatusOK, map[string]string{"latest": "3"})
+	case strings.HasPrefix(p, namespacePrefix+"/"):
+		f.serveNamespace(w, r, path.Clean(strings.TrimPrefix(p, namespacePrefix)))
+	case strings.HasPrefix(p, "/platform/") && strings.Contains(p, exportsSuffix):
+		f.serveExports(w, r, resourceID(p, exportsSuffix))
+	case strings.HasPrefix(p, "/platform/") && strings.Contains(p, sharesSuffix):
+		f.serveShares(w, r, resourceID(p, sharesSuffix))
+	case strings.HasPrefix(p, "/platform/") && strings.Contains(p, quotasSuffix):
+		f.serveQuotas(w, r, resourceID(p, quotasSuffix))
+	case strings.HasPrefix(p, "/platform/") && strings.Contains(p, snapshotsSuffix):
+		f.serveSnapshots(w, r, resourceID(p, snapshotsSuffix))
+	case strings.HasPrefix(p, "/platform/") && strings.Contains(p, schedulesSuffix):
+		f.serveSchedules(w, r, resourceID(p, schedulesSuffix))
+	case strings.HasPrefix(p, "/platform/") && strings.Contains(p, policiesSuffix):
+		f.servePolicies(w, r, resourceID(p, policiesSuffix))
+	case strings.HasPrefix(p, "/platform/") && strings.Contains(p, filePoolsSuffix):
+		f.serveFilePools(w, r, resourceID(p, filePoolsSuffix))
+	case strings.HasPrefix(p, "/platform/") && strings.HasSuffix(p, jobsSuffix):
+		f.serveJobs(w, r)
+	default:
+		writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("no such resource %s", p))
+	}
+}
+
+func (f *FakeOneFS) serveNamespace(w http.ResponseWriter, r *http.Request, dir string) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := f.dirs[dir]; !ok {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("path %s not found", dir))
+			return
+		}
+		if _, ok := query["metadata"]; ok {
+			writeJSON(w, http.StatusOK, map[string]interface{}{"attrs": []interface{}{
+				map[string]interface{}{"name": "type", "value": "container"},
+				map[string]interface{}{"name": "owner", "value": f.dirs[dir].Owner},
+				map[string]interface{}{"name": "group", "value": f.dirs[dir].Group},
+			}})
+			return
+		}
+		children := []interface{}{}
+		for _, name := range f.children(dir) {
+			children = append(children, map[string]string{"name": name})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"children": children})
+
+	case http.MethodPut:
+		if source := r.Header.Get("x-isi-ifs-copy-source"); source != "" {
+			f.copyDirectory(w, r, path.Clean(strings.TrimPrefix(source, namespacePrefix)), dir)
+			return
+		}
+		if _, ok := query["acl"]; ok {
+			d, ok := f.dirs[dir]
+			if !ok {
+				writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("path %s not found", dir))
+				return
+			}
+			var acl struct {
+				Authoritative string                     `json:"authoritative"`
+				Mode          string                     `json:"mode"`
+				Owner         *struct{ Name, ID string } `json:"owner"`
+				Group         *struct{ Name, ID string } `json:"group"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&acl); err != nil {
+				writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+				return
+			}
+			if acl.Authoritative == "mode" {
+				if _, err := strconv.ParseUint(acl.Mode, 8, 32); err != nil {
+					writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("invalid mode %q", acl.Mode))
+					return
+				}
+				d.Mode = acl.Mode
+			}
+			if acl.Owner != nil {
+				d.Owner = acl.Owner.Name
+				if acl.Owner.ID != "" {
+					d.Owner = acl.Owner.ID
+				}
+			}
+			if acl.Group != nil {
+				d.Group = acl.Group.Name
+				if acl.Group.ID != "" {
+					d.Group = acl.Group.ID
+				}
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{})
+			return
+		}
+		if _, ok := query["recursive"]; ok {
+			for parent := path.Dir(dir); parent != "/"; parent = path.Dir(parent) {
+				if _, ok := f.dirs[parent]; !ok {
+					f.dirs[parent] = &FakeDirectory{Owner: f.username}
+				}
+			}
+		}
+		if _, ok := f.dirs[path.Dir(dir)]; !ok {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("parent of %s not found", dir))
+			return
+		}
+		if _, ok := f.dirs[dir]; !ok {
+			f.dirs[dir] = &FakeDirectory{Owner: f.username}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+
+	case http.MethodPost:
+		dest := r.Header.Get("x-isi-ifs-set-location")
+		if dest == "" {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "x-isi-ifs-set-location is required")
+			return
+		}
+		f.moveDirectory(w, dir, path.Clean(strings.TrimPrefix(dest, namespacePrefix)))
+
+	case http.MethodDelete:
+		if _, ok := f.dirs[dir]; !ok {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("path %s not found", dir))
+			return
+		}
+		if len(f.children(dir)) > 0 && query.Get("recursive") != "true" {
+			writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("directory %s not empty", dir))
+			return
+		}
+		for p := range f.dirs {
+			if p == dir || strings.HasPrefix(p, dir+"/") {
+				delete(f.dirs, p)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{})
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+// copyDirectory copies the directory tree at source, which may lie within a
+// snapshot under /ifs/.snapshot, to dest.
+func (f *FakeOneFS) copyDirectory(w http.ResponseWriter, r *http.Request, source, dest string) {
+	tree, ok := f.tree(source)
+	if !ok {
+		writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("path %s not found", source))
+		return
+	}
+	if _, ok := f.dirs[path.Dir(dest)]; !ok {
+		writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("parent of %s not found", dest))
+		return
+	}
+	if _, ok := f.dirs[dest]; ok && r.URL.Query().Get("merge") != "true" {
+		writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("path %s already exists", dest))
+		return
+	}
+	// like OneFS, a copy that would take a quota past its hard limit fails
+	data := f.data(source)
+	quota := f.quotaForPath(dest)
+	if quota != nil && quota.Thresholds.Hard != nil && data > *quota.Thresholds.Hard {
+		writeError(w, http.StatusInsufficientStorage, "AEC_EXCEEDED", fmt.Sprintf("disk quota exceeded on %s", dest))
+		return
+	}
+	if quota != nil {
+		quota.Usage.Logical = data
+	}
+
+	for rel, d := range tree {
+		copied := d
+		f.dirs[path.Join(dest, rel)] = &copied
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// moveDirectory moves the directory tree at source to dest.
+func (f *FakeOneFS) moveDirectory(w http.ResponseWriter, source, dest string) {
+	if _, ok := f.dirs[source]; !ok {
+		writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("path %s not found", source))
+		return
+	}
+	if _, ok := f.dirs[path.Dir(dest)]; !ok {
+		writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("parent of %s not found", dest))
+		return
+	}
+	if _, ok := f.dirs[dest]; ok {
+		writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("path %s already exists", dest))
+		return
+	}
+
+	moved := map[string]*FakeDirectory{}
+	for p, d := range f.dirs {
+		if p == source || strings.HasPrefix(p, source+"/") {
+			moved[dest+strings.TrimPrefix(p, source)] = d
+			delete(f.dirs, p)
+		}
+	}
+	for p, d := range moved {
+		f.dirs[p] = d
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{})
+}
+
+// data is the logical usage of the quota on the directory at source, or of
+// the one it had when snapshotted for a directory in a snapshot.
+func (f *FakeOneFS) data(source string) int64 {
+	if strings.HasPrefix(source, "/ifs/.snapshot/") {
+		name := strings.SplitN(strings.TrimPrefix(source, "/ifs/.snapshot/"), "/", 2)[0]
+		for _, s := range f.snapshots {
+			if s.Name == name {
+				return s.data
+			}
+		}
+		return 0
+	}
+	if q := f.quotaForPath(source); q != nil {
+		return q.Usage.Logical
+	}
+	return 0
+}
+
+// tree returns the directories at and under dir, keyed by their path
+// relative to it.
+func (f *FakeOneFS) tree(dir string) (map[string]FakeDirectory, bool) {
+	contents := map[string]FakeDirectory{}
+	for p, d := range f.dirs {
+		contents[p] = *d
+	}
+	root := dir
+
+	if strings.HasPrefix(dir, "/ifs/.snapshot/") {
+		parts := strings.SplitN(strings.TrimPrefix(dir, "/ifs/.snapshot/"), "/", 2)
+		var snapshot *FakeSnapshot
+		for _, s := range f.snapshots {
+			if s.Name == parts[0] {
+				snapshot = s
+			}
+		}
+		if snapshot == nil || len(parts) < 2 {
+			return nil, false
+		}
+		contents = map[string]FakeDirectory{}
+		for rel, d := range snapshot.contents {
+			contents[path.Join(snapshot.Path, rel)] = d
+		}
+		root = path.Join("/ifs", parts[1])
+	}
+
+	tree := map[string]FakeDirectory{}
+	for p, d := range contents {
+		if p == root || strings.HasPrefix(p, root+"/") {
+			tree[strings.TrimPrefix(p, root)] = d
+		}
+	}
+	if len(tree) == 0 {
+		return nil, false
+	}
+	return tree, true
+}
+
+func (f *FakeOneFS) serveExports(w http.ResponseWriter, r *http.Request, id string) {
+	// like OneFS, requests without a zone parameter are for the System zone
+	zone := r.URL.Query().Get("zone")
+	if zone == "" {
+		zone = systemZone
+	}
+
+	var export *FakeExport
+	if id != "" {
+		n, err := strconv.Atoi(id)
+		if err == nil {
+			export = f.exports[n]
+		}
+		if export == nil || export.Zone != zone {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("export %s not found", id))
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && export == nil:
+		list := []*FakeExport{}
+		for _, n := range f.sortedExportIDs() {
+			if f.exports[n].Zone == zone {
+				list = append(list, f.exports[n])
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"exports": list, "total": len(list)})
+
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"exports": []*FakeExport{export}})
+
+	case r.Method == http.MethodPost && export == nil:
+		created := &FakeExport{}
+		if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if len(created.Paths) == 0 {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "paths is required")
+			return
+		}
+		for _, p := range created.Paths {
+			if _, ok := f.dirs[path.Clean(p)]; !ok {
+				writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("path %s does not exist", p))
+				return
+			}
+		}
+		if len(created.SecurityFlavors) == 0 {
+			created.SecurityFlavors = []string{"unix"}
+		}
+		if !validSecurityFlavors(w, created.SecurityFlavors) {
+			return
+		}
+		created.ID = f.nextExportID
+		created.Zone = zone
+		f.nextExportID++
+		f.exports[created.ID] = created
+		writeJSON(w, http.StatusCreated, map[string]int{"id": created.ID})
+
+	case r.Method == http.MethodPut && export != nil:
+		updated := *export
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if !validSecurityFlavors(w, updated.SecurityFlavors) {
+			return
+		}
+		updated.ID, updated.Zone = export.ID, export.Zone
+		*export = updated
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && export != nil:
+		delete(f.exports, export.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+func (f *FakeOneFS) serveShares(w http.ResponseWriter, r *http.Request, name string) {
+	zone := r.URL.Query().Get("zone")
+	if zone == "" {
+		zone = systemZone
+	}
+
+	var share *FakeShare
+	if name != "" {
+		share = f.shares[shareKey(zone, name)]
+		if share == nil {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("share %s not found", name))
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && share == nil:
+		list := []*FakeShare{}
+		for _, s := range f.shares {
+			if s.Zone == zone {
+				list = append(list, s)
+			}
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"shares": list, "total": len(list)})
+
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"shares": []*FakeShare{share}})
+
+	case r.Method == http.MethodPost && share == nil:
+		created := &FakeShare{}
+		if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if created.Name == "" || created.Path == "" {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "name and path are required")
+			return
+		}
+		created.Path = path.Clean(created.Path)
+		if _, ok := f.dirs[created.Path]; !ok {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("path %s does not exist", created.Path))
+			return
+		}
+		if _, ok := f.shares[shareKey(zone, created.Name)]; ok {
+			writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("share %s already exists", created.Name))
+			return
+		}
+		created.Zone = zone
+		f.shares[shareKey(zone, created.Name)] = created
+		writeJSON(w, http.StatusCreated, map[string]string{"id": created.Name})
+
+	case r.Method == http.MethodDelete && share != nil:
+		delete(f.shares, shareKey(zone, share.Name))
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+// shareKey identifies a share; share names are unique within an access zone.
+func shareKey(zone, name string) string {
+	return zone + "/" + name
+}
+
+// validSecurityFlavors checks that an export allows at least one flavor and
+// only flavors OneFS knows.
+func validSecurityFlavors(w http.ResponseWriter, flavors []string) bool {
+	if len(flavors) == 0 {
+		writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "security_flavors cannot be empty")
+		return false
+	}
+	for _, flavor := range flavors {
+		switch flavor {
+		case "unix", "krb5", "krb5i", "krb5p":
+		default:
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("unknown security flavor %s", flavor))
+			return false
+		}
+	}
+	return true
+}
+
+func (f *FakeOneFS) serveQuotas(w http.ResponseWriter, r *http.Request, id string) {
+	var quota *FakeQuota
+	if id != "" {
+		if quota = f.quotas[id]; quota == nil {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("quota %s not found", id))
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && quota == nil:
+		list := []*FakeQuota{}
+		for _, q := range f.sortedQuotas() {
+			if p := r.URL.Query().Get("path"); p == "" || p == q.Path {
+				list = append(list, q)
+			}
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"quotas": list, "total": len(list)})
+
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"quotas": []*FakeQuota{quota}})
+
+	case r.Method == http.MethodPost && quota == nil:
+		created := &FakeQuota{}
+		if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if !validThresholds(w, created.Thresholds) {
+			return
+		}
+		created.Path = path.Clean(created.Path)
+		if _, ok := f.dirs[created.Path]; !ok {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("path %s does not exist", created.Path))
+			return
+		}
+		if f.quotaForPath(created.Path) != nil {
+			writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("quota already exists on %s", created.Path))
+			return
+		}
+		created.ID = fmt.Sprintf("quota-%d", f.nextQuotaID)
+		f.nextQuotaID++
+		f.quotas[created.ID] = created
+		writeJSON(w, http.StatusCreated, map[string]string{"id": created.ID})
+
+	case r.Method == http.MethodPut && quota != nil:
+		updated := *quota
+		if err := json.NewDecoder(r.Body).Decode(&updated); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if !validThresholds(w, updated.Thresholds) {
+			return
+		}
+		updated.ID, updated.Path, updated.Usage = quota.ID, quota.Path, quota.Usage
+		*quota = updated
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && quota != nil:
+		delete(f.quotas, quota.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete:
+		q := f.quotaForPath(path.Clean(r.URL.Query().Get("path")))
+		if q == nil {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("no quota on %s", r.URL.Query().Get("path")))
+			return
+		}
+		delete(f.quotas, q.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+func (f *FakeOneFS) serveSnapshots(w http.ResponseWriter, r *http.Request, id string) {
+	var snapshot *FakeSnapshot
+	if id != "" {
+		// like OneFS, a snapshot can be addressed by its ID or its name
+		for _, s := range f.snapshots {
+			if strconv.FormatInt(s.ID, 10) == id || s.Name == id {
+				snapshot = s
+			}
+		}
+		if snapshot == nil {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("snapshot %s not found", id))
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && snapshot == nil:
+		list := f.sortedSnapshots()
+		writeJSON(w, http.StatusOK, map[string]interface{}{"snapshots": list, "total": len(list)})
+
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"snapshots": []*FakeSnapshot{snapshot}})
+
+	case r.Method == http.MethodPost && snapshot == nil:
+		var body struct {
+			Name string `json:"name"`
+			Path string `json:"path"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if _, ok := f.dirs[path.Clean(body.Path)]; !ok {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("path %s does not exist", body.Path))
+			return
+		}
+		for _, s := range f.snapshots {
+			if body.Name != "" && s.Name == body.Name {
+				writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("snapshot %s already exists", body.Name))
+				return
+			}
+		}
+		writeJSON(w, http.StatusCreated, f.takeSnapshot(path.Clean(body.Path), body.Name))
+
+	case r.Method == http.MethodDelete && snapshot != nil:
+		delete(f.snapshots, snapshot.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+func (f *FakeOneFS) serveSchedules(w http.ResponseWriter, r *http.Request, id string) {
+	var schedule *FakeSnapshotSchedule
+	if id != "" {
+		for _, s := range f.schedules {
+			if strconv.FormatInt(s.ID, 10) == id || s.Name == id {
+				schedule = s
+			}
+		}
+		if schedule == nil {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("schedule %s not found", id))
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && schedule == nil:
+		list := []*FakeSnapshotSchedule{}
+		for _, s := range f.schedules {
+			list = append(list, s)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"schedules": list, "total": len(list)})
+
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"schedules": []*FakeSnapshotSchedule{schedule}})
+
+	case r.Method == http.MethodPost && schedule == nil:
+		created := &FakeSnapshotSchedule{}
+		if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		created.Path = path.Clean(created.Path)
+		if _, ok := f.dirs[created.Path]; !ok {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("path %s does not exist", created.Path))
+			return
+		}
+		if created.Name == "" || created.Schedule == "" || created.Pattern == "" {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "name, pattern and schedule are required")
+			return
+		}
+		if _, ok := f.schedules[created.Name]; ok {
+			writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("schedule %s already exists", created.Name))
+			return
+		}
+		created.ID = int64(len(f.schedules) + 1)
+		for _, s := range f.schedules {
+			if s.ID >= created.ID {
+				created.ID = s.ID + 1
+			}
+		}
+		f.schedules[created.Name] = created
+		writeJSON(w, http.StatusCreated, map[string]int64{"id": created.ID})
+
+	case r.Method == http.MethodDelete && schedule != nil:
+		delete(f.schedules, schedule.Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+func (f *FakeOneFS) servePolicies(w http.ResponseWriter, r *http.Request, id string) {
+	var policy *FakeSyncPolicy
+	if id != "" {
+		for _, p := range f.policies {
+			if p.ID == id || p.Name == id {
+				policy = p
+			}
+		}
+		if policy == nil {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("policy %s not found", id))
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && policy == nil:
+		list := []*FakeSyncPolicy{}
+		for _, p := range f.policies {
+			list = append(list, p)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"policies": list, "total": len(list)})
+
+	case r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"policies": []*FakeSyncPolicy{policy}})
+
+	case r.Method == http.MethodPost && policy == nil:
+		created := &FakeSyncPolicy{}
+		if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if created.Name == "" || created.Action == "" || created.SourceRootPath == "" || created.TargetHost == "" || created.TargetPath == "" {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "name, action, source_root_path, target_host and target_path are required")
+			return
+		}
+		if !f.validPolicy(w, created) {
+			return
+		}
+		if _, ok := f.policies[created.Name]; ok {
+			writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("policy %s already exists", created.Name))
+			return
+		}
+		created.ID = fmt.Sprintf("%032x", f.nextPolicyID)
+		f.nextPolicyID++
+		f.policies[created.Name] = created
+		writeJSON(w, http.StatusCreated, map[string]string{"id": created.ID})
+
+	case r.Method == http.MethodPut && policy != nil:
+		// only the fields present in the body change
+		modified := *policy
+		if err := json.NewDecoder(r.Body).Decode(&modified); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if modified.Name != policy.Name || modified.ID != policy.ID {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "policies cannot be renamed")
+			return
+		}
+		if !f.validPolicy(w, &modified) {
+			return
+		}
+		*policy = modified
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && policy != nil:
+		delete(f.policies, policy.Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+func (f *FakeOneFS) serveFilePools(w http.ResponseWriter, r *http.Request, name string) {
+	var policy *FakeFilePoolPolicy
+	if name != "" {
+		policy = f.filePools[name]
+		if policy == nil {
+			writeError(w, http.StatusNotFound, "AEC_NOT_FOUND", fmt.Sprintf("file pool policy %s not found", name))
+			return
+		}
+	}
+
+	switch {
+	case r.Method == http.MethodGet && policy != nil:
+		writeJSON(w, http.StatusOK, map[string]interface{}{"policies": []*FakeFilePoolPolicy{policy}})
+
+	case r.Method == http.MethodPost && policy == nil:
+		created := &FakeFilePoolPolicy{}
+		if err := json.NewDecoder(r.Body).Decode(created); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		if created.Name == "" || created.Path() == "" || created.StorageTarget() == "" {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "name, a path pattern and a storage target are required")
+			return
+		}
+		if _, ok := f.filePools[created.Name]; ok {
+			writeError(w, http.StatusConflict, "AEC_CONFLICT", fmt.Sprintf("file pool policy %s already exists", created.Name))
+			return
+		}
+		f.filePools[created.Name] = created
+		writeJSON(w, http.StatusCreated, map[string]string{"id": created.Name})
+
+	case r.Method == http.MethodPut && policy != nil:
+		modified := *policy
+		if err := json.NewDecoder(r.Body).Decode(&modified); err != nil {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+			return
+		}
+		modified.Name = policy.Name
+		*policy = modified
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == http.MethodDelete && policy != nil:
+		delete(f.filePools, policy.Name)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+	}
+}
+
+func (f *FakeOneFS) serveJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "AEC_BAD_REQUEST", r.Method)
+		return
+	}
+	job := FakeJob{}
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", err.Error())
+		return
+	}
+	for _, p := range job.Paths {
+		if _, ok := f.dirs[path.Clean(p)]; !ok {
+			writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("path %s does not exist", p))
+			return
+		}
+	}
+	f.jobs = append(f.jobs, job)
+	writeJSON(w, http.StatusCreated, map[string]int{"id": len(f.jobs)})
+}
+
+// validThresholds rejects a soft threshold without a grace period, as OneFS
+// does.
+func validThresholds(w http.ResponseWriter, thresholds FakeQuotaThresholds) bool {
+	if thresholds.Soft != nil && (thresholds.SoftGrace == nil || *thresholds.SoftGrace <= 0) {
+		writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", "a soft threshold needs a soft_grace")
+		return false
+	}
+	return true
+}
+
+// validPolicy checks the source of a policy, which must exist, and its
+// target path, which OneFS requires to be under /ifs.
+func (f *FakeOneFS) validPolicy(w http.ResponseWriter, policy *FakeSyncPolicy) bool {
+	policy.SourceRootPath = path.Clean(policy.SourceRootPath)
+	if _, ok := f.dirs[policy.SourceRootPath]; !ok {
+		writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("path %s does not exist", policy.SourceRootPath))
+		return false
+	}
+	if !strings.HasPrefix(path.Clean(policy.TargetPath)+"/", "/ifs/") {
+		writeError(w, http.StatusBadRequest, "AEC_BAD_REQUEST", fmt.Sprintf("target path %s is not under /ifs", policy.TargetPath))
+		return false
+	}
+	return true
+}
+
+func (f *FakeOneFS) takeSnapshot(dir, name string) *FakeSnapshot {
+	snapshot := &FakeSnapshot{
+		ID:      f.nextSnapID,
+		Name:    name,
+		Path:    dir,
+		Created: time.Now().Unix(),
+		State:   "active",
+	}
+	if snapshot.Name == "" {
+		snapshot.Name = fmt.Sprintf("s%d", snapshot.ID)
+	}
+	snapshot.contents, _ = f.tree(dir)
+	if q := f.quotaForPath(dir); q != nil {
+		snapshot.data = q.Usage.Logical
+	}
+	f.nextSnapID++
+	f.snapshots[snapshot.ID] = snapshot
+	return snapshot
+}
+
+func (f *FakeOneFS) children(dir string) []string {
+	names := []string{}
+	for p := range f.dirs {
+		if path.Dir(p) == dir && p != dir {
+			names = append(names, path.Base(p))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *FakeOneFS) exportForPath(dir string) *FakeExport {
+	for _, n := range f.sortedExportIDs() {
+		for _, p := range f.exports[n].Paths {
+			if path.Clean(p) == dir {
+				return f.exports[n]
+			}
+		}
+	}
+	return nil
+}
+
+func (f *FakeOneFS) quotaForPath(dir string) *FakeQuota {
+	for _, q := range f.sortedQuotas() {
+		if q.Path == dir {
+			return q
+		}
+	}
+	return nil
+}
+
+func (f *FakeOneFS) policyForPath(dir string) *FakeSyncPolicy {
+	for _, p := range f.policies {
+		if p.SourceRootPath == dir {
+			return p
+		}
+	}
+	return nil
+}
+
+func (f *FakeOneFS) sortedSnapshots() []*FakeSnapshot {
+	list := []*FakeSnapshot{}
+	for _, s := range f.snapshots {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (f *FakeOneFS) sortedExportIDs() []int {
+	ids := []int{}
+	for id := range f.exports {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (f *FakeOneFS) sortedQuotas() []*FakeQuota {
+	list := []*FakeQuota{}
+	for _, q := range f.quotas {
+		list = append(list, q)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// resourceID returns whatever follows the collection suffix in an API path,
+// e.g. "7" for /platform/2/protocols/nfs/exports/7.
+func resourceID(p, suffix string) string {
+	i := strings.Index(p, suffix)
+	return strings.Trim(p[i+len(suffix):], "/")
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string][]apiError{"errors": {{Code: code, Message: message}}})
+}
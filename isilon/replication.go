@@ -0,0 +1,143 @@
+package isilon
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+)
+
+const syncPoliciesPath = "platform/1/sync/policies"
+
+// ErrReplicationPolicyNotFound is returned by ReplicationStatus when the
+// volume has no replication policy.
+var ErrReplicationPolicyNotFound = errors.New("replication policy not found")
+
+// ReplicationPolicy is a SyncIQ policy that copies a volume to a directory on
+// another cluster.
+type ReplicationPolicy struct {
+	// TargetHost is the SmartConnect name or address of the target cluster.
+	TargetHost string
+	TargetPath string
+	// Schedule is in the OneFS schedule syntax, e.g. "Every day at 12:00 AM".
+	Schedule string
+}
+
+// ReplicationStatus is the state of the latest job of a volume's replication
+// policy, such as "finished", "running" or "failed", and empty before its
+// first job. LastSuccess is the start of the last job that succeeded, in
+// seconds since the epoch, and zero if none has.
+type ReplicationStatus struct {
+	State       string
+	LastSuccess int64
+}
+
+type syncPolicy struct {
+	ID             string `json:"id,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Action         string `json:"action,omitempty"`
+	SourceRootPath string `json:"source_root_path,omitempty"`
+	TargetHost     string `json:"target_host,omitempty"`
+	TargetPath     string `json:"target_path,omitempty"`
+	Schedule       string `json:"schedule,omitempty"`
+	Enabled        *bool  `json:"enabled,omitempty"`
+	LastJobState   string `json:"last_job_state,omitempty"`
+	LastSuccess    int64  `json:"last_success,omitempty"`
+}
+
+// ReplicationPolicyName is the name of the SyncIQ policy the broker keeps for
+// a volume.
+func ReplicationPolicyName(name string) string {
+	return "isilon-nfs-broker-" + name
+}
+
+// SetReplicationPolicy creates the replication policy of a volume, or
+// modifies it in place so that SyncIQ keeps its record of what has already
+// been copied.
+func (c *client) SetReplicationPolicy(ctx context.Context, name string, policy ReplicationPolicy) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	enabled := true
+	body := syncPolicy{
+		SourceRootPath: cli.API.VolumePath(name),
+		TargetHost:     policy.TargetHost,
+		TargetPath:     policy.TargetPath,
+		Schedule:       policy.Schedule,
+		Enabled:        &enabled,
+	}
+
+	var resp struct {
+		Policies []syncPolicy `json:"policies"`
+	}
+	err = cli.API.Get(ctx, syncPoliciesPath, ReplicationPolicyName(name), nil, nil, &resp)
+	if isNotFound(err) {
+		body.Name = ReplicationPolicyName(name)
+		body.Action = "sync"
+		return cli.API.Post(ctx, syncPoliciesPath, "", nil, nil, body, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Policies) > 0 && path.Clean(resp.Policies[0].SourceRootPath) != path.Clean(body.SourceRootPath) {
+		return fmt.Errorf("replication policy %s already replicates %s", ReplicationPolicyName(name), resp.Policies[0].SourceRootPath)
+	}
+	return cli.API.Put(ctx, syncPoliciesPath, ReplicationPolicyName(name), nil, nil, body, nil)
+}
+
+// ClearReplicationPolicy removes the replication policy of a volume. A policy
+// of the same name for another directory with the same base name is not the
+// volume's, and is left alone.
+func (c *client) ClearReplicationPolicy(ctx context.Context, name string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Policies []syncPolicy `json:"policies"`
+	}
+	err = cli.API.Get(ctx, syncPoliciesPath, ReplicationPolicyName(name), nil, nil, &resp)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Policies) == 0 || path.Clean(resp.Policies[0].SourceRootPath) != path.Clean(cli.API.VolumePath(name)) {
+		return nil
+	}
+
+	err = cli.API.Delete(ctx, syncPoliciesPath, ReplicationPolicyName(name), nil, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *client) ReplicationStatus(ctx context.Context, name string) (ReplicationStatus, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return ReplicationStatus{}, err
+	}
+
+	var resp struct {
+		Policies []syncPolicy `json:"policies"`
+	}
+	err = cli.API.Get(ctx, syncPoliciesPath, ReplicationPolicyName(name), nil, nil, &resp)
+	if isNotFound(err) {
+		return ReplicationStatus{}, ErrReplicationPolicyNotFound
+	}
+	if err != nil {
+		return ReplicationStatus{}, err
+	}
+	if len(resp.Policies) == 0 {
+		return ReplicationStatus{}, fmt.Errorf("replication policy %s was returned empty", ReplicationPolicyName(name))
+	}
+	if path.Clean(resp.Policies[0].SourceRootPath) != path.Clean(cli.API.VolumePath(name)) {
+		return ReplicationStatus{}, ErrReplicationPolicyNotFound
+	}
+	return ReplicationStatus{State: resp.Policies[0].LastJobState, LastSuccess: resp.Policies[0].LastSuccess}, nil
+}
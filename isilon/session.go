@@ -0,0 +1,217 @@
+package isilon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sync"
+
+	"github.com/thecodeteam/goisilon"
+	"github.com/thecodeteam/goisilon/api"
+)
+
+// endpoint is a cluster and the credentials the broker uses on it, which is
+// all a connection depends on.
+type endpoint struct {
+	URL      string
+	Insecure bool
+	Username string
+	Password string
+	Group    string
+}
+
+func endpointOf(config Config) endpoint {
+	return endpoint{
+		URL:      config.Endpoint,
+		Insecure: config.Insecure,
+		Username: config.Username,
+		Password: config.Password,
+		Group:    config.Group,
+	}
+}
+
+// sessions holds the session of every endpoint a client has been created
+// for, so that clients for the same cluster and credentials share one
+// connection, whatever their volume paths. There is one for each cluster in
+// the clusters file, however many directories clients are made for.
+var sessions = struct {
+	sync.Mutex
+	byEndpoint map[endpoint]*session
+}{byEndpoint: map[endpoint]*session{}}
+
+// session is a long-lived connection to a cluster. It connects when it is
+// first used, connects again when the cluster refuses its credentials, as it
+// does once a session has expired, and drops the connection when the cluster
+// cannot be reached, so that the next request connects afresh.
+//
+// It sends the requests of the goisilon API client on whichever connection
+// is current; the volume path of each request comes from the client that
+// makes it, by way of volumes.
+type session struct {
+	config     Config
+	mutex      sync.Mutex
+	current    api.Client
+	apiVersion uint8
+}
+
+// volumes is a session as seen by a client with its own volume path, which
+// the goisilon helpers build the paths of volumes from.
+type volumes struct {
+	*session
+	volumePath string
+}
+
+func (v volumes) VolumesPath() string {
+	return v.volumePath
+}
+
+func (v volumes) VolumePath(name string) string {
+	return path.Join(v.volumePath, name)
+}
+
+// sessionFor returns the session shared by every client for the endpoint of
+// config, connecting if there is none yet. A connection that fails is not
+// kept, so the next request tries again.
+func sessionFor(ctx context.Context, config Config) (*session, error) {
+	sessions.Lock()
+	s, ok := sessions.byEndpoint[endpointOf(config)]
+	if !ok {
+		s = &session{config: config}
+		sessions.byEndpoint[endpointOf(config)] = s
+	}
+	sessions.Unlock()
+
+	if _, err := s.connection(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// connection returns the current connection, connecting if there is none.
+// Requests that find no connection wait for the one that is connecting, so
+// the cluster sees a single handshake.
+func (s *session) connection(ctx context.Context) (api.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current != nil {
+		return s.current, nil
+	}
+
+	cli, err := goisilon.NewClientWithArgs(
+		ctx,
+		s.config.Endpoint,
+		s.config.Insecure,
+		s.config.Username,
+		s.config.Group,
+		s.config.Password,
+		s.config.VolumePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create isilon client with error %s", err)
+	}
+	s.apiVersion = cli.API.APIVersion()
+	s.current = cli.API
+	return s.current, nil
+}
+
+// drop forgets a connection, unless another request has already replaced it.
+func (s *session) drop(cli api.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current == cli {
+		s.current = nil
+	}
+}
+
+// send makes a request on the current connection. A request the cluster
+// refused as unauthorized did nothing, so it is sent once more on a new
+// connection. A request that could not reach the cluster may or may not
+// have been carried out, so it is not sent again, but the connection is
+// dropped.
+func (s *session) send(ctx context.Context, request func(cli api.Client) error) error {
+	cli, err := s.connection(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = request(cli)
+	switch {
+	case isUnauthorized(err):
+		s.drop(cli)
+		if cli, err = s.connection(ctx); err != nil {
+			return err
+		}
+		return request(cli)
+	case isUnreachable(err):
+		s.drop(cli)
+	}
+	return err
+}
+
+func (s *session) Do(ctx context.Context, method, path, id string, params api.OrderedValues, body, resp interface{}) error {
+	return s.send(ctx, func(cli api.Client) error {
+		return cli.Do(ctx, method, path, id, params, body, resp)
+	})
+}
+
+func (s *session) DoWithHeaders(ctx context.Context, method, path, id string, params api.OrderedValues, headers map[string]string, body, resp interface{}) error {
+	return s.send(ctx, func(cli api.Client) error {
+		return cli.DoWithHeaders(ctx, method, path, id, params, headers, body, resp)
+	})
+}
+
+func (s *session) Get(ctx context.Context, path, id string, params api.OrderedValues, headers map[string]string, resp interface{}) error {
+	return s.send(ctx, func(cli api.Client) error {
+		return cli.Get(ctx, path, id, params, headers, resp)
+	})
+}
+
+func (s *session) Post(ctx context.Context, path, id string, params api.OrderedValues, headers map[string]string, body, resp interface{}) error {
+	return s.send(ctx, func(cli api.Client) error {
+		return cli.Post(ctx, path, id, params, headers, body, resp)
+	})
+}
+
+func (s *session) Put(ctx context.Context, path, id string, params api.OrderedValues, headers map[string]string, body, resp interface{}) error {
+	return s.send(ctx, func(cli api.Client) error {
+		return cli.Put(ctx, path, id, params, headers, body, resp)
+	})
+}
+
+func (s *session) Delete(ctx context.Context, path, id string, params api.OrderedValues, headers map[string]string, resp interface{}) error {
+	return s.send(ctx, func(cli api.Client) error {
+		return cli.Delete(ctx, path, id, params, headers, resp)
+	})
+}
+
+// APIVersion is the version of the platform API the cluster offered when
+// the session last connected.
+func (s *session) APIVersion() uint8 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.apiVersion
+}
+
+func (s *session) User() string {
+	return s.config.Username
+}
+
+func (s *session) Group() string {
+	return s.config.Group
+}
+
+func isUnauthorized(err error) bool {
+	jsonErr, ok := err.(*api.JSONError)
+	return ok && jsonErr.StatusCode == http.StatusUnauthorized
+}
+
+// isUnreachable is true of errors that came from the network rather than
+// from the cluster, such as a refused connection or a timeout.
+func isUnreachable(err error) bool {
+	_, ok := err.(net.Error)
+	return ok
+}
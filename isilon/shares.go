@@ -0,0 +1,113 @@
+package isilon
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/thecodeteam/goisilon"
+)
+
+const sharesPath = "platform/1/protocols/smb/shares"
+
+// everyoneSID is the well-known SID of the Everyone group.
+const everyoneSID = "SID:S-1-1-0"
+
+type smbTrustee struct {
+	ID string `json:"id"`
+}
+
+type smbPermission struct {
+	Permission     string     `json:"permission"`
+	PermissionType string     `json:"permission_type"`
+	Trustee        smbTrustee `json:"trustee"`
+}
+
+type smbShare struct {
+	Name        string          `json:"name"`
+	Path        string          `json:"path,omitempty"`
+	Permissions []smbPermission `json:"permissions,omitempty"`
+}
+
+// CreateShare creates the SMB share of a volume in an access zone, named
+// after the volume. Everyone gets full control at the share level, so that
+// what a user may do is decided by the permissions of the directory, as it
+// is over NFS. A share of the volume that already exists is left as it is,
+// but a share of the same name for another directory is an error.
+func (c *client) CreateShare(ctx context.Context, name string, zone string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	share, err := shareOf(ctx, cli, name, zone)
+	if err != nil {
+		return err
+	}
+	if share != nil && path.Clean(share.Path) == path.Clean(cli.API.VolumePath(name)) {
+		return nil
+	}
+	if share != nil {
+		return fmt.Errorf("share %s already shares %s", name, share.Path)
+	}
+
+	body := smbShare{
+		Name: name,
+		Path: cli.API.VolumePath(name),
+		Permissions: []smbPermission{{
+			Permission:     "full",
+			PermissionType: "allow",
+			Trustee:        smbTrustee{ID: everyoneSID},
+		}},
+	}
+	return cli.API.Post(ctx, sharesPath, "", zoneParams(zone), nil, body, nil)
+}
+
+// DeleteShare removes the SMB share of a volume. A share of the same name
+// for another directory belongs to something else and is left alone.
+func (c *client) DeleteShare(ctx context.Context, name string, zone string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	share, err := shareOf(ctx, cli, name, zone)
+	if err != nil || share == nil || path.Clean(share.Path) != path.Clean(cli.API.VolumePath(name)) {
+		return err
+	}
+	err = cli.API.Delete(ctx, sharesPath, name, zoneParams(zone), nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *client) IsShared(ctx context.Context, name string, zone string) (bool, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return false, err
+	}
+	share, err := shareOf(ctx, cli, name, zone)
+	if err != nil || share == nil {
+		return false, err
+	}
+	return path.Clean(share.Path) == path.Clean(cli.API.VolumePath(name)), nil
+}
+
+// shareOf returns the share called name, whatever directory it shares, or
+// nil if there is none.
+func shareOf(ctx context.Context, cli *goisilon.Client, name string, zone string) (*smbShare, error) {
+	var resp struct {
+		Shares []smbShare `json:"shares"`
+	}
+	err := cli.API.Get(ctx, sharesPath, name, zoneParams(zone), nil, &resp)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Shares) == 0 {
+		return nil, fmt.Errorf("share %s was returned empty", name)
+	}
+	return &resp.Shares[0], nil
+}
@@ -0,0 +1,183 @@
+package isilon
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thecodeteam/goisilon"
+	"github.com/thecodeteam/goisilon/api"
+)
+
+const (
+	snapshotsPath         = "platform/1/snapshot/snapshots"
+	snapshotSchedulesPath = "platform/1/snapshot/schedules"
+)
+
+// ErrSnapshotNotFound is returned by DeleteSnapshot when the volume has no
+// snapshot with the given ID.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// SnapshotSchedule is a OneFS snapshot schedule for a volume.
+type SnapshotSchedule struct {
+	// Schedule is in the OneFS schedule syntax, e.g. "Every day every 1 hours".
+	Schedule string
+	// Retention is how long each snapshot is kept for.
+	Retention time.Duration
+}
+
+// Snapshot is a OneFS snapshot of a volume. Times are in seconds since the
+// epoch, Expires is zero for snapshots that are kept until deleted, Size is
+// the number of bytes the snapshot itself takes up, which grows as the volume
+// changes and is not the amount of data in it, and Schedule names the
+// schedule that took it, if one did.
+type Snapshot struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires,omitempty"`
+	Size     int64  `json:"size"`
+	State    string `json:"state"`
+	Schedule string `json:"schedule,omitempty"`
+}
+
+// ContentPath is where the snapshotted directory can be read from.
+func (s Snapshot) ContentPath() string {
+	return path.Join("/ifs/.snapshot", s.Name, strings.TrimPrefix(path.Clean(s.Path), "/ifs"))
+}
+
+type snapshotSchedule struct {
+	ID       int64  `json:"id,omitempty"`
+	Name     string `json:"name"`
+	Path     string `json:"path"`
+	Pattern  string `json:"pattern"`
+	Schedule string `json:"schedule"`
+	Duration int64  `json:"duration,omitempty"`
+}
+
+// SnapshotScheduleName is the name of the snapshot schedule the broker keeps
+// for a volume.
+func SnapshotScheduleName(name string) string {
+	return "isilon-nfs-broker-" + name
+}
+
+func (c *client) SetSnapshotSchedule(ctx context.Context, name string, schedule SnapshotSchedule) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	if err := clearSnapshotSchedule(ctx, cli, name); err != nil {
+		return err
+	}
+
+	body := snapshotSchedule{
+		Name:     SnapshotScheduleName(name),
+		Path:     cli.API.VolumePath(name),
+		Pattern:  name + "_%Y-%m-%d_%H-%M",
+		Schedule: schedule.Schedule,
+		Duration: int64(schedule.Retention / time.Second),
+	}
+	return cli.API.Post(ctx, snapshotSchedulesPath, "", nil, nil, body, nil)
+}
+
+func (c *client) ClearSnapshotSchedule(ctx context.Context, name string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return clearSnapshotSchedule(ctx, cli, name)
+}
+
+func clearSnapshotSchedule(ctx context.Context, cli *goisilon.Client, name string) error {
+	var resp struct {
+		Schedules []snapshotSchedule `json:"schedules"`
+	}
+	err := cli.API.Get(ctx, snapshotSchedulesPath, SnapshotScheduleName(name), nil, nil, &resp)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// a schedule of the same name for another directory with the same base
+	// name is not this volume's
+	if len(resp.Schedules) == 0 || path.Clean(resp.Schedules[0].Path) != path.Clean(cli.API.VolumePath(name)) {
+		return nil
+	}
+
+	err = cli.API.Delete(ctx, snapshotSchedulesPath, SnapshotScheduleName(name), nil, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func (c *client) ListSnapshots(ctx context.Context, name string) ([]Snapshot, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp struct {
+		Snapshots []Snapshot `json:"snapshots"`
+	}
+	if err := cli.API.Get(ctx, snapshotsPath, "", nil, nil, &resp); err != nil {
+		return nil, err
+	}
+
+	volumePath := path.Clean(cli.API.VolumePath(name))
+	snapshots := []Snapshot{}
+	for _, snapshot := range resp.Snapshots {
+		if path.Clean(snapshot.Path) == volumePath {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	return snapshots, nil
+}
+
+func (c *client) CreateSnapshot(ctx context.Context, name string, snapshotName string) (Snapshot, error) {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	body := struct {
+		Path string `json:"path"`
+		Name string `json:"name,omitempty"`
+	}{cli.API.VolumePath(name), snapshotName}
+
+	var snapshot Snapshot
+	if err := cli.API.Post(ctx, snapshotsPath, "", nil, nil, body, &snapshot); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+func (c *client) DeleteSnapshot(ctx context.Context, name string, id int64) error {
+	snapshots, err := c.ListSnapshots(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.ID != id {
+			continue
+		}
+
+		cli, err := c.connect(ctx)
+		if err != nil {
+			return err
+		}
+		return cli.API.Delete(ctx, snapshotsPath, strconv.FormatInt(id, 10), nil, nil, nil)
+	}
+	return ErrSnapshotNotFound
+}
+
+func isNotFound(err error) bool {
+	jsonErr, ok := err.(*api.JSONError)
+	return ok && jsonErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,138 @@
+package isilon
+
+import (
+	"context"
+	"fmt"
+	"path"
+)
+
+const (
+	filePoolPoliciesPath = "platform/1/filepool/policies"
+	jobsPath             = "platform/1/job/jobs"
+)
+
+type filePoolCriterion struct {
+	Type     string `json:"type"`
+	Operator string `json:"operator"`
+	Value    string `json:"value"`
+}
+
+type filePoolCriteria struct {
+	AndCriteria []filePoolCriterion `json:"and_criteria"`
+}
+
+type filePoolPattern struct {
+	OrCriteria []filePoolCriteria `json:"or_criteria"`
+}
+
+type filePoolAction struct {
+	ActionType  string `json:"action_type"`
+	ActionParam string `json:"action_param"`
+}
+
+type filePoolPolicy struct {
+	Name                string           `json:"name,omitempty"`
+	FileMatchingPattern filePoolPattern  `json:"file_matching_pattern"`
+	Actions             []filePoolAction `json:"actions"`
+}
+
+// pathPattern is the path pattern the policy matches, if it matches on one.
+func (p filePoolPolicy) pathPattern() string {
+	for _, criteria := range p.FileMatchingPattern.OrCriteria {
+		for _, criterion := range criteria.AndCriteria {
+			if criterion.Type == "path" {
+				return criterion.Value
+			}
+		}
+	}
+	return ""
+}
+
+// filePoolPolicyName is the name of the file pool policy the broker keeps
+// for a volume.
+func filePoolPolicyName(name string) string {
+	return "isilon-nfs-broker-" + name
+}
+
+// SetStoragePool creates the file pool policy of a volume, which stores
+// everything under the volume in a SmartPools node pool or tier, or points
+// it at another one. A policy of the same name for another directory with
+// the same base name is not the volume's, and is not taken over.
+func (c *client) SetStoragePool(ctx context.Context, name string, pool string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the policy matches every file whose path is under the volume
+	body := filePoolPolicy{
+		FileMatchingPattern: filePoolPattern{OrCriteria: []filePoolCriteria{{
+			AndCriteria: []filePoolCriterion{{Type: "path", Operator: "==", Value: path.Join(cli.API.VolumePath(name), "*")}},
+		}}},
+		Actions: []filePoolAction{{ActionType: "set_data_storage_target", ActionParam: pool}},
+	}
+
+	var resp struct {
+		Policies []filePoolPolicy `json:"policies"`
+	}
+	err = cli.API.Get(ctx, filePoolPoliciesPath, filePoolPolicyName(name), nil, nil, &resp)
+	if isNotFound(err) {
+		body.Name = filePoolPolicyName(name)
+		return cli.API.Post(ctx, filePoolPoliciesPath, "", nil, nil, body, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Policies) > 0 && path.Clean(resp.Policies[0].pathPattern()) != path.Clean(body.FileMatchingPattern.OrCriteria[0].AndCriteria[0].Value) {
+		return fmt.Errorf("file pool policy %s already matches %s", filePoolPolicyName(name), resp.Policies[0].pathPattern())
+	}
+	return cli.API.Put(ctx, filePoolPoliciesPath, filePoolPolicyName(name), nil, nil, body, nil)
+}
+
+// ClearStoragePool removes the file pool policy of a volume. A policy of the
+// same name for another directory with the same base name is not the
+// volume's, and is left alone.
+func (c *client) ClearStoragePool(ctx context.Context, name string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Policies []filePoolPolicy `json:"policies"`
+	}
+	err = cli.API.Get(ctx, filePoolPoliciesPath, filePoolPolicyName(name), nil, nil, &resp)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(resp.Policies) == 0 || path.Clean(resp.Policies[0].pathPattern()) != path.Join(cli.API.VolumePath(name), "*") {
+		return nil
+	}
+
+	err = cli.API.Delete(ctx, filePoolPoliciesPath, filePoolPolicyName(name), nil, nil, nil)
+	if isNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// MoveToStoragePool starts a SmartPoolsTree job on a volume, which moves
+// the data already in it to where its file pool policy says. Without one,
+// OneFS only moves it when the cluster-wide SmartPools job next runs.
+func (c *client) MoveToStoragePool(ctx context.Context, name string) error {
+	cli, err := c.connect(ctx)
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Type  string   `json:"type"`
+		Paths []string `json:"paths"`
+	}{
+		Type:  "SmartPoolsTree",
+		Paths: []string{cli.API.VolumePath(name)},
+	}
+	return cli.API.Post(ctx, jobsPath, "", nil, nil, body, nil)
+}
@@ -4,13 +4,17 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"code.cloudfoundry.org/clock"
 	"code.cloudfoundry.org/debugserver"
 	"code.cloudfoundry.org/goshims/osshim"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/lager/lagerflags"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
 	"github.com/nimbus-cloud/isilon-nfs-broker/nfsbroker"
 	"github.com/nimbus-cloud/isilon-nfs-broker/utils"
 
@@ -49,6 +53,54 @@ var serviceId = flag.String(
 	"service-guid",
 	"ID of the service to register with cloud controller",
 )
+var catalogFile = flag.String(
+	"catalogFile",
+	"",
+	"(optional) YAML or JSON file describing the services and plans to offer. When omitted a single service named by serviceName and serviceId is offered with 5GB and 10GB plans",
+)
+
+var clustersFile = flag.String(
+	"clustersFile",
+	"",
+	"(optional) YAML or JSON file listing the Isilon clusters to place instances on and the placement policy. When omitted the single cluster given by the ISILON_* environment variables is used",
+)
+
+var adminURL = flag.String(
+	"adminURL",
+	"",
+	"(optional) URL of a running broker for the admin subcommands. Defaults to the broker at listenAddr",
+)
+
+var trashPurgeInterval = flag.Duration(
+	"trashPurgeInterval",
+	time.Hour,
+	"how often to purge deleted instances whose trash retention has expired",
+)
+
+var reconcileInterval = flag.Duration(
+	"reconcileInterval",
+	0,
+	"(optional) how often to compare the broker's instances with the clusters and log what differs. Off when 0",
+)
+
+var reconcileRepair = flag.Bool(
+	"reconcileRepair",
+	false,
+	"(optional) re-create missing exports and quotas found by the periodic reconciliation",
+)
+
+var directoryLayout = flag.String(
+	"directoryLayout",
+	nfsbroker.DefaultLayout,
+	"template for the directory of a new instance, relative to the volume path, such as {{.OrgGUID}}/{{.SpaceGUID}}/{{.InstanceID}}. {{.OrgName}} and {{.SpaceName}} need cfApiURL",
+)
+
+var cfApiURL = flag.String(
+	"cfApiURL",
+	"",
+	"(optional) Cloud Controller API URL, through which directory layouts look up org and space names. The UAA client is given by CF_CLIENT_ID and CF_CLIENT_SECRET",
+)
+
 var dbDriver = flag.String(
 	"dbDriver",
 	"",
@@ -107,19 +159,36 @@ var (
 	isilonPassword string
 	isilonGroup    string
 	isilonVolPath  string
+	isilonNFSHost  string
+	cfClientID     string
+	cfClientSecret string
 )
 
 func main() {
 	parseCommandLine()
 	parseEnvironment()
 
+	if flag.Arg(0) == "admin" {
+		os.Exit(runAdminCommand(os.Stdout, os.Stderr, flag.Args()[1:]))
+	}
+
 	checkParams()
 
-	sink, err := lager.NewRedactingWriterSink(os.Stdout, lager.DEBUG, nil, nil)
+	// a one-off reconcile logs to stderr, leaving stdout to its report
+	logOutput := os.Stdout
+	if flag.Arg(0) == "reconcile" {
+		logOutput = os.Stderr
+	}
+	sink, err := lager.NewRedactingWriterSink(logOutput, lager.DEBUG, nil, nil)
 	if err != nil {
 		panic(err)
 	}
 	logger, logSink := lagerflags.NewFromSink("nfsbroker", sink)
+
+	if flag.Arg(0) == "reconcile" {
+		os.Exit(runReconcile(logger, os.Stdout, os.Stderr, flag.Args()[1:]))
+	}
+
 	logger.Info("starting")
 	defer logger.Info("ends")
 
@@ -154,6 +223,9 @@ func parseEnvironment() {
 	isilonPassword, _ = os.LookupEnv("ISILON_PASSWORD")
 	isilonGroup, _ = os.LookupEnv("ISILON_GROUP")
 	isilonVolPath, _ = os.LookupEnv("ISILON_VOLUMEPATH")
+	isilonNFSHost, _ = os.LookupEnv("ISILON_NFS_HOST")
+	cfClientID, _ = os.LookupEnv("CF_CLIENT_ID")
+	cfClientSecret, _ = os.LookupEnv("CF_CLIENT_SECRET")
 }
 
 func checkParams() {
@@ -201,6 +273,28 @@ func parseVcapServices(logger lager.Logger, os osshim.Os) {
 }
 
 func createServer(logger lager.Logger) ifrit.Runner {
+	clock := clock.NewClock()
+	serviceBroker := createBroker(logger, clock, nfsbroker.New)
+
+	credentials := brokerapi.BrokerCredentials{Username: username, Password: password}
+	handler := http.NewServeMux()
+	handler.Handle("/admin/", nfsbroker.NewAdminHandler(logger.Session("admin-api"), serviceBroker, username, password))
+	handler.Handle("/", brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials))
+
+	members := grouper.Members{
+		{"broker-api", http_server.New(*atAddress, handler)},
+		{"trash-reaper", nfsbroker.NewTrashReaper(logger, serviceBroker, clock, *trashPurgeInterval)},
+	}
+	if *reconcileInterval > 0 {
+		members = append(members, grouper.Member{"reconciler", nfsbroker.NewReconciler(logger, serviceBroker, clock, *reconcileInterval, *reconcileRepair)})
+	}
+	return grouper.NewOrdered(os.Interrupt, members)
+}
+
+// brokerConstructor is nfsbroker.New, or nfsbroker.NewOffline for one-off work.
+type brokerConstructor func(lager.Logger, *nfsbroker.Catalog, string, osshim.Os, clock.Clock, brokerstore.Store, *nfsbroker.Config, *nfsbroker.Clusters, *nfsbroker.Layout) *nfsbroker.Broker
+
+func createBroker(logger lager.Logger, clock clock.Clock, newBroker brokerConstructor) *nfsbroker.Broker {
 	fileName := filepath.Join(*dataDir, fmt.Sprintf("%s-services.json", *serviceName))
 
 	// if we are CF pushed
@@ -215,22 +309,49 @@ func createServer(logger lager.Logger) ifrit.Runner {
 	logger.Debug("nfsbroker-startup-config", lager.Data{"config": mounts})
 
 	config := nfsbroker.NewNfsBrokerConfig(mounts)
-	isilonClientConfig := make(map[string]string)
-	isilonClientConfig["insecure"] = isilonInsecure
-	isilonClientConfig["endpoint"] = isilonEndpoint
-	isilonClientConfig["username"] = isilonUsername
-	isilonClientConfig["password"] = isilonPassword
-	isilonClientConfig["group"] = isilonGroup
-	isilonClientConfig["volpath"] = isilonVolPath
-
-	serviceBroker := nfsbroker.New(logger,
-		*serviceName, *serviceId,
-		*dataDir, &osshim.OsShim{}, clock.NewClock(), store, config, isilonClientConfig)
 
-	credentials := brokerapi.BrokerCredentials{Username: username, Password: password}
-	handler := brokerapi.New(serviceBroker, logger.Session("broker-api"), credentials)
+	catalog := nfsbroker.DefaultCatalog(*serviceName, *serviceId)
+	if *catalogFile != "" {
+		var err error
+		catalog, err = nfsbroker.LoadCatalog(*catalogFile)
+		utils.ExitOnFailure(logger, err)
+	}
+	logger.Debug("nfsbroker-startup-catalog", lager.Data{"catalog": catalog})
+
+	clusters, err := loadClusters()
+	utils.ExitOnFailure(logger, err)
+	utils.ExitOnFailure(logger, clusters.CheckCatalog(catalog))
+
+	var names nfsbroker.NameLookup
+	if *cfApiURL != "" {
+		names = nfsbroker.NewCloudController(*cfApiURL, cfClientID, cfClientSecret)
+	}
+	layout, err := nfsbroker.NewLayout(*directoryLayout, names)
+	utils.ExitOnFailure(logger, err)
+
+	return newBroker(logger,
+		catalog,
+		*dataDir, &osshim.OsShim{}, clock, store, config, clusters, layout)
+}
+
+func loadClusters() (*nfsbroker.Clusters, error) {
+	if *clustersFile != "" {
+		return nfsbroker.LoadClusters(*clustersFile)
+	}
 
-	return http_server.New(*atAddress, handler)
+	insecure, _ := strconv.ParseBool(isilonInsecure) // defaults to false
+	return nfsbroker.NewClusters(nfsbroker.PlacementRoundRobin, nfsbroker.Cluster{
+		Name:    "default",
+		NFSHost: isilonNFSHost,
+		Config: isilon.Config{
+			Endpoint:   isilonEndpoint,
+			Insecure:   insecure,
+			Username:   isilonUsername,
+			Password:   isilonPassword,
+			Group:      isilonGroup,
+			VolumePath: isilonVolPath,
+		},
+	})
 }
 
 func ConvertPostgresError(err *pq.Error) string {
@@ -17,7 +17,7 @@ func TestLocalbroker(t *testing.T) {
 
 var _ = SynchronizedBeforeSuite(func() []byte {
 	var err error
-	binaryPath, err = gexec.Build("code.cloudfoundry.org/nfsbroker", "-race")
+	binaryPath, err = gexec.Build("github.com/nimbus-cloud/isilon-nfs-broker", "-race")
 	Expect(err).NotTo(HaveOccurred())
 
 	return []byte(binaryPath)
@@ -12,6 +12,7 @@ import (
 	"fmt"
 
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/onsi/gomega/gbytes"
@@ -250,6 +251,7 @@ var _ = Describe("nfsbroker Main", func() {
 			Expect(err).NotTo(HaveOccurred())
 
 			req.SetBasicAuth(username, password)
+			req.Header.Set("X-Broker-API-Version", "2.14")
 			return http.DefaultClient.Do(req)
 		}
 
@@ -280,10 +282,153 @@ var _ = Describe("nfsbroker Main", func() {
 
 				Expect(catalog.Services[0].Name).To(Equal("something"))
 				Expect(catalog.Services[0].ID).To(Equal("someguid"))
-				Expect(catalog.Services[0].Plans[0].ID).To(Equal("Existing"))
-				Expect(catalog.Services[0].Plans[0].Name).To(Equal("Existing"))
-				Expect(catalog.Services[0].Plans[0].Description).To(Equal("A preexisting filesystem"))
+				Expect(catalog.Services[0].Plans[0].ID).To(Equal("5"))
+				Expect(catalog.Services[0].Plans[0].Name).To(Equal("5GB"))
+				Expect(catalog.Services[0].Plans[0].Description).To(Equal("5GB Dell EMC Isilon NFS Share."))
 			})
 		})
+
+		It("serves the admin API behind the broker credentials", func() {
+			req, err := http.NewRequest("POST", "http://"+listenAddr+"/admin/export-clients", nil)
+			Expect(err).NotTo(HaveOccurred())
+			resp, err := http.DefaultClient.Do(req)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(401))
+
+			resp, err = httpDoWithAuth("POST", "/admin/export-clients", nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+		})
+
+		It("runs admin subcommands against the running broker", func() {
+			command := exec.Command(binaryPath, "-listenAddr", listenAddr, "admin", "reapply-export-clients")
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`"instances":\[`))
+		})
+
+		It("prints the usage report as CSV", func() {
+			command := exec.Command(binaryPath, "-listenAddr", listenAddr, "admin", "usage", "csv")
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say("instance_id,organization_guid,space_guid,plan_id,plan"))
+		})
+
+		It("prints the reconciliation report", func() {
+			command := exec.Command(binaryPath, "-listenAddr", listenAddr, "admin", "reconcile")
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`"counts":\{`))
+		})
+
+		It("prints the reconciliation metrics", func() {
+			command := exec.Command(binaryPath, "-listenAddr", listenAddr, "admin", "metrics")
+			session, err := gexec.Start(command, GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`"reconcile_runs": 0`))
+		})
+
+		Context("given a catalog file", func() {
+			BeforeEach(func() {
+				catalogFile := filepath.Join(tempDir, "catalog.yml")
+				err := ioutil.WriteFile(catalogFile, []byte(`
+services:
+- id: 5f2a6f7e-4d1c-4c36-9a57-7a3b0f4c1e21
+  name: isilon-nfs
+  description: Isilon NFS shares
+  plans:
+  - id: 0c6d9a3e-2b8f-4c71-bb3e-9d54a1e7f602
+    name: small
+    description: A small share
+    size: 500MB
+`), 0644)
+				Expect(err).NotTo(HaveOccurred())
+
+				args = append(args, "-catalogFile", catalogFile)
+			})
+
+			It("serves the catalog from the file", func() {
+				resp, err := httpDoWithAuth("GET", "/v2/catalog", nil)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(200))
+
+				bytes, err := ioutil.ReadAll(resp.Body)
+				Expect(err).NotTo(HaveOccurred())
+
+				var catalog brokerapi.CatalogResponse
+				err = json.Unmarshal(bytes, &catalog)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(catalog.Services[0].Name).To(Equal("isilon-nfs"))
+				Expect(catalog.Services[0].Plans[0].ID).To(Equal("0c6d9a3e-2b8f-4c71-bb3e-9d54a1e7f602"))
+				Expect(catalog.Services[0].Plans[0].Name).To(Equal("small"))
+			})
+		})
+	})
+
+	Context("Unknown admin command", func() {
+		It("shows the admin usage", func() {
+			session, err := gexec.Start(exec.Command(binaryPath, "admin", "frobnicate"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say("unknown admin command"))
+			Expect(session.Err).To(gbytes.Say("reapply-export-clients"))
+		})
+
+		It("reports missing arguments", func() {
+			session, err := gexec.Start(exec.Command(binaryPath, "admin", "delete-snapshot", "instance-id"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say("missing argument <snapshot>"))
+		})
+	})
+
+	Context("One-off reconcile", func() {
+		It("prints the reconciliation report without a running broker", func() {
+			session, err := gexec.Start(exec.Command(binaryPath, "-dataDir", os.TempDir(), "reconcile"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session, 10).Should(gexec.Exit(0))
+			Expect(session.Out).To(gbytes.Say(`"counts":\{`))
+		})
+
+		It("rejects unknown modes", func() {
+			session, err := gexec.Start(exec.Command(binaryPath, "-dataDir", os.TempDir(), "reconcile", "fix"), GinkgoWriter, GinkgoWriter)
+			Expect(err).NotTo(HaveOccurred())
+			Eventually(session).Should(gexec.Exit(2))
+			Expect(session.Err).To(gbytes.Say("usage: isilon-nfs-broker"))
+		})
+	})
+
+	Context("Invalid catalog file", func() {
+		var process ifrit.Process
+
+		It("refuses to start", func() {
+			catalogFile := filepath.Join(os.TempDir(), "invalid-catalog.yml")
+			err := ioutil.WriteFile(catalogFile, []byte(`
+services:
+- id: some-service-id
+  name: isilon-nfs
+  plans:
+  - id: some-plan-id
+    name: small
+    size: lots
+`), 0644)
+			Expect(err).NotTo(HaveOccurred())
+
+			volmanRunner := failRunner{
+				Name:       "nfsbroker",
+				Command:    exec.Command(binaryPath, "-dataDir", os.TempDir(), "-catalogFile", catalogFile),
+				StartCheck: "must be a whole number followed by B, KB, MB, GB, TB or PB",
+			}
+			process = ifrit.Invoke(volmanRunner)
+		})
+
+		AfterEach(func() {
+			ginkgomon.Kill(process)
+		})
 	})
 })
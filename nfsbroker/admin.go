@@ -0,0 +1,226 @@
+package nfsbroker
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/gorilla/mux"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// NewAdminHandler serves the operator API under /admin/. It is guarded by the
+// same basic auth credentials as the service broker API.
+func NewAdminHandler(logger lager.Logger, broker *Broker, username, password string) http.Handler {
+	admin := &adminAPI{logger: logger, broker: broker}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/admin/export-clients", admin.reapplyExportClients).Methods("POST")
+	router.HandleFunc("/admin/usage", admin.usage).Methods("GET")
+	router.HandleFunc("/admin/instances/{instance_id}/snapshots", admin.listSnapshots).Methods("GET")
+	router.HandleFunc("/admin/instances/{instance_id}/snapshots", admin.createSnapshot).Methods("POST")
+	router.HandleFunc("/admin/instances/{instance_id}/snapshots/{snapshot_id}", admin.deleteSnapshot).Methods("DELETE")
+	router.HandleFunc("/admin/reconcile", admin.reconcile).Methods("POST")
+	router.HandleFunc("/admin/metrics", admin.metrics).Methods("GET")
+	router.HandleFunc("/admin/trash", admin.listTrash).Methods("GET")
+	router.HandleFunc("/admin/trash/{deleted_instance_id}/undelete/{instance_id}", admin.undelete).Methods("POST")
+
+	return basicAuth(username, password, router)
+}
+
+type adminAPI struct {
+	logger lager.Logger
+	broker *Broker
+}
+
+type adminError struct {
+	Error string `json:"error"`
+}
+
+func (a *adminAPI) reapplyExportClients(w http.ResponseWriter, r *http.Request) {
+	logger := a.logger.Session("reapply-export-clients")
+
+	results, err := a.broker.ReapplyExportClients(r.Context())
+	if err != nil {
+		a.respond(logger, w, http.StatusInternalServerError, adminError{Error: err.Error()})
+		return
+	}
+
+	status := http.StatusOK
+	for _, result := range results {
+		if result.Error != "" {
+			status = http.StatusInternalServerError
+		}
+	}
+	a.respond(logger, w, status, struct {
+		Instances []ExportClientsResult `json:"instances"`
+	}{results})
+}
+
+// usage reports the quota usage of every instance as JSON, or as CSV with
+// format=csv.
+func (a *adminAPI) usage(w http.ResponseWriter, r *http.Request) {
+	logger := a.logger.Session("usage")
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		a.respond(logger, w, http.StatusBadRequest, adminError{Error: "format must be json or csv"})
+		return
+	}
+
+	usage, err := a.broker.Usage(r.Context())
+	if err != nil {
+		a.respond(logger, w, http.StatusInternalServerError, adminError{Error: err.Error()})
+		return
+	}
+
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.WriteHeader(http.StatusOK)
+		if err := writeUsageCSV(w, usage); err != nil {
+			logger.Error("failed-to-write-response", err)
+		}
+		return
+	}
+	a.respond(logger, w, http.StatusOK, struct {
+		Instances []InstanceUsage `json:"instances"`
+	}{usage})
+}
+
+func (a *adminAPI) listSnapshots(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	logger := a.logger.Session("list-snapshots", lager.Data{"instanceID": instanceID})
+
+	snapshots, err := a.broker.InstanceSnapshots(r.Context(), instanceID)
+	if err != nil {
+		a.respondError(logger, w, err)
+		return
+	}
+	a.respond(logger, w, http.StatusOK, struct {
+		Snapshots []isilon.Snapshot `json:"snapshots"`
+	}{snapshots})
+}
+
+// createSnapshot takes a snapshot named by the optional name query parameter.
+func (a *adminAPI) createSnapshot(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	logger := a.logger.Session("create-snapshot", lager.Data{"instanceID": instanceID})
+
+	snapshot, err := a.broker.CreateInstanceSnapshot(r.Context(), instanceID, r.URL.Query().Get("name"))
+	if err != nil {
+		a.respondError(logger, w, err)
+		return
+	}
+	logger.Info("created-snapshot", lager.Data{"snapshot": snapshot})
+	a.respond(logger, w, http.StatusCreated, snapshot)
+}
+
+func (a *adminAPI) deleteSnapshot(w http.ResponseWriter, r *http.Request) {
+	instanceID := mux.Vars(r)["instance_id"]
+	logger := a.logger.Session("delete-snapshot", lager.Data{"instanceID": instanceID})
+
+	snapshotID, err := strconv.ParseInt(mux.Vars(r)["snapshot_id"], 10, 64)
+	if err != nil {
+		a.respond(logger, w, http.StatusBadRequest, adminError{Error: "snapshot id must be a number"})
+		return
+	}
+	if err := a.broker.DeleteInstanceSnapshot(r.Context(), instanceID, snapshotID); err != nil {
+		a.respondError(logger, w, err)
+		return
+	}
+	logger.Info("deleted-snapshot", lager.Data{"snapshotID": snapshotID})
+	a.respond(logger, w, http.StatusOK, struct{}{})
+}
+
+// reconcile compares the store with the clusters, and with mode=repair also
+// re-creates missing exports and quotas.
+func (a *adminAPI) reconcile(w http.ResponseWriter, r *http.Request) {
+	logger := a.logger.Session("reconcile")
+
+	mode := r.URL.Query().Get("mode")
+	if mode != "" && mode != "report" && mode != "repair" {
+		a.respond(logger, w, http.StatusBadRequest, adminError{Error: "mode must be report or repair"})
+		return
+	}
+
+	report, err := a.broker.Reconcile(r.Context(), mode == "repair")
+	if err != nil {
+		a.respondError(logger, w, err)
+		return
+	}
+	a.respond(logger, w, http.StatusOK, report)
+}
+
+// metrics reports the counters and gauges of reconciliation.
+func (a *adminAPI) metrics(w http.ResponseWriter, r *http.Request) {
+	logger := a.logger.Session("metrics")
+
+	a.respond(logger, w, http.StatusOK, json.RawMessage(a.broker.Metrics().String()))
+}
+
+func (a *adminAPI) listTrash(w http.ResponseWriter, r *http.Request) {
+	logger := a.logger.Session("list-trash")
+
+	entries, err := a.broker.Trash()
+	if err != nil {
+		a.respondError(logger, w, err)
+		return
+	}
+	a.respond(logger, w, http.StatusOK, struct {
+		Instances []TrashEntry `json:"instances"`
+	}{entries})
+}
+
+// undelete restores a deleted instance's directory into another instance.
+func (a *adminAPI) undelete(w http.ResponseWriter, r *http.Request) {
+	deletedID := mux.Vars(r)["deleted_instance_id"]
+	instanceID := mux.Vars(r)["instance_id"]
+	logger := a.logger.Session("undelete", lager.Data{"deletedID": deletedID, "instanceID": instanceID})
+
+	if err := a.broker.UndeleteInstance(r.Context(), deletedID, instanceID); err != nil {
+		a.respondError(logger, w, err)
+		return
+	}
+	logger.Info("undeleted")
+	a.respond(logger, w, http.StatusOK, struct{}{})
+}
+
+// respondError reports a missing instance, snapshot or trash entry as a 404,
+// an instance another request is working on as a 409, and anything else as a
+// 500.
+func (a *adminAPI) respondError(logger lager.Logger, w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if err == brokerapi.ErrInstanceDoesNotExist || err == isilon.ErrSnapshotNotFound || err == ErrTrashEntryNotFound {
+		status = http.StatusNotFound
+	} else if err == ErrConcurrentInstanceAccess {
+		status = http.StatusConflict
+	} else {
+		logger.Error("failed", err)
+	}
+	a.respond(logger, w, status, adminError{Error: err.Error()})
+}
+
+func (a *adminAPI) respond(logger lager.Logger, w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		logger.Error("failed-to-write-response", err)
+	}
+}
+
+func basicAuth(username, password string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="isilon-nfs-broker admin"`)
+			http.Error(w, "Not Authorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,764 @@
+package nfsbroker_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	"code.cloudfoundry.org/clock/fakeclock"
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon/isilonfakes"
+	"github.com/nimbus-cloud/isilon-nfs-broker/nfsbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/ifrit"
+)
+
+var _ = Describe("Admin API", func() {
+	var (
+		ctx       context.Context
+		tempDir   string
+		fakeOneFS *isilonfakes.FakeOneFS
+		catalog   *nfsbroker.Catalog
+		fakeClock *fakeclock.FakeClock
+		broker    *nfsbroker.Broker
+		handler   http.Handler
+	)
+
+	BeforeEach(func() {
+		ctx = context.TODO()
+
+		var err error
+		tempDir, err = ioutil.TempDir("", "admin")
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeOneFS = isilonfakes.NewFakeOneFS("admin", "password")
+		fakeOneFS.MkdirAll("/ifs/volumes")
+
+		catalog = nfsbroker.DefaultCatalog("service-name", "service-id")
+		catalog.Services[0].Plans[0].Export = &nfsbroker.ExportPolicy{
+			Clients:         []string{"10.10.0.0/16"},
+			RootClients:     []string{"10.10.1.5"},
+			ReadOnlyClients: []string{"10.20.0.0/16"},
+		}
+		catalog.OrgExports = map[string]nfsbroker.ExportPolicy{
+			"org-override": {Clients: []string{"192.168.0.0/24"}},
+		}
+
+		clusters, err := nfsbroker.NewClusters(nfsbroker.PlacementRoundRobin, nfsbroker.Cluster{
+			Name: "default",
+			Config: isilon.Config{
+				Endpoint:   fakeOneFS.URL,
+				Username:   "admin",
+				Password:   "password",
+				VolumePath: "/ifs/volumes",
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		fakeClock = fakeclock.NewFakeClock(time.Date(2018, 3, 1, 12, 0, 0, 0, time.UTC))
+
+		logger := lagertest.NewTestLogger("test-broker")
+		store := brokerstore.NewStore(logger, "", "", "", "", "", "", "", filepath.Join(tempDir, "service-name-services.json"))
+		broker = nfsbroker.New(
+			logger,
+			catalog, tempDir,
+			&os_fake.FakeOs{},
+			fakeClock,
+			store,
+			nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+			clusters,
+			nil,
+		)
+		handler = nfsbroker.NewAdminHandler(logger, broker, "broker-user", "broker-password")
+	})
+
+	AfterEach(func() {
+		fakeOneFS.Close()
+		os.RemoveAll(tempDir)
+	})
+
+	provisionWithParameters := func(instanceID, planID, orgGUID, parameters string) error {
+		_, err := broker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, OrganizationGUID: orgGUID, RawParameters: json.RawMessage(parameters)}, false)
+		return err
+	}
+
+	provision := func(instanceID, planID, orgGUID string) {
+		Expect(provisionWithParameters(instanceID, planID, orgGUID, "")).To(Succeed())
+	}
+
+	request := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.SetBasicAuth("broker-user", "broker-password")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	It("rejects requests without the broker credentials", func() {
+		req := httptest.NewRequest("POST", "/admin/export-clients", nil)
+		req.SetBasicAuth("broker-user", "wrong")
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, req)
+		Expect(recorder.Code).To(Equal(http.StatusUnauthorized))
+	})
+
+	Describe("export clients", func() {
+		It("restricts new exports to the plan's clients", func() {
+			provision("instance-1", "5", "org")
+
+			export, ok := fakeOneFS.Export("/ifs/volumes/instance-1")
+			Expect(ok).To(BeTrue())
+			Expect(export.Clients).To(ConsistOf("10.10.0.0/16"))
+			Expect(export.RootClients).To(ConsistOf("10.10.1.5"))
+			Expect(export.ReadOnlyClients).To(ConsistOf("10.20.0.0/16"))
+		})
+
+		It("replaces the lists an org override sets", func() {
+			provision("instance-1", "5", "org-override")
+
+			export, _ := fakeOneFS.Export("/ifs/volumes/instance-1")
+			Expect(export.Clients).To(ConsistOf("192.168.0.0/24"))
+			Expect(export.RootClients).To(ConsistOf("10.10.1.5"))
+		})
+
+		It("leaves exports of plans without a policy open", func() {
+			provision("instance-1", "10", "org")
+
+			export, _ := fakeOneFS.Export("/ifs/volumes/instance-1")
+			Expect(export.Clients).To(BeEmpty())
+			Expect(export.RootClients).To(BeEmpty())
+		})
+
+		It("applies the new plan's policy when an instance changes plan", func() {
+			provision("instance-1", "10", "org")
+
+			_, err := broker.Update(ctx, "instance-1", brokerapi.UpdateDetails{ServiceID: "service-id", PlanID: "5"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			export, _ := fakeOneFS.Export("/ifs/volumes/instance-1")
+			Expect(export.Clients).To(ConsistOf("10.10.0.0/16"))
+			Expect(export.RootClients).To(ConsistOf("10.10.1.5"))
+			Expect(export.ReadOnlyClients).To(ConsistOf("10.20.0.0/16"))
+		})
+
+		It("re-applies the current policy to existing exports", func() {
+			provision("instance-1", "5", "org")
+			provision("instance-2", "10", "org")
+
+			catalog.Services[0].Plans[0].Export.Clients = []string{"10.30.0.0/16"}
+			catalog.Services[0].Plans[1].Export = &nfsbroker.ExportPolicy{Clients: []string{"10.40.0.0/16"}}
+
+			recorder := request("POST", "/admin/export-clients")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+
+			var body struct {
+				Instances []nfsbroker.ExportClientsResult `json:"instances"`
+			}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+			Expect(body.Instances).To(HaveLen(2))
+
+			export, _ := fakeOneFS.Export("/ifs/volumes/instance-1")
+			Expect(export.Clients).To(ConsistOf("10.30.0.0/16"))
+			export, _ = fakeOneFS.Export("/ifs/volumes/instance-2")
+			Expect(export.Clients).To(ConsistOf("10.40.0.0/16"))
+		})
+
+		It("reports instances a request is working on instead of changing their export", func() {
+			provision("instance-1", "5", "org")
+			held, release := fakeOneFS.HoldRequest("DELETE", "/platform/")
+			deprovisioned := make(chan error, 1)
+			go func() {
+				_, err := broker.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{}, false)
+				deprovisioned <- err
+			}()
+			Eventually(held).Should(BeClosed())
+
+			recorder := request("POST", "/admin/export-clients")
+			Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+			Expect(recorder.Body.String()).To(ContainSubstring("another operation for this service instance is in progress"))
+
+			release()
+			Eventually(deprovisioned).Should(Receive(BeNil()))
+			Expect(fakeOneFS.ExportCount()).To(Equal(0))
+		})
+
+		It("reports instances whose export could not be updated", func() {
+			provision("instance-1", "5", "org")
+			fakeOneFS.FailRequests("PUT", "/platform/2/protocols/nfs/exports")
+
+			recorder := request("POST", "/admin/export-clients")
+			Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+			Expect(recorder.Body.String()).To(ContainSubstring("failed to set isilon export clients for instance-1"))
+		})
+	})
+
+	Describe("snapshots", func() {
+		BeforeEach(func() {
+			catalog.Services[0].Plans[0].Snapshots = &nfsbroker.SnapshotPolicy{Frequency: "hourly", Retention: "7d"}
+		})
+
+		It("creates the plan's snapshot schedule with the quota", func() {
+			provision("instance-1", "5", "org")
+
+			schedule, ok := fakeOneFS.SnapshotSchedule("/ifs/volumes/instance-1")
+			Expect(ok).To(BeTrue())
+			Expect(schedule.Schedule).To(Equal("Every day every 1 hours"))
+			Expect(schedule.Duration).To(Equal(int64(7 * 24 * 60 * 60)))
+		})
+
+		It("lets the snapshots parameter override the plan", func() {
+			Expect(provisionWithParameters("instance-1", "5", "org", `{"snapshots": {"frequency": "weekly", "retention": "4w"}}`)).To(Succeed())
+			Expect(provisionWithParameters("instance-2", "5", "org", `{"snapshots": {"frequency": "none"}}`)).To(Succeed())
+			Expect(provisionWithParameters("instance-3", "10", "org", `{"snapshots": {"frequency": "daily", "retention": "36h"}}`)).To(Succeed())
+
+			schedule, _ := fakeOneFS.SnapshotSchedule("/ifs/volumes/instance-1")
+			Expect(schedule.Schedule).To(Equal("Every Sunday at 12:00 AM"))
+			Expect(schedule.Duration).To(Equal(int64(4 * 7 * 24 * 60 * 60)))
+			_, ok := fakeOneFS.SnapshotSchedule("/ifs/volumes/instance-2")
+			Expect(ok).To(BeFalse())
+			schedule, _ = fakeOneFS.SnapshotSchedule("/ifs/volumes/instance-3")
+			Expect(schedule.Duration).To(Equal(int64(36 * 60 * 60)))
+		})
+
+		It("rejects an invalid snapshots parameter", func() {
+			err := provisionWithParameters("instance-1", "5", "org", `{"snapshots": {"frequency": "hourly", "retention": "7 years"}}`)
+			Expect(err).To(MatchError(ContainSubstring("invalid snapshots parameter")))
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-1")).To(BeFalse())
+		})
+
+		It("rolls back the instance when the schedule cannot be created", func() {
+			fakeOneFS.FailRequests("POST", "/platform/1/snapshot/schedules")
+
+			err := provisionWithParameters("instance-1", "5", "org", "")
+			Expect(err).To(MatchError(ContainSubstring("failed to create isilon snapshot schedule for instance-1")))
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-1")).To(BeFalse())
+			Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+		})
+
+		It("lists, creates and deletes the snapshots of an instance", func() {
+			provision("instance-1", "5", "org")
+			provision("instance-2", "5", "org")
+			scheduled := fakeOneFS.TakeSnapshot("/ifs/volumes/instance-1", "instance-1_2018-01-01_00-00")
+			fakeOneFS.TakeSnapshot("/ifs/volumes/instance-2", "instance-2_2018-01-01_00-00")
+
+			recorder := request("POST", "/admin/instances/instance-1/snapshots?name=before-upgrade")
+			Expect(recorder.Code).To(Equal(http.StatusCreated))
+			var created isilon.Snapshot
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &created)).To(Succeed())
+			Expect(created.Name).To(Equal("before-upgrade"))
+			Expect(created.Path).To(Equal("/ifs/volumes/instance-1"))
+
+			recorder = request("GET", "/admin/instances/instance-1/snapshots")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			var body struct {
+				Snapshots []isilon.Snapshot `json:"snapshots"`
+			}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+			Expect(body.Snapshots).To(HaveLen(2))
+			Expect(body.Snapshots[0].ID).To(Equal(scheduled))
+			Expect(body.Snapshots[1].Name).To(Equal("before-upgrade"))
+
+			recorder = request("DELETE", fmt.Sprintf("/admin/instances/instance-1/snapshots/%d", scheduled))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(fakeOneFS.Snapshots("/ifs/volumes/instance-1")).To(HaveLen(1))
+		})
+
+		It("does not delete snapshots of other instances", func() {
+			provision("instance-1", "5", "org")
+			provision("instance-2", "5", "org")
+			other := fakeOneFS.TakeSnapshot("/ifs/volumes/instance-2", "")
+
+			recorder := request("DELETE", fmt.Sprintf("/admin/instances/instance-1/snapshots/%d", other))
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+			Expect(fakeOneFS.Snapshots("/ifs/volumes/instance-2")).To(HaveLen(1))
+		})
+
+		It("responds with a 404 for unknown instances", func() {
+			Expect(request("GET", "/admin/instances/missing/snapshots").Code).To(Equal(http.StatusNotFound))
+			Expect(request("POST", "/admin/instances/missing/snapshots").Code).To(Equal(http.StatusNotFound))
+		})
+
+		It("removes the schedule and snapshots on deprovision", func() {
+			provision("instance-1", "5", "org")
+			fakeOneFS.TakeSnapshot("/ifs/volumes/instance-1", "")
+
+			_, err := broker.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{PlanID: "5"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeOneFS.SnapshotScheduleCount()).To(Equal(0))
+			Expect(fakeOneFS.Snapshots("/ifs/volumes/instance-1")).To(BeEmpty())
+		})
+
+		It("leaves snapshots the broker did not take on deprovision", func() {
+			provision("instance-1", "5", "org")
+			fakeOneFS.TakeSnapshot("/ifs/volumes/instance-1", "")
+			Expect(request("POST", "/admin/instances/instance-1/snapshots?name=before-upgrade").Code).To(Equal(http.StatusCreated))
+			client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+			_, err := client.CreateSnapshot(ctx, "instance-1", "by-hand")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{PlanID: "5"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			snapshots := fakeOneFS.Snapshots("/ifs/volumes/instance-1")
+			Expect(snapshots).To(HaveLen(1))
+			Expect(snapshots[0].Name).To(Equal("by-hand"))
+		})
+
+		It("does not change the schedule on update", func() {
+			provision("instance-1", "5", "org")
+
+			_, err := broker.Update(ctx, "instance-1", brokerapi.UpdateDetails{RawParameters: json.RawMessage(`{"snapshots": {"frequency": "none"}}`)}, false)
+			Expect(err).To(MatchError(ContainSubstring("can only be chosen when it is created")))
+		})
+	})
+
+	Describe("usage", func() {
+		BeforeEach(func() {
+			catalog.Services[0].Plans[1].Thresholds = &nfsbroker.QuotaThresholds{AdvisoryPercent: 80}
+
+			_, err := broker.Provision(ctx, "instance-1", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5", OrganizationGUID: "org", SpaceGUID: "space"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = broker.Provision(ctx, "instance-2", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "10", OrganizationGUID: "other-org", SpaceGUID: "other-space"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			fakeOneFS.SetQuotaUsage("/ifs/volumes/instance-1", isilonfakes.FakeQuotaUsage{Logical: 1024, Physical: 4096, Inodes: 3})
+		})
+
+		It("reports each instance's quota and usage as JSON", func() {
+			recorder := request("GET", "/admin/usage")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+
+			var body struct {
+				Instances []nfsbroker.InstanceUsage `json:"instances"`
+			}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+			Expect(body.Instances).To(Equal([]nfsbroker.InstanceUsage{
+				{
+					InstanceID: "instance-1", OrgGUID: "org", SpaceGUID: "space", PlanID: "5", Plan: "5GB", Cluster: "default",
+					HardLimit: 5 * nfsbroker.GB, Logical: 1024, Physical: 4096, Files: 3,
+				},
+				{
+					InstanceID: "instance-2", OrgGUID: "other-org", SpaceGUID: "other-space", PlanID: "10", Plan: "10GB", Cluster: "default",
+					HardLimit: 10 * nfsbroker.GB, AdvisoryLimit: 10 * nfsbroker.GB / 100 * 80,
+				},
+			}))
+		})
+
+		It("reports CSV on request", func() {
+			recorder := request("GET", "/admin/usage?format=csv")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Header().Get("Content-Type")).To(Equal("text/csv"))
+			Expect(recorder.Body.String()).To(Equal(
+				"instance_id,organization_guid,space_guid,plan_id,plan,cluster,hard_limit,advisory_limit,soft_limit,logical,physical,files,replication_state,replication_last_success,error\n" +
+					"instance-1,org,space,5,5GB,default,5368709120,0,0,1024,4096,3,,0,\n" +
+					"instance-2,other-org,other-space,10,10GB,default,10737418240,8589934560,0,0,0,0,,0,\n"))
+		})
+
+		It("reports the replication of instances of replicated plans", func() {
+			catalog.Services[0].Plans[0].Replication = &nfsbroker.ReplicationPolicy{TargetHost: "dr.example.com", TargetPath: "/ifs/dr", Frequency: nfsbroker.SnapshotsHourly}
+			_, err := broker.Provision(ctx, "instance-3", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5", OrganizationGUID: "org", SpaceGUID: "space"}, false)
+			Expect(err).NotTo(HaveOccurred())
+			fakeOneFS.RunSyncPolicy("/ifs/volumes/instance-3", "finished")
+
+			var body struct {
+				Instances []nfsbroker.InstanceUsage `json:"instances"`
+			}
+			Expect(json.Unmarshal(request("GET", "/admin/usage").Body.Bytes(), &body)).To(Succeed())
+			Expect(body.Instances).To(HaveLen(3))
+			Expect(body.Instances[0].ReplicationState).To(Equal(nfsbroker.ReplicationMissing))
+			Expect(body.Instances[1].ReplicationState).To(BeEmpty())
+			Expect(body.Instances[2].ReplicationState).To(Equal("finished"))
+			Expect(body.Instances[2].ReplicationLastSuccess).To(BeNumerically(">", 0))
+		})
+
+		It("reports instances whose quota cannot be read", func() {
+			fakeOneFS.FailRequests("GET", "/platform/1/quota/quotas")
+
+			recorder := request("GET", "/admin/usage")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(ContainSubstring("failed to read isilon quota for instance-1"))
+		})
+
+		It("rejects unknown formats", func() {
+			Expect(request("GET", "/admin/usage?format=xml").Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("trash", func() {
+		deprovision := func(instanceID, planID string) {
+			_, err := broker.Deprovision(ctx, instanceID, brokerapi.DeprovisionDetails{PlanID: planID}, false)
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		listTrash := func() []nfsbroker.TrashEntry {
+			recorder := request("GET", "/admin/trash")
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			var body struct {
+				Instances []nfsbroker.TrashEntry `json:"instances"`
+			}
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &body)).To(Succeed())
+			return body.Instances
+		}
+
+		BeforeEach(func() {
+			catalog.Services[0].Plans[0].TrashRetention = "7d"
+
+			provision("instance-1", "5", "org")
+			fakeOneFS.MkdirAll("/ifs/volumes/instance-1/data")
+			deprovision("instance-1", "5")
+		})
+
+		It("moves the directory of a deleted instance to the trash", func() {
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-1")).To(BeFalse())
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1/data")).To(BeTrue())
+			Expect(fakeOneFS.ExportCount()).To(Equal(0))
+			Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+
+			entries := listTrash()
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].InstanceID).To(Equal("instance-1"))
+			Expect(entries[0].OrgGUID).To(Equal("org"))
+			Expect(entries[0].Cluster).To(Equal("default"))
+			Expect(entries[0].Path).To(Equal("/ifs/volumes/.trash/instance-1"))
+			Expect(entries[0].Expires).To(BeTemporally("==", fakeClock.Now().Add(7*24*time.Hour)))
+		})
+
+		It("deletes instances of plans without a trash retention right away", func() {
+			provision("instance-2", "10", "org")
+			deprovision("instance-2", "10")
+
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-2")).To(BeFalse())
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-2")).To(BeFalse())
+			Expect(listTrash()).To(HaveLen(1))
+		})
+
+		It("deletes an instance whose directory was already removed by hand", func() {
+			provision("instance-2", "5", "org")
+			client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+			Expect(client.DeleteVolume(ctx, "instance-2")).To(Succeed())
+
+			deprovision("instance-2", "5")
+			Expect(listTrash()).To(HaveLen(2))
+
+			fakeClock.Increment(8 * 24 * time.Hour)
+			Expect(broker.PurgeTrash(ctx)).To(Succeed())
+			Expect(listTrash()).To(BeEmpty())
+		})
+
+		It("purges entries once they expire", func() {
+			fakeClock.Increment(7*24*time.Hour - time.Minute)
+			Expect(broker.PurgeTrash(ctx)).To(Succeed())
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1")).To(BeTrue())
+
+			fakeClock.Increment(time.Minute)
+			Expect(broker.PurgeTrash(ctx)).To(Succeed())
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1")).To(BeFalse())
+			Expect(listTrash()).To(BeEmpty())
+		})
+
+		It("keeps an entry it fails to purge", func() {
+			fakeClock.Increment(8 * 24 * time.Hour)
+			fakeOneFS.FailRequests("DELETE", "/namespace/ifs/volumes/.trash")
+
+			Expect(broker.PurgeTrash(ctx)).To(MatchError("failed to purge 1 of the expired trash entries"))
+			Expect(listTrash()).To(HaveLen(1))
+		})
+
+		It("purges in the background with the reaper", func() {
+			reaper := ifrit.Invoke(nfsbroker.NewTrashReaper(lagertest.NewTestLogger("reaper"), broker, fakeClock, time.Hour))
+			defer func() {
+				reaper.Signal(os.Interrupt)
+				Eventually(reaper.Wait()).Should(Receive())
+			}()
+
+			fakeClock.WaitForWatcherAndIncrement(8 * 24 * time.Hour)
+			Eventually(func() bool {
+				return fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1")
+			}).Should(BeFalse())
+		})
+
+		Describe("undelete", func() {
+			It("restores the directory into a new instance", func() {
+				provision("instance-2", "5", "org")
+
+				recorder := request("POST", "/admin/trash/instance-1/undelete/instance-2")
+				Expect(recorder.Code).To(Equal(http.StatusOK), recorder.Body.String())
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-2/data")).To(BeTrue())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1")).To(BeFalse())
+				export, ok := fakeOneFS.Export("/ifs/volumes/instance-2")
+				Expect(ok).To(BeTrue())
+				Expect(export.Clients).To(ConsistOf("10.10.0.0/16"))
+				quota, ok := fakeOneFS.Quota("/ifs/volumes/instance-2")
+				Expect(ok).To(BeTrue())
+				Expect(*quota.Thresholds.Hard).To(Equal(int64(5 * 1024 * 1024 * 1024)))
+				Expect(listTrash()).To(BeEmpty())
+			})
+
+			It("refuses an instance that is not empty", func() {
+				provision("instance-2", "5", "org")
+				fakeOneFS.SetQuotaUsage("/ifs/volumes/instance-2", isilonfakes.FakeQuotaUsage{Inodes: 3})
+
+				recorder := request("POST", "/admin/trash/instance-1/undelete/instance-2")
+				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				Expect(recorder.Body.String()).To(ContainSubstring("instance instance-2 is not empty"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1/data")).To(BeTrue())
+			})
+
+			It("refuses an instance of another org", func() {
+				provision("instance-2", "5", "other-org")
+
+				recorder := request("POST", "/admin/trash/instance-1/undelete/instance-2")
+				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				Expect(recorder.Body.String()).To(ContainSubstring("belongs to another org"))
+			})
+
+			It("refuses an instance too small for the deleted instance's data", func() {
+				catalog.Services[0].Plans[1].TrashRetention = "7d"
+				provision("instance-3", "10", "org")
+				fakeOneFS.SetQuotaUsage("/ifs/volumes/instance-3", isilonfakes.FakeQuotaUsage{Logical: 6 * nfsbroker.GB})
+				deprovision("instance-3", "10")
+				provision("instance-2", "5", "org")
+
+				recorder := request("POST", "/admin/trash/instance-3/undelete/instance-2")
+				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				Expect(recorder.Body.String()).To(ContainSubstring("do not fit"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-3")).To(BeTrue())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-2")).To(BeTrue())
+			})
+
+			It("puts the directory back in the trash when restoring fails", func() {
+				provision("instance-2", "5", "org")
+				fakeOneFS.FailRequests("PUT", "/platform/2/protocols/nfs/exports")
+
+				recorder := request("POST", "/admin/trash/instance-1/undelete/instance-2")
+				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1/data")).To(BeTrue())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-2")).To(BeTrue())
+				Expect(listTrash()).To(HaveLen(1))
+			})
+
+			It("refuses an entry that has expired", func() {
+				provision("instance-2", "5", "org")
+				fakeClock.Increment(7 * 24 * time.Hour)
+
+				recorder := request("POST", "/admin/trash/instance-1/undelete/instance-2")
+				Expect(recorder.Code).To(Equal(http.StatusInternalServerError))
+				Expect(recorder.Body.String()).To(ContainSubstring("about to be purged"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.trash/instance-1/data")).To(BeTrue())
+			})
+
+			It("keeps the reaper off an entry that expires while it is being restored", func() {
+				provision("instance-2", "5", "org")
+				held, release := fakeOneFS.HoldRequest("POST", "/namespace/ifs/volumes/.trash/instance-1")
+				undeleted := make(chan int, 1)
+				go func() {
+					undeleted <- request("POST", "/admin/trash/instance-1/undelete/instance-2").Code
+				}()
+				Eventually(held).Should(BeClosed())
+
+				fakeClock.Increment(8 * 24 * time.Hour)
+				Expect(broker.PurgeTrash(ctx)).To(Succeed())
+
+				release()
+				Eventually(undeleted).Should(Receive(Equal(http.StatusOK)))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/instance-2/data")).To(BeTrue())
+				Expect(listTrash()).To(BeEmpty())
+			})
+
+			It("returns 404 for an instance that is not in the trash", func() {
+				provision("instance-2", "5", "org")
+				Expect(request("POST", "/admin/trash/instance-3/undelete/instance-2").Code).To(Equal(http.StatusNotFound))
+			})
+
+			It("returns 404 for an unknown instance", func() {
+				Expect(request("POST", "/admin/trash/instance-1/undelete/instance-3").Code).To(Equal(http.StatusNotFound))
+			})
+		})
+	})
+
+	Describe("reconcile", func() {
+		var client isilon.Client
+
+		reconcile := func(path string) nfsbroker.ReconcileReport {
+			recorder := request("POST", path)
+			Expect(recorder.Code).To(Equal(http.StatusOK), recorder.Body.String())
+			var report nfsbroker.ReconcileReport
+			Expect(json.Unmarshal(recorder.Body.Bytes(), &report)).To(Succeed())
+			return report
+		}
+
+		kinds := func(report nfsbroker.ReconcileReport) []string {
+			found := []string{}
+			for _, drift := range report.Drift {
+				found = append(found, drift.Kind+" "+drift.Path)
+			}
+			return found
+		}
+
+		BeforeEach(func() {
+			client = isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+			for _, instanceID := range []string{"instance-1", "instance-2", "instance-3", "instance-4"} {
+				provision(instanceID, "5", "org")
+			}
+		})
+
+		It("finds nothing when the clusters match the store", func() {
+			fakeOneFS.MkdirAll("/ifs/volumes/.trash")
+
+			report := reconcile("/admin/reconcile")
+			Expect(report.Instances).To(Equal(4))
+			Expect(report.Drift).To(BeEmpty())
+			Expect(report.Counts).To(HaveKeyWithValue("missing_export", 0))
+		})
+
+		Context("when the clusters have drifted", func() {
+			BeforeEach(func() {
+				Expect(client.UnexportVolume(ctx, "instance-1", "")).To(Succeed())
+				Expect(client.ClearQuota(ctx, "instance-2")).To(Succeed())
+				Expect(client.DeleteVolume(ctx, "instance-3")).To(Succeed())
+				Expect(client.SetQuota(ctx, "instance-4", isilon.QuotaLimits{Hard: nfsbroker.GB})).To(Succeed())
+				fakeOneFS.MkdirAll("/ifs/volumes/stray")
+			})
+
+			It("reports every difference", func() {
+				report := reconcile("/admin/reconcile")
+				Expect(kinds(report)).To(ConsistOf(
+					"missing_export /ifs/volumes/instance-1",
+					"missing_quota /ifs/volumes/instance-2",
+					"missing_directory /ifs/volumes/instance-3",
+					"quota_mismatch /ifs/volumes/instance-4",
+					"orphaned_directory /ifs/volumes/stray",
+				))
+				Expect(report.Counts).To(HaveKeyWithValue("missing_export", 1))
+				Expect(report.Counts).To(HaveKeyWithValue("orphaned_directory", 1))
+				for _, drift := range report.Drift {
+					Expect(drift.Repaired).To(BeFalse())
+					if drift.Kind == "quota_mismatch" {
+						Expect(drift.Expected).To(Equal(5 * nfsbroker.GB))
+						Expect(drift.Actual).To(Equal(nfsbroker.GB))
+					}
+				}
+
+				_, ok := fakeOneFS.Export("/ifs/volumes/instance-1")
+				Expect(ok).To(BeFalse())
+			})
+
+			It("re-creates missing exports and quotas in repair mode", func() {
+				report := reconcile("/admin/reconcile?mode=repair")
+				for _, drift := range report.Drift {
+					switch drift.Kind {
+					case "missing_export", "missing_quota":
+						Expect(drift.Repaired).To(BeTrue())
+					default:
+						Expect(drift.Repaired).To(BeFalse())
+					}
+				}
+
+				export, ok := fakeOneFS.Export("/ifs/volumes/instance-1")
+				Expect(ok).To(BeTrue())
+				Expect(export.Clients).To(ConsistOf("10.10.0.0/16"))
+				quota, ok := fakeOneFS.Quota("/ifs/volumes/instance-2")
+				Expect(ok).To(BeTrue())
+				Expect(*quota.Thresholds.Hard).To(Equal(5 * nfsbroker.GB))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/stray")).To(BeTrue())
+
+				Expect(kinds(reconcile("/admin/reconcile"))).To(ConsistOf(
+					"missing_directory /ifs/volumes/instance-3",
+					"quota_mismatch /ifs/volumes/instance-4",
+					"orphaned_directory /ifs/volumes/stray",
+				))
+			})
+
+			It("counts the differences in the metrics", func() {
+				reconcile("/admin/reconcile?mode=repair")
+				reconcile("/admin/reconcile")
+
+				recorder := request("GET", "/admin/metrics")
+				Expect(recorder.Code).To(Equal(http.StatusOK))
+				var metrics struct {
+					Runs      int            `json:"reconcile_runs"`
+					Failures  int            `json:"reconcile_failures"`
+					LastRun   int64          `json:"reconcile_last_run"`
+					Instances int            `json:"reconcile_instances"`
+					Drift     map[string]int `json:"reconcile_drift"`
+					Found     map[string]int `json:"reconcile_drift_found"`
+					Repaired  map[string]int `json:"reconcile_drift_repaired"`
+				}
+				Expect(json.Unmarshal(recorder.Body.Bytes(), &metrics)).To(Succeed())
+
+				Expect(metrics.Runs).To(Equal(2))
+				Expect(metrics.Failures).To(Equal(0))
+				Expect(metrics.LastRun).To(Equal(fakeClock.Now().Unix()))
+				Expect(metrics.Instances).To(Equal(4))
+				Expect(metrics.Drift).To(HaveKeyWithValue("missing_export", 0))
+				Expect(metrics.Drift).To(HaveKeyWithValue("quota_mismatch", 1))
+				Expect(metrics.Drift).To(HaveKeyWithValue("check_failed", 0))
+				Expect(metrics.Found).To(HaveKeyWithValue("missing_export", 1))
+				Expect(metrics.Found).To(HaveKeyWithValue("quota_mismatch", 2))
+				Expect(metrics.Repaired).To(HaveKeyWithValue("missing_export", 1))
+				Expect(metrics.Repaired).To(HaveKeyWithValue("missing_quota", 1))
+				Expect(metrics.Repaired).To(HaveKeyWithValue("quota_mismatch", 0))
+			})
+
+			It("repairs in the background with the reconciler", func() {
+				reconciler := ifrit.Invoke(nfsbroker.NewReconciler(lagertest.NewTestLogger("reconciler"), broker, fakeClock, time.Hour, true))
+				defer func() {
+					reconciler.Signal(os.Interrupt)
+					Eventually(reconciler.Wait()).Should(Receive())
+				}()
+
+				fakeClock.WaitForWatcherAndIncrement(time.Hour)
+				Eventually(func() bool {
+					_, ok := fakeOneFS.Quota("/ifs/volumes/instance-2")
+					return ok
+				}).Should(BeTrue())
+			})
+		})
+
+		It("skips instances a request is working on", func() {
+			held, release := fakeOneFS.HoldRequest("DELETE", "/platform/")
+			deprovisioned := make(chan error, 1)
+			go func() {
+				_, err := broker.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{}, false)
+				deprovisioned <- err
+			}()
+			Eventually(held).Should(BeClosed())
+
+			report := reconcile("/admin/reconcile?mode=repair")
+			Expect(report.Instances).To(Equal(3))
+			for _, drift := range report.Drift {
+				Expect(drift.InstanceID).NotTo(Equal("instance-1"))
+			}
+
+			release()
+			Eventually(deprovisioned).Should(Receive(BeNil()))
+			_, ok := fakeOneFS.Export("/ifs/volumes/instance-1")
+			Expect(ok).To(BeFalse())
+			_, ok = fakeOneFS.Quota("/ifs/volumes/instance-1")
+			Expect(ok).To(BeFalse())
+		})
+
+		It("reports a volume path it cannot list", func() {
+			fakeOneFS.FailRequests("GET", "/namespace/ifs/volumes")
+
+			report := reconcile("/admin/reconcile")
+			Expect(report.Counts).To(HaveKeyWithValue("check_failed", 1))
+			Expect(report.Counts).To(HaveKeyWithValue("missing_directory", 0))
+		})
+
+		It("rejects unknown modes", func() {
+			Expect(request("POST", "/admin/reconcile?mode=fix").Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+})
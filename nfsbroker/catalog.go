@@ -0,0 +1,449 @@
+package nfsbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pivotal-cf/brokerapi"
+	"gopkg.in/yaml.v2"
+)
+
+// Catalog is the set of services and plans the broker advertises. Each plan
+// maps an opaque plan ID to the size of the quota an instance gets.
+type Catalog struct {
+	Services []CatalogService `json:"services"`
+
+	// OrgExports override the export policy of every plan for instances of
+	// the given organization GUIDs.
+	OrgExports map[string]ExportPolicy `json:"org_exports,omitempty"`
+}
+
+type CatalogService struct {
+	ID          string                     `json:"id"`
+	Name        string                     `json:"name"`
+	Description string                     `json:"description"`
+	Tags        []string                   `json:"tags,omitempty"`
+	Metadata    *brokerapi.ServiceMetadata `json:"metadata,omitempty"`
+	Plans       []CatalogPlan              `json:"plans"`
+}
+
+type CatalogPlan struct {
+	ID          string                         `json:"id"`
+	Name        string                         `json:"name"`
+	Description string                         `json:"description"`
+	Free        *bool                          `json:"free,omitempty"`
+	Metadata    *brokerapi.ServicePlanMetadata `json:"metadata,omitempty"`
+
+	// Size is the quota of an instance of this plan, such as "500MB" or
+	// "2TB". On a custom plan it is the size used when none is requested and
+	// may be left out.
+	Size string `json:"size,omitempty"`
+
+	// MinSize and MaxSize make this a custom plan, where the size comes from
+	// the size provision parameter and must lie within these limits.
+	MinSize string `json:"min_size,omitempty"`
+	MaxSize string `json:"max_size,omitempty"`
+
+	// Cluster pins instances of this plan to the named cluster when the
+	// plan placement policy is in use.
+	Cluster string `json:"cluster,omitempty"`
+
+	// Zone is the access zone instances of this plan are exported from,
+	// unless their org is mapped to a zone. It defaults to the System zone.
+	Zone string `json:"zone,omitempty"`
+
+	// Export restricts the hosts that may mount instances of this plan.
+	Export *ExportPolicy `json:"export,omitempty"`
+
+	// Security makes the exports of this plan require Kerberos, and its
+	// bindings mount over NFSv4.
+	Security *SecurityPolicy `json:"security,omitempty"`
+
+	// SMB shares instances of this plan over SMB as well as, or instead of,
+	// NFS.
+	SMB *SMBPolicy `json:"smb,omitempty"`
+
+	// StoragePool is the SmartPools node pool or tier the data of instances
+	// of this plan is stored in. It defaults to the cluster's default pool.
+	StoragePool string `json:"storage_pool,omitempty"`
+
+	// Ownership is the owner, group and mode of the root directory of
+	// instances of this plan, and the uids and gids they may choose instead.
+	Ownership *OwnershipPolicy `json:"ownership,omitempty"`
+
+	// Snapshots is the snapshot schedule of instances of this plan, unless
+	// they choose their own through the snapshots provision parameter.
+	Snapshots *SnapshotPolicy `json:"snapshots,omitempty"`
+
+	// Thresholds adds advisory and soft limits below the hard limit of the
+	// quotas of this plan.
+	Thresholds *QuotaThresholds `json:"thresholds,omitempty"`
+
+	// TrashRetention turns on soft delete: deprovisioning an instance of this
+	// plan moves its directory to the trash, where it is kept for this long,
+	// such as "7d", before it is purged.
+	TrashRetention string `json:"trash_retention,omitempty"`
+
+	// Replication copies instances of this plan to another cluster.
+	Replication *ReplicationPolicy `json:"replication,omitempty"`
+
+	// Import makes instances of this plan adopt an existing directory instead
+	// of creating a new one.
+	Import *ImportPolicy `json:"import,omitempty"`
+}
+
+// DefaultCatalog is served when no catalog file is configured. It keeps the
+// plan IDs of the original hard-coded plans so existing instances still map
+// onto a plan.
+func DefaultCatalog(serviceName, serviceId string) *Catalog {
+	return &Catalog{
+		Services: []CatalogService{{
+			ID:          serviceId,
+			Name:        serviceName,
+			Description: "DELL EMC Isilon",
+			Tags:        []string{"nfs", "isilon"},
+			Plans: []CatalogPlan{
+				{
+					ID:          "5",
+					Name:        "5GB",
+					Description: "5GB Dell EMC Isilon NFS Share.",
+					Size:        "5GB",
+				},
+				{
+					ID:          "10",
+					Name:        "10GB",
+					Description: "10GB Dell EMC Isilon NFS Share.",
+					Size:        "10GB",
+				},
+			},
+		}},
+	}
+}
+
+// LoadCatalog reads and validates a catalog file. The file may be YAML or
+// JSON; field names are the same in both.
+func LoadCatalog(path string) (*Catalog, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog %s with error %s", path, err)
+	}
+
+	catalog, err := parseCatalog(contents)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse catalog %s with error %s", path, err)
+	}
+
+	if err := catalog.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid catalog %s: %s", path, err)
+	}
+	return catalog, nil
+}
+
+func parseCatalog(contents []byte) (*Catalog, error) {
+	catalog := &Catalog{}
+	if err := decodeConfig(contents, catalog); err != nil {
+		return nil, err
+	}
+	return catalog, nil
+}
+
+// decodeConfig decodes YAML (and therefore JSON) into v. The YAML is
+// converted to JSON first so that the json tags, including the ones on the
+// embedded brokerapi types, are the only field names that apply.
+func decodeConfig(contents []byte, v interface{}) error {
+	var raw interface{}
+	if err := yaml.Unmarshal(contents, &raw); err != nil {
+		return err
+	}
+
+	converted, err := jsonCompatible(raw)
+	if err != nil {
+		return err
+	}
+	asJSON, err := json.Marshal(converted)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(asJSON))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+func jsonCompatible(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		result := map[string]interface{}{}
+		for key, elem := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			converted, err := jsonCompatible(elem)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = converted
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, elem := range v {
+			converted, err := jsonCompatible(elem)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = converted
+		}
+		return result, nil
+	default:
+		return v, nil
+	}
+}
+
+// Validate checks that every service and plan is complete, that IDs are
+// unique across the catalog and that every plan size can be parsed.
+func (c *Catalog) Validate() error {
+	if len(c.Services) == 0 {
+		return errors.New("no services defined")
+	}
+
+	serviceIDs := map[string]bool{}
+	serviceNames := map[string]bool{}
+	planIDs := map[string]bool{}
+
+	for _, service := range c.Services {
+		if service.ID == "" || service.Name == "" {
+			return errors.New("every service needs an id and a name")
+		}
+		if serviceIDs[service.ID] {
+			return fmt.Errorf("service id %s is used more than once", service.ID)
+		}
+		if serviceNames[service.Name] {
+			return fmt.Errorf("service name %s is used more than once", service.Name)
+		}
+		serviceIDs[service.ID] = true
+		serviceNames[service.Name] = true
+
+		if len(service.Plans) == 0 {
+			return fmt.Errorf("service %s has no plans", service.Name)
+		}
+
+		planNames := map[string]bool{}
+		for _, plan := range service.Plans {
+			if plan.ID == "" || plan.Name == "" {
+				return fmt.Errorf("every plan of service %s needs an id and a name", service.Name)
+			}
+			if planIDs[plan.ID] {
+				return fmt.Errorf("plan id %s is used more than once", plan.ID)
+			}
+			if planNames[plan.Name] {
+				return fmt.Errorf("plan name %s is used more than once in service %s", plan.Name, service.Name)
+			}
+			planIDs[plan.ID] = true
+			planNames[plan.Name] = true
+
+			if err := plan.validateSize(); err != nil {
+				return fmt.Errorf("plan %s of service %s: %s", plan.Name, service.Name, err)
+			}
+			if plan.Export != nil {
+				if err := plan.Export.validate(); err != nil {
+					return fmt.Errorf("plan %s of service %s: export: %s", plan.Name, service.Name, err)
+				}
+			}
+			if plan.Security != nil {
+				if err := plan.Security.validate(); err != nil {
+					return fmt.Errorf("plan %s of service %s: security: %s", plan.Name, service.Name, err)
+				}
+			}
+			if !plan.SMB.exportsNFS() && (plan.Export != nil || plan.Security != nil) {
+				return fmt.Errorf("plan %s of service %s: smb: export and security need the NFS export that no_nfs leaves out", plan.Name, service.Name)
+			}
+			if plan.Ownership != nil {
+				if err := plan.Ownership.validate(); err != nil {
+					return fmt.Errorf("plan %s of service %s: ownership: %s", plan.Name, service.Name, err)
+				}
+			}
+			if plan.Snapshots != nil {
+				if err := plan.Snapshots.validate(); err != nil {
+					return fmt.Errorf("plan %s of service %s: snapshots: %s", plan.Name, service.Name, err)
+				}
+			}
+			if plan.Thresholds != nil {
+				if err := plan.Thresholds.validate(); err != nil {
+					return fmt.Errorf("plan %s of service %s: thresholds: %s", plan.Name, service.Name, err)
+				}
+			}
+			if plan.TrashRetention != "" {
+				if _, err := parsePeriod("trash_retention", plan.TrashRetention); err != nil {
+					return fmt.Errorf("plan %s of service %s: %s", plan.Name, service.Name, err)
+				}
+			}
+			if plan.Replication != nil {
+				if err := plan.Replication.validate(); err != nil {
+					return fmt.Errorf("plan %s of service %s: replication: %s", plan.Name, service.Name, err)
+				}
+			}
+			if plan.Import != nil {
+				if err := plan.Import.validate(); err != nil {
+					return fmt.Errorf("plan %s of service %s: import: %s", plan.Name, service.Name, err)
+				}
+				if plan.Snapshots != nil || plan.Replication != nil || plan.TrashRetention != "" {
+					return fmt.Errorf("plan %s of service %s: import: cannot be combined with snapshots, replication or trash_retention", plan.Name, service.Name)
+				}
+				if plan.SMB != nil {
+					return fmt.Errorf("plan %s of service %s: import: adopted directories cannot be shared over SMB", plan.Name, service.Name)
+				}
+				if plan.StoragePool != "" {
+					return fmt.Errorf("plan %s of service %s: import: adopted directories cannot be moved to a storage_pool", plan.Name, service.Name)
+				}
+				if plan.Ownership != nil {
+					return fmt.Errorf("plan %s of service %s: import: adopted directories keep their owner and mode", plan.Name, service.Name)
+				}
+			}
+		}
+	}
+
+	for org, policy := range c.OrgExports {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("org_exports of org %s: %s", org, err)
+		}
+	}
+	return nil
+}
+
+// offers reports whether the service serviceID has the plan planID.
+func (c *Catalog) offers(serviceID, planID string) bool {
+	for _, service := range c.Services {
+		if service.ID != serviceID {
+			continue
+		}
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// plan finds a plan by its ID.
+func (c *Catalog) plan(planID string) (CatalogPlan, bool) {
+	for _, service := range c.Services {
+		for _, plan := range service.Plans {
+			if plan.ID == planID {
+				return plan, true
+			}
+		}
+	}
+	return CatalogPlan{}, false
+}
+
+// SizeBytes is the plan size in bytes.
+func (p CatalogPlan) SizeBytes() (int64, error) {
+	return parseSize(p.Size)
+}
+
+// Custom reports whether instances of the plan choose their own size.
+func (p CatalogPlan) Custom() bool {
+	return p.MinSize != "" || p.MaxSize != ""
+}
+
+func (p CatalogPlan) limits() (int64, int64, error) {
+	min, err := parseSize(p.MinSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("min_size: %s", err)
+	}
+	max, err := parseSize(p.MaxSize)
+	if err != nil {
+		return 0, 0, fmt.Errorf("max_size: %s", err)
+	}
+	return min, max, nil
+}
+
+func (p CatalogPlan) validateSize() error {
+	if !p.Custom() {
+		_, err := p.SizeBytes()
+		return err
+	}
+
+	min, max, err := p.limits()
+	if err != nil {
+		return err
+	}
+	if min > max {
+		return fmt.Errorf("min_size %s is larger than max_size %s", p.MinSize, p.MaxSize)
+	}
+	if p.Size != "" {
+		size, err := p.SizeBytes()
+		if err != nil {
+			return err
+		}
+		if size < min || size > max {
+			return fmt.Errorf("size %s is outside of min_size %s and max_size %s", p.Size, p.MinSize, p.MaxSize)
+		}
+	}
+	return nil
+}
+
+// sizeFor works out the size of an instance of the plan given the size
+// requested through provision parameters, which may be empty.
+func (p CatalogPlan) sizeFor(requested string) (int64, error) {
+	if !p.Custom() {
+		if requested != "" {
+			return 0, fmt.Errorf("plan %s has a fixed size and does not accept a size parameter", p.Name)
+		}
+		return p.SizeBytes()
+	}
+
+	if requested == "" {
+		if p.Size == "" {
+			return 0, fmt.Errorf("plan %s requires a size parameter between %s and %s", p.Name, p.MinSize, p.MaxSize)
+		}
+		return p.SizeBytes()
+	}
+
+	size, err := parseSize(requested)
+	if err != nil {
+		return 0, err
+	}
+	min, max, err := p.limits()
+	if err != nil {
+		return 0, err
+	}
+	if size < min || size > max {
+		return 0, fmt.Errorf("size %s is outside the limits of plan %s, which are %s to %s", requested, p.Name, p.MinSize, p.MaxSize)
+	}
+	return size, nil
+}
+
+var sizePattern = regexp.MustCompile(`^\s*(\d+)\s*([KMGTP]?B)\s*$`)
+
+// parseSize converts a size such as "500MB" or "2TB" to bytes. Units are
+// binary, so 1KB is 1024 bytes.
+func parseSize(size string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(strings.ToUpper(size))
+	if match == nil {
+		return 0, fmt.Errorf("size %q must be a whole number followed by B, KB, MB, GB, TB or PB", size)
+	}
+
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+
+	unit := map[string]int64{"B": 1, "KB": KB, "MB": MB, "GB": GB, "TB": TB, "PB": PB}[match[2]]
+	if n > (1<<63-1)/unit {
+		return 0, fmt.Errorf("size %q is too large", size)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("size %q must be greater than 0 bytes", size)
+	}
+	return n * unit, nil
+}
@@ -0,0 +1,256 @@
+package nfsbroker_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/nfsbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Catalog", func() {
+	var (
+		tempDir     string
+		catalogFile string
+		contents    string
+
+		catalog *nfsbroker.Catalog
+		err     error
+	)
+
+	BeforeEach(func() {
+		tempDir, err = ioutil.TempDir("", "catalog")
+		Expect(err).NotTo(HaveOccurred())
+		catalogFile = filepath.Join(tempDir, "catalog.yml")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(tempDir)
+	})
+
+	JustBeforeEach(func() {
+		Expect(ioutil.WriteFile(catalogFile, []byte(contents), 0644)).To(Succeed())
+		catalog, err = nfsbroker.LoadCatalog(catalogFile)
+	})
+
+	Context("given a YAML catalog", func() {
+		BeforeEach(func() {
+			contents = `
+services:
+- id: 5f2a6f7e-4d1c-4c36-9a57-7a3b0f4c1e21
+  name: isilon-nfs
+  description: Isilon NFS shares
+  tags: [nfs, isilon]
+  metadata:
+    displayName: Isilon NFS
+    documentationUrl: https://example.com/docs
+  plans:
+  - id: 0c6d9a3e-2b8f-4c71-bb3e-9d54a1e7f602
+    name: small
+    description: A small share
+    size: 500MB
+    free: false
+    metadata:
+      bullets: [500MB of storage]
+  - id: 7e0f4b8a-97c5-4a0e-8a2e-3f6d1c9b5a44
+    name: huge
+    description: A huge share
+    size: 2TB
+`
+		})
+
+		It("loads the services and plans", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Services).To(HaveLen(1))
+
+			service := catalog.Services[0]
+			Expect(service.ID).To(Equal("5f2a6f7e-4d1c-4c36-9a57-7a3b0f4c1e21"))
+			Expect(service.Name).To(Equal("isilon-nfs"))
+			Expect(service.Tags).To(ConsistOf("nfs", "isilon"))
+			Expect(service.Metadata.DisplayName).To(Equal("Isilon NFS"))
+			Expect(service.Metadata.DocumentationUrl).To(Equal("https://example.com/docs"))
+
+			Expect(service.Plans).To(HaveLen(2))
+			Expect(service.Plans[0].Name).To(Equal("small"))
+			Expect(*service.Plans[0].Free).To(BeFalse())
+			Expect(service.Plans[0].Metadata.Bullets).To(ConsistOf("500MB of storage"))
+		})
+
+		It("converts plan sizes to bytes", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Services[0].Plans[0].SizeBytes()).To(Equal(500 * nfsbroker.MB))
+			Expect(catalog.Services[0].Plans[1].SizeBytes()).To(Equal(2 * nfsbroker.TB))
+		})
+	})
+
+	Context("given a JSON catalog", func() {
+		BeforeEach(func() {
+			contents = `{"services": [{"id": "service-id", "name": "isilon-nfs", "plans": [{"id": "plan-id", "name": "small", "size": "1GB"}]}]}`
+		})
+
+		It("loads it", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Services[0].Plans[0].SizeBytes()).To(Equal(nfsbroker.GB))
+		})
+	})
+
+	Context("when the file does not exist", func() {
+		JustBeforeEach(func() {
+			catalog, err = nfsbroker.LoadCatalog(filepath.Join(tempDir, "missing.yml"))
+		})
+
+		It("errors", func() {
+			Expect(err).To(MatchError(ContainSubstring("failed to read catalog")))
+		})
+	})
+
+	Context("given an invalid catalog", func() {
+		invalidCatalogs := []struct {
+			name, contents, message string
+		}{
+			{"no services", `services: []`, "no services defined"},
+			{"unknown field", `{"services": [{"id": "s", "name": "n", "plan": []}]}`, "unknown field"},
+			{"service without a name", `{"services": [{"id": "s", "plans": [{"id": "p", "name": "n", "size": "1GB"}]}]}`, "every service needs an id and a name"},
+			{"service without plans", `{"services": [{"id": "s", "name": "n", "plans": []}]}`, "service n has no plans"},
+			{"plan without an id", `{"services": [{"id": "s", "name": "n", "plans": [{"name": "p", "size": "1GB"}]}]}`, "every plan of service n needs an id and a name"},
+			{"duplicate plan ids", `{"services": [
+			{"id": "s1", "name": "n1", "plans": [{"id": "p", "name": "a", "size": "1GB"}]},
+			{"id": "s2", "name": "n2", "plans": [{"id": "p", "name": "b", "size": "1GB"}]}]}`, "plan id p is used more than once"},
+			{"duplicate service ids", `{"services": [
+			{"id": "s", "name": "n1", "plans": [{"id": "p1", "name": "a", "size": "1GB"}]},
+			{"id": "s", "name": "n2", "plans": [{"id": "p2", "name": "b", "size": "1GB"}]}]}`, "service id s is used more than once"},
+			{"missing size", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a"}]}]}`, `plan a of service n: size "" must be a whole number`},
+			{"size without a unit", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "5"}]}]}`, `size "5" must be a whole number`},
+			{"zero size", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "0GB"}]}]}`, `size "0GB" must be greater than 0 bytes`},
+			{"size too large", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "9000000PB"}]}]}`, `size "9000000PB" is too large`},
+			{"custom plan without max_size", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "min_size": "1GB"}]}]}`, `plan a of service n: max_size: size "" must be a whole number`},
+			{"min_size larger than max_size", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "min_size": "1TB", "max_size": "1GB"}]}]}`, "min_size 1TB is larger than max_size 1GB"},
+			{"invalid export clients", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "export": {"clients": ["10.0.0.0/33"]}}]}]}`, `plan a of service n: export: clients: "10.0.0.0/33" is not an IP address or CIDR network`},
+			{"invalid org export override", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB"}]}], "org_exports": {"org": {"root_clients": ["somehost"]}}}`, `org_exports of org org: root_clients: "somehost" is not an IP address or CIDR network`},
+			{"security without flavors", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "security": {}}]}]}`, "plan a of service n: security: flavors: at least one flavor is needed"},
+			{"security with the unix flavor", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "security": {"flavors": ["krb5p", "unix"]}}]}]}`, `flavors: "unix" must be krb5, krb5i or krb5p`},
+			{"smb only with an export policy", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "smb": {"no_nfs": true}, "export": {"clients": ["10.0.0.0/8"]}}]}]}`, "plan a of service n: smb: export and security need the NFS export that no_nfs leaves out"},
+			{"import plan shared over smb", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "smb": {}, "import": {"prefixes": ["/ifs/legacy"]}}]}]}`, "import: adopted directories cannot be shared over SMB"},
+			{"import plan with a storage pool", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "storage_pool": "archive", "import": {"prefixes": ["/ifs/legacy"]}}]}]}`, "import: adopted directories cannot be moved to a storage_pool"},
+			{"import plan with ownership", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "ownership": {"mode": "755"}, "import": {"prefixes": ["/ifs/legacy"]}}]}]}`, "import: adopted directories keep their owner and mode"},
+			{"default uid outside its range", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "ownership": {"uid": 0, "uid_range": {"min": 1000, "max": 2000}}}]}]}`, "plan a of service n: ownership: uid 0 is not in uid_range 1000-2000"},
+			{"inverted gid range", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "ownership": {"gid_range": {"min": 2000, "max": 1000}}}]}]}`, "ownership: gid_range: 2000-1000 is not a range of ids from 0 up"},
+			{"setuid mode", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "ownership": {"mode": "4755"}}]}]}`, `ownership: mode "4755" must be permissions in octal, from 000 to 777`},
+			{"unknown snapshot frequency", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "snapshots": {"frequency": "monthly", "retention": "7d"}}]}]}`, `plan a of service n: snapshots: frequency "monthly" must be one of`},
+			{"snapshots without a retention", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "snapshots": {"frequency": "hourly"}}]}]}`, `retention "" must be a whole number followed by h, d or w`},
+			{"zero snapshot retention", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "snapshots": {"frequency": "daily", "retention": "0d"}}]}]}`, `retention "0d" must be longer than 0`},
+			{"advisory threshold of 100%", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "thresholds": {"advisory_percent": 100}}]}]}`, "plan a of service n: thresholds: advisory_percent 100 must be between 1 and 99, or 0 for no advisory threshold"},
+			{"negative soft threshold", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "thresholds": {"soft_percent": -5, "soft_grace": "1d"}}]}]}`, "soft_percent -5 must be between 1 and 99, or 0 for no soft threshold"},
+			{"advisory threshold above the soft one", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "thresholds": {"advisory_percent": 90, "soft_percent": 80, "soft_grace": "1d"}}]}]}`, "advisory_percent 90 must be below soft_percent 80"},
+			{"soft threshold without a grace period", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "thresholds": {"soft_percent": 90}}]}]}`, `soft_grace "" must be a whole number followed by h, d or w`},
+			{"grace period without a soft threshold", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "thresholds": {"advisory_percent": 80, "soft_grace": "1d"}}]}]}`, "soft_grace needs a soft_percent"},
+			{"trash retention in minutes", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "trash_retention": "30m"}]}]}`, `plan a of service n: trash_retention "30m" must be a whole number followed by h, d or w`},
+			{"import plan without prefixes", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "import": {}}]}]}`, "plan a of service n: import: prefixes: at least one prefix is needed"},
+			{"relative import prefix", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "import": {"prefixes": ["ifs/legacy"]}}]}]}`, `prefixes: "ifs/legacy" is not a clean absolute path below /`},
+			{"unknown import on_delete", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "import": {"prefixes": ["/ifs/legacy"], "on_delete": "archive"}}]}]}`, "on_delete: must be release or delete"},
+			{"import plan with trash retention", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "trash_retention": "7d", "import": {"prefixes": ["/ifs/legacy"]}}]}]}`, "import: cannot be combined with snapshots, replication or trash_retention"},
+			{"replication without a target host", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "replication": {"target_path": "/ifs/dr", "frequency": "daily"}}]}]}`, "plan a of service n: replication: target_host is required"},
+			{"replication outside /ifs", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "replication": {"target_host": "dr.example.com", "target_path": "/dr", "frequency": "daily"}}]}]}`, `target_path "/dr" must be a clean path under /ifs`},
+			{"unknown replication frequency", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "1GB", "replication": {"target_host": "dr.example.com", "target_path": "/ifs/dr", "frequency": "monthly"}}]}]}`, `frequency "monthly" must be hourly, daily or weekly`},
+			{"default size outside the limits", `{"services": [{"id": "s", "name": "n", "plans": [{"id": "p", "name": "a", "size": "5GB", "min_size": "10GB", "max_size": "1TB"}]}]}`, "size 5GB is outside of min_size 10GB and max_size 1TB"},
+		}
+
+		for _, invalid := range invalidCatalogs {
+			invalid := invalid
+			It("rejects a catalog with "+invalid.name, func() {
+				Expect(ioutil.WriteFile(catalogFile, []byte(invalid.contents), 0644)).To(Succeed())
+				_, err := nfsbroker.LoadCatalog(catalogFile)
+				Expect(err).To(MatchError(ContainSubstring(invalid.message)))
+			})
+		}
+	})
+
+	Context("given a custom plan", func() {
+		BeforeEach(func() {
+			contents = `
+services:
+- id: service-id
+  name: isilon-nfs
+  plans:
+  - id: plan-id
+    name: custom
+    size: 10GB
+    min_size: 1GB
+    max_size: 1TB
+`
+		})
+
+		It("loads the size limits", func() {
+			Expect(err).NotTo(HaveOccurred())
+			plan := catalog.Services[0].Plans[0]
+			Expect(plan.Custom()).To(BeTrue())
+			Expect(plan.MinSize).To(Equal("1GB"))
+			Expect(plan.MaxSize).To(Equal("1TB"))
+		})
+	})
+
+	Context("given export policies", func() {
+		BeforeEach(func() {
+			contents = `
+services:
+- id: service-id
+  name: isilon-nfs
+  plans:
+  - id: plan-id
+    name: small
+    size: 1GB
+    export:
+      clients: [10.10.0.0/16]
+      root_clients: [10.10.1.5]
+      read_only_clients: [10.20.0.0/16]
+org_exports:
+  org-guid:
+    clients: [192.168.0.0/24]
+`
+		})
+
+		It("loads the plan policy and the org overrides", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Services[0].Plans[0].Export.Clients).To(ConsistOf("10.10.0.0/16"))
+			Expect(catalog.Services[0].Plans[0].Export.RootClients).To(ConsistOf("10.10.1.5"))
+			Expect(catalog.Services[0].Plans[0].Export.ReadOnlyClients).To(ConsistOf("10.20.0.0/16"))
+			Expect(catalog.OrgExports["org-guid"].Clients).To(ConsistOf("192.168.0.0/24"))
+		})
+	})
+
+	Context("given a snapshot schedule", func() {
+		BeforeEach(func() {
+			contents = `
+services:
+- id: service-id
+  name: isilon-nfs
+  plans:
+  - id: plan-id
+    name: small
+    size: 1GB
+    snapshots:
+      frequency: hourly
+      retention: 7d
+`
+		})
+
+		It("loads the plan's schedule", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(catalog.Services[0].Plans[0].Snapshots).To(Equal(&nfsbroker.SnapshotPolicy{Frequency: "hourly", Retention: "7d"}))
+		})
+	})
+
+	Describe("DefaultCatalog", func() {
+		It("is valid", func() {
+			Expect(nfsbroker.DefaultCatalog("service-name", "service-id").Validate()).To(Succeed())
+		})
+
+		It("keeps the plan IDs of the original plans", func() {
+			plans := nfsbroker.DefaultCatalog("service-name", "service-id").Services[0].Plans
+			Expect([]string{plans[0].ID, plans[1].ID}).To(Equal([]string{"5", "10"}))
+			Expect(plans[1].SizeBytes()).To(Equal(10 * nfsbroker.GB))
+		})
+	})
+})
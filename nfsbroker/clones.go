@@ -0,0 +1,72 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// placeClone checks that an instance of orgGUID can be cloned from the source
+// instance, or from its snapshot when snapshotName is set. It returns the
+// cluster of the source, which the copy has to be made on, and the directory
+// to copy, having reserved the clone's capacity there.
+func (b *Broker) placeClone(ctx context.Context, instanceID, sourceID, snapshotName, orgGUID string, size int64) (*Cluster, string, error) {
+	details, fp, err := b.retrieveInstance(sourceID)
+	if err != nil {
+		return nil, "", fmt.Errorf("source instance %s does not exist", sourceID)
+	}
+	if details.OrganizationGUID != orgGUID {
+		return nil, "", fmt.Errorf("source instance %s belongs to another org", sourceID)
+	}
+	if op := fp.Operation; op != nil && (op.Type != operationProvision || op.State != brokerapi.Succeeded) {
+		return nil, "", fmt.Errorf("source instance %s cannot be cloned while its last %s is %s", sourceID, op.Type, op.State)
+	}
+
+	cluster, zone, name, err := b.instanceVolume(sourceID, fp)
+	if err != nil {
+		return nil, "", err
+	}
+
+	source := fp.VolumePath
+	if snapshotName == "" {
+		used, err := zone.Client.QuotaUsage(ctx, name)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read isilon quota usage for %s with error %s", sourceID, err)
+		}
+		if used > size {
+			return nil, "", fmt.Errorf("source instance %s holds %d bytes, which do not fit in %d bytes", sourceID, used, size)
+		}
+	} else {
+		snapshots, err := zone.Client.ListSnapshots(ctx, name)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to list isilon snapshots of %s with error %s", sourceID, err)
+		}
+		var found *isilon.Snapshot
+		for i := range snapshots {
+			if snapshots[i].Name == snapshotName {
+				found = &snapshots[i]
+			}
+		}
+		if found == nil {
+			return nil, "", fmt.Errorf("source instance %s has no snapshot %s", sourceID, snapshotName)
+		}
+		// what the snapshot holds cannot be known beforehand, so it is
+		// bounded by the quota the copy is made under instead
+		source = found.ContentPath()
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	allocated, err := b.allocatedLocked()
+	if err != nil {
+		return nil, "", err
+	}
+	if !b.clusters.fits(cluster, size, allocated) {
+		return nil, "", fmt.Errorf("cluster %s, which source instance %s is on, does not have %d bytes of capacity left", cluster.Name, sourceID, size)
+	}
+	b.reserved[instanceID] = reservation{cluster: cluster.Name, size: size}
+	return cluster, source, nil
+}
@@ -0,0 +1,139 @@
+package nfsbroker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// CloudController looks up org and space names through the Cloud Controller
+// v3 API. It authenticates as a UAA client with the client_credentials
+// grant, so the client needs the cloud_controller.admin_read_only or
+// cloud_controller.global_auditor authority.
+type CloudController struct {
+	apiURL       string
+	clientID     string
+	clientSecret string
+	httpClient   *http.Client
+
+	mutex *sync.Mutex
+	token string
+}
+
+func NewCloudController(apiURL, clientID, clientSecret string) *CloudController {
+	return &CloudController{
+		apiURL:       strings.TrimSuffix(apiURL, "/"),
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		httpClient:   http.DefaultClient,
+		mutex:        &sync.Mutex{},
+	}
+}
+
+func (c *CloudController) OrgName(ctx context.Context, guid string) (string, error) {
+	return c.name(ctx, "organizations", guid)
+}
+
+func (c *CloudController) SpaceName(ctx context.Context, guid string) (string, error) {
+	return c.name(ctx, "spaces", guid)
+}
+
+// name reads the name of an org or space. A token that has expired is
+// replaced once.
+func (c *CloudController) name(ctx context.Context, resource, guid string) (string, error) {
+	if guid == "" {
+		return "", fmt.Errorf("no %s guid to look up", resource)
+	}
+
+	var resp struct {
+		Name string `json:"name"`
+	}
+	endpoint := "/v3/" + resource + "/" + url.PathEscape(guid)
+	status, err := c.get(ctx, endpoint, &resp)
+	if status == http.StatusUnauthorized {
+		c.mutex.Lock()
+		c.token = ""
+		c.mutex.Unlock()
+		_, err = c.get(ctx, endpoint, &resp)
+	}
+	if err != nil {
+		return "", err
+	}
+	return resp.Name, nil
+}
+
+func (c *CloudController) get(ctx context.Context, endpoint string, result interface{}) (int, error) {
+	token, err := c.accessToken(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, c.apiURL+endpoint, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "bearer "+token)
+	return c.do(ctx, req, result)
+}
+
+// accessToken returns the current UAA token, fetching a new one when there is
+// none. The UAA is found through the links of the Cloud Controller's root.
+func (c *CloudController) accessToken(ctx context.Context) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.token != "" {
+		return c.token, nil
+	}
+
+	var root struct {
+		Links struct {
+			UAA struct {
+				Href string `json:"href"`
+			} `json:"uaa"`
+		} `json:"links"`
+	}
+	req, err := http.NewRequest(http.MethodGet, c.apiURL+"/", nil)
+	if err != nil {
+		return "", err
+	}
+	if _, err := c.do(ctx, req, &root); err != nil {
+		return "", fmt.Errorf("failed to find the UAA of %s with error %s", c.apiURL, err)
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	req, err = http.NewRequest(http.MethodPost, strings.TrimSuffix(root.Links.UAA.Href, "/")+"/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(c.clientID, c.clientSecret)
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if _, err := c.do(ctx, req, &token); err != nil {
+		return "", fmt.Errorf("failed to get a UAA token for client %s with error %s", c.clientID, err)
+	}
+
+	c.token = token.AccessToken
+	return c.token, nil
+}
+
+// do sends a request and decodes the JSON it gets back, returning the status
+// code along with any error.
+func (c *CloudController) do(ctx context.Context, req *http.Request, result interface{}) (int, error) {
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%s %s returned %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp.StatusCode, json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,486 @@
+package nfsbroker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"sync"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+)
+
+// Placement policies decide which cluster a new instance is created on.
+const (
+	// PlacementMostFreeSpace picks the cluster with the most unallocated
+	// capacity. Every cluster needs a capacity for it to be used.
+	PlacementMostFreeSpace = "most-free-space"
+	// PlacementRoundRobin takes turns between the clusters.
+	PlacementRoundRobin = "round-robin"
+	// PlacementPlan uses the cluster a plan is pinned to, and the first
+	// cluster with room for plans that are not pinned.
+	PlacementPlan = "plan"
+	// PlacementOrg uses a cluster that lists the instance's org, and the
+	// first cluster with room for orgs that no cluster lists.
+	PlacementOrg = "org"
+)
+
+// Cluster is one Isilon cluster the broker creates instances on.
+type Cluster struct {
+	Name   string
+	Config isilon.Config
+
+	// NFSHost is the host clients mount System zone exports from, usually a
+	// SmartConnect name. It defaults to the host of the API endpoint, which
+	// is often on a management network that clients cannot reach.
+	NFSHost string
+
+	// Capacity is the total quota, in bytes, the broker may allocate on the
+	// cluster. Zero means there is no limit.
+	Capacity int64
+
+	// Orgs are the organization GUIDs the org placement policy puts on this
+	// cluster.
+	Orgs []string
+
+	// Zones are the access zones, other than the System zone, that instances
+	// may be exported from.
+	Zones []*Zone
+
+	// TrashPath is where the directories of soft-deleted instances are kept
+	// until they are purged. It defaults to .trash under the volume path.
+	TrashPath string
+
+	// Client talks to the cluster. It is created from Config when not set.
+	Client isilon.Client
+
+	system *Zone
+}
+
+// systemZone is the name OneFS gives the access zone every cluster has.
+const systemZone = "System"
+
+// Zone is a OneFS access zone on a cluster.
+type Zone struct {
+	Name string
+
+	// SmartConnect is the DNS name clients mount the zone's exports through.
+	SmartConnect string
+
+	// VolumePath is where the zone's volumes are created. It must be inside
+	// the zone's base path, and defaults to the cluster's volume path.
+	VolumePath string
+
+	// Orgs are the organization GUIDs whose instances always go in this zone.
+	Orgs []string
+
+	// Client manages volumes in the zone. It is the cluster's Client, at
+	// VolumePath, when not set.
+	Client isilon.Client
+}
+
+// Host is the host name clients mount the zone's exports from.
+func (z *Zone) Host() string {
+	return z.SmartConnect
+}
+
+// instancePath is the directory of an instance in the zone.
+func (z *Zone) instancePath(instanceID string) string {
+	return path.Join(z.VolumePath, instanceID)
+}
+
+// exportZone is the zone name the OneFS API expects, which is empty for the
+// System zone.
+func (z *Zone) exportZone() string {
+	if z.Name == systemZone {
+		return ""
+	}
+	return z.Name
+}
+
+// Host is the host name of the cluster's API endpoint.
+func (c *Cluster) Host() string {
+	endpoint, err := url.Parse(c.Config.Endpoint)
+	if err != nil {
+		return ""
+	}
+	return endpoint.Hostname()
+}
+
+// Clusters is the set of clusters the broker manages and the policy used to
+// place new instances on them.
+type Clusters struct {
+	policy  string
+	members []*Cluster
+
+	mutex sync.Mutex
+	next  int
+}
+
+func NewClusters(policy string, members ...Cluster) (*Clusters, error) {
+	switch policy {
+	case PlacementMostFreeSpace, PlacementRoundRobin, PlacementPlan, PlacementOrg:
+	default:
+		return nil, fmt.Errorf("unknown placement policy %q", policy)
+	}
+
+	if len(members) == 0 {
+		return nil, errors.New("no clusters defined")
+	}
+
+	clusters := &Clusters{policy: policy}
+	names := map[string]bool{}
+	for i := range members {
+		cluster := members[i]
+		if cluster.Name == "" {
+			return nil, errors.New("every cluster needs a name")
+		}
+		if names[cluster.Name] {
+			return nil, fmt.Errorf("cluster name %s is used more than once", cluster.Name)
+		}
+		names[cluster.Name] = true
+
+		if policy == PlacementMostFreeSpace && cluster.Capacity <= 0 {
+			return nil, fmt.Errorf("cluster %s needs a capacity to use the %s placement policy", cluster.Name, policy)
+		}
+		if cluster.Client == nil {
+			cluster.Client = isilon.NewClient(cluster.Config)
+		}
+		if cluster.TrashPath == "" {
+			cluster.TrashPath = path.Join(cluster.Config.VolumePath, ".trash")
+		}
+		if err := cluster.setUpZones(); err != nil {
+			return nil, err
+		}
+		clusters.members = append(clusters.members, &cluster)
+	}
+	return clusters, nil
+}
+
+func (c *Cluster) setUpZones() error {
+	nfsHost := c.NFSHost
+	if nfsHost == "" {
+		nfsHost = c.Host()
+	}
+	c.system = &Zone{Name: systemZone, SmartConnect: nfsHost, VolumePath: c.Config.VolumePath, Client: c.Client}
+
+	names := map[string]bool{}
+	orgs := map[string]string{}
+	zones := []*Zone{}
+	for _, z := range c.Zones {
+		zone := *z
+		if zone.Name == "" || zone.Name == systemZone {
+			return fmt.Errorf("every access zone of cluster %s needs a name other than %s", c.Name, systemZone)
+		}
+		if names[zone.Name] {
+			return fmt.Errorf("access zone %s is listed more than once for cluster %s", zone.Name, c.Name)
+		}
+		names[zone.Name] = true
+
+		if zone.SmartConnect == "" {
+			return fmt.Errorf("access zone %s of cluster %s needs a smartconnect name", zone.Name, c.Name)
+		}
+		for _, org := range zone.Orgs {
+			if other, ok := orgs[org]; ok {
+				return fmt.Errorf("org %s is mapped to both access zone %s and %s on cluster %s", org, other, zone.Name, c.Name)
+			}
+			orgs[org] = zone.Name
+		}
+
+		if zone.VolumePath == "" {
+			zone.VolumePath = c.Config.VolumePath
+		}
+		if zone.Client == nil {
+			if zone.VolumePath == c.Config.VolumePath {
+				zone.Client = c.Client
+			} else {
+				zone.Client = c.Client.At(zone.VolumePath)
+			}
+		}
+		zones = append(zones, &zone)
+	}
+	c.Zones = zones
+	return nil
+}
+
+// ownPaths are the volume paths the broker creates instances in on the
+// cluster, and the trash path it moves deleted instances to.
+func (c *Cluster) ownPaths() []string {
+	paths := []string{c.TrashPath}
+	for _, zone := range c.volumeZones() {
+		paths = append(paths, zone.VolumePath)
+	}
+	return paths
+}
+
+// Zone finds an access zone on the cluster by name. Instances created before
+// zones were recorded have no zone name; they are in the System zone.
+func (c *Cluster) Zone(name string) (*Zone, bool) {
+	if name == "" || name == systemZone {
+		return c.system, true
+	}
+	for _, zone := range c.Zones {
+		if zone.Name == name {
+			return zone, true
+		}
+	}
+	return nil, false
+}
+
+// zoneAt is a copy of an access zone of the cluster whose volume path is
+// volumePath, through which directories outside the zone's own volume path
+// are managed. Its client is the zone's, at volumePath.
+func (c *Cluster) zoneAt(zone *Zone, volumePath string) *Zone {
+	if path.Clean(volumePath) == path.Clean(zone.VolumePath) {
+		return zone
+	}
+	at := *zone
+	at.VolumePath = volumePath
+	at.Client = zone.Client.At(volumePath)
+	return &at
+}
+
+// zoneFor picks the access zone for a new instance on the cluster. A zone
+// mapped to the instance's org wins over the zone of its plan, so that orgs
+// stay isolated whichever plan they use.
+func (c *Cluster) zoneFor(plan CatalogPlan, orgGUID string) (*Zone, error) {
+	for _, zone := range c.Zones {
+		if inArray(zone.Orgs, orgGUID) {
+			return zone, nil
+		}
+	}
+
+	zone, ok := c.Zone(plan.Zone)
+	if !ok {
+		return nil, fmt.Errorf("plan %s uses access zone %s, which cluster %s does not have", plan.Name, plan.Zone, c.Name)
+	}
+	return zone, nil
+}
+
+// ClustersConfig is the contents of a clusters file.
+type ClustersConfig struct {
+	Placement string          `json:"placement"`
+	Clusters  []ClusterConfig `json:"clusters"`
+}
+
+type ClusterConfig struct {
+	Name       string       `json:"name"`
+	Endpoint   string       `json:"endpoint"`
+	NFSHost    string       `json:"nfs_host,omitempty"`
+	Insecure   bool         `json:"insecure,omitempty"`
+	Username   string       `json:"username"`
+	Password   string       `json:"password"`
+	Group      string       `json:"group,omitempty"`
+	VolumePath string       `json:"volume_path"`
+	Capacity   string       `json:"capacity,omitempty"`
+	Orgs       []string     `json:"orgs,omitempty"`
+	Zones      []ZoneConfig `json:"zones,omitempty"`
+	TrashPath  string       `json:"trash_path,omitempty"`
+}
+
+type ZoneConfig struct {
+	Name         string   `json:"name"`
+	SmartConnect string   `json:"smartconnect"`
+	VolumePath   string   `json:"volume_path,omitempty"`
+	Orgs         []string `json:"orgs,omitempty"`
+}
+
+// LoadClusters reads and validates a clusters file. Like the catalog it may
+// be YAML or JSON.
+func LoadClusters(path string) (*Clusters, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read clusters %s with error %s", path, err)
+	}
+
+	config := ClustersConfig{}
+	if err := decodeConfig(contents, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse clusters %s with error %s", path, err)
+	}
+
+	clusters, err := config.clusters()
+	if err != nil {
+		return nil, fmt.Errorf("invalid clusters %s: %s", path, err)
+	}
+	return clusters, nil
+}
+
+func (c ClustersConfig) clusters() (*Clusters, error) {
+	policy := c.Placement
+	if policy == "" {
+		policy = PlacementRoundRobin
+	}
+
+	members := []Cluster{}
+	for _, config := range c.Clusters {
+		if config.Endpoint == "" || config.VolumePath == "" {
+			return nil, fmt.Errorf("cluster %s needs an endpoint and a volume_path", config.Name)
+		}
+
+		var capacity int64
+		if config.Capacity != "" {
+			var err error
+			if capacity, err = parseSize(config.Capacity); err != nil {
+				return nil, fmt.Errorf("cluster %s capacity: %s", config.Name, err)
+			}
+		}
+
+		zones := []*Zone{}
+		for _, zone := range config.Zones {
+			zones = append(zones, &Zone{
+				Name:         zone.Name,
+				SmartConnect: zone.SmartConnect,
+				VolumePath:   zone.VolumePath,
+				Orgs:         zone.Orgs,
+			})
+		}
+
+		members = append(members, Cluster{
+			Name:    config.Name,
+			NFSHost: config.NFSHost,
+			Config: isilon.Config{
+				Endpoint:   config.Endpoint,
+				Insecure:   config.Insecure,
+				Username:   config.Username,
+				Password:   config.Password,
+				Group:      config.Group,
+				VolumePath: config.VolumePath,
+			},
+			Capacity:  capacity,
+			Orgs:      config.Orgs,
+			Zones:     zones,
+			TrashPath: config.TrashPath,
+		})
+	}
+	return NewClusters(policy, members...)
+}
+
+// CheckCatalog makes sure every cluster a plan is pinned to exists, that
+// every cluster a plan's instances can be placed on has the plan's zone, and
+// that plans adopting directories know which cluster to find them on and do
+// not adopt them from where the broker creates or trashes instances.
+func (c *Clusters) CheckCatalog(catalog *Catalog) error {
+	for _, service := range catalog.Services {
+		for _, plan := range service.Plans {
+			targets := c.members
+			if plan.Cluster != "" {
+				cluster, ok := c.Get(plan.Cluster)
+				if !ok {
+					return fmt.Errorf("plan %s of service %s is pinned to unknown cluster %s", plan.Name, service.Name, plan.Cluster)
+				}
+				if c.policy == PlacementPlan {
+					targets = []*Cluster{cluster}
+				}
+			}
+
+			if plan.Import != nil && plan.Cluster == "" && len(c.members) > 1 {
+				return fmt.Errorf("plan %s of service %s adopts directories, so it has to be pinned to a cluster", plan.Name, service.Name)
+			}
+
+			for _, cluster := range targets {
+				if _, ok := cluster.Zone(plan.Zone); !ok {
+					return fmt.Errorf("plan %s of service %s uses access zone %s, which cluster %s does not have", plan.Name, service.Name, plan.Zone, cluster.Name)
+				}
+			}
+
+			// directories adopted from the broker's own paths could be the
+			// directories of other instances
+			if plan.Import != nil {
+				cluster, _ := c.Get(plan.Cluster)
+				for _, prefix := range plan.Import.Prefixes {
+					for _, dir := range cluster.ownPaths() {
+						if overlaps(prefix, dir) {
+							return fmt.Errorf("plan %s of service %s adopts directories from %s, which overlaps %s, where cluster %s keeps the directories of instances", plan.Name, service.Name, prefix, dir, cluster.Name)
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Get finds a cluster by name. Instances created before clusters were
+// recorded have no cluster name; they belong to the first cluster.
+func (c *Clusters) Get(name string) (*Cluster, bool) {
+	if name == "" {
+		return c.members[0], true
+	}
+	for _, cluster := range c.members {
+		if cluster.Name == name {
+			return cluster, true
+		}
+	}
+	return nil, false
+}
+
+func (c *Clusters) fits(cluster *Cluster, size int64, allocated map[string]int64) bool {
+	return cluster.Capacity == 0 || allocated[cluster.Name]+size <= cluster.Capacity
+}
+
+// place picks the cluster for a new instance of size bytes according to the
+// placement policy. allocated is the quota already handed out per cluster.
+func (c *Clusters) place(plan CatalogPlan, orgGUID string, size int64, allocated map[string]int64) (*Cluster, error) {
+	candidates := []*Cluster{}
+	for _, cluster := range c.members {
+		if c.fits(cluster, size, allocated) {
+			candidates = append(candidates, cluster)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no isilon cluster has %d bytes of capacity left", size)
+	}
+
+	switch c.policy {
+	case PlacementMostFreeSpace:
+		best := candidates[0]
+		for _, cluster := range candidates[1:] {
+			if cluster.Capacity-allocated[cluster.Name] > best.Capacity-allocated[best.Name] {
+				best = cluster
+			}
+		}
+		return best, nil
+
+	case PlacementRoundRobin:
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		for i := 0; i < len(c.members); i++ {
+			index := (c.next + i) % len(c.members)
+			if cluster := c.members[index]; c.fits(cluster, size, allocated) {
+				c.next = index + 1
+				return cluster, nil
+			}
+		}
+
+	case PlacementPlan:
+		if plan.Cluster != "" {
+			cluster, ok := c.Get(plan.Cluster)
+			if !ok {
+				return nil, fmt.Errorf("plan %s is pinned to unknown cluster %s", plan.Name, plan.Cluster)
+			}
+			if !c.fits(cluster, size, allocated) {
+				return nil, fmt.Errorf("cluster %s, which plan %s is pinned to, does not have %d bytes of capacity left", cluster.Name, plan.Name, size)
+			}
+			return cluster, nil
+		}
+
+	case PlacementOrg:
+		affine := false
+		for _, cluster := range c.members {
+			if !inArray(cluster.Orgs, orgGUID) {
+				continue
+			}
+			affine = true
+			if c.fits(cluster, size, allocated) {
+				return cluster, nil
+			}
+		}
+		if affine {
+			return nil, fmt.Errorf("none of the clusters for org %s has %d bytes of capacity left", orgGUID, size)
+		}
+	}
+
+	return candidates[0], nil
+}
@@ -0,0 +1,485 @@
+package nfsbroker_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"code.cloudfoundry.org/goshims/osshim/os_fake"
+	"code.cloudfoundry.org/lager/lagertest"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon/isilonfakes"
+	"github.com/nimbus-cloud/isilon-nfs-broker/nfsbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+var _ = Describe("Clusters", func() {
+	Describe("LoadClusters", func() {
+		var (
+			tempDir      string
+			clustersFile string
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "clusters")
+			Expect(err).NotTo(HaveOccurred())
+			clustersFile = filepath.Join(tempDir, "clusters.yml")
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		load := func(contents string) (*nfsbroker.Clusters, error) {
+			Expect(ioutil.WriteFile(clustersFile, []byte(contents), 0644)).To(Succeed())
+			return nfsbroker.LoadClusters(clustersFile)
+		}
+
+		It("loads every cluster", func() {
+			clusters, err := load(`
+placement: most-free-space
+clusters:
+- name: east
+  endpoint: https://isilon-east.example.com:8080
+  username: admin
+  password: secret
+  volume_path: /ifs/volumes
+  capacity: 100TB
+  orgs: [org-a]
+- name: west
+  endpoint: https://isilon-west.example.com:8080
+  nfs_host: nfs-west.example.com
+  insecure: true
+  username: admin
+  password: secret
+  volume_path: /ifs/data/volumes
+  capacity: 50TB
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			east, ok := clusters.Get("east")
+			Expect(ok).To(BeTrue())
+			Expect(east.Host()).To(Equal("isilon-east.example.com"))
+			Expect(east.Capacity).To(Equal(100 * nfsbroker.TB))
+			Expect(east.Orgs).To(ConsistOf("org-a"))
+
+			west, ok := clusters.Get("west")
+			Expect(ok).To(BeTrue())
+			Expect(west.Config.Insecure).To(BeTrue())
+			Expect(west.Config.VolumePath).To(Equal("/ifs/data/volumes"))
+
+			system, ok := west.Zone("")
+			Expect(ok).To(BeTrue())
+			Expect(system.Host()).To(Equal("nfs-west.example.com"))
+		})
+
+		It("treats instances without a recorded cluster as living on the first cluster", func() {
+			clusters, err := load(`
+clusters:
+- name: east
+  endpoint: https://east:8080
+  volume_path: /ifs/volumes
+- name: west
+  endpoint: https://west:8080
+  volume_path: /ifs/volumes
+`)
+			Expect(err).NotTo(HaveOccurred())
+			cluster, ok := clusters.Get("")
+			Expect(ok).To(BeTrue())
+			Expect(cluster.Name).To(Equal("east"))
+		})
+
+		It("rejects an unknown placement policy", func() {
+			_, err := load(`{"placement": "random", "clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs"}]}`)
+			Expect(err).To(MatchError(ContainSubstring(`unknown placement policy "random"`)))
+		})
+
+		It("rejects duplicate cluster names", func() {
+			_, err := load(`{"clusters": [
+				{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs"},
+				{"name": "a", "endpoint": "https://b:8080", "volume_path": "/ifs"}]}`)
+			Expect(err).To(MatchError(ContainSubstring("cluster name a is used more than once")))
+		})
+
+		It("rejects a cluster without an endpoint", func() {
+			_, err := load(`{"clusters": [{"name": "a", "volume_path": "/ifs"}]}`)
+			Expect(err).To(MatchError(ContainSubstring("cluster a needs an endpoint and a volume_path")))
+		})
+
+		It("requires capacities for the most-free-space policy", func() {
+			_, err := load(`{"placement": "most-free-space", "clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs"}]}`)
+			Expect(err).To(MatchError(ContainSubstring("cluster a needs a capacity to use the most-free-space placement policy")))
+		})
+
+		It("loads the access zones of each cluster", func() {
+			clusters, err := load(`
+clusters:
+- name: east
+  endpoint: https://isilon-east.example.com:8080
+  volume_path: /ifs/volumes
+  zones:
+  - name: finance
+    smartconnect: finance.nfs.example.com
+    volume_path: /ifs/finance/volumes
+    orgs: [org-finance]
+`)
+			Expect(err).NotTo(HaveOccurred())
+
+			east, _ := clusters.Get("east")
+			zone, ok := east.Zone("finance")
+			Expect(ok).To(BeTrue())
+			Expect(zone.Host()).To(Equal("finance.nfs.example.com"))
+			Expect(zone.VolumePath).To(Equal("/ifs/finance/volumes"))
+			Expect(zone.Orgs).To(ConsistOf("org-finance"))
+
+			system, ok := east.Zone("")
+			Expect(ok).To(BeTrue())
+			Expect(system.Name).To(Equal("System"))
+			Expect(system.Host()).To(Equal("isilon-east.example.com"))
+		})
+
+		It("requires a smartconnect name for every access zone", func() {
+			_, err := load(`{"clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs", "zones": [{"name": "z"}]}]}`)
+			Expect(err).To(MatchError(ContainSubstring("access zone z of cluster a needs a smartconnect name")))
+		})
+
+		It("rejects orgs mapped to more than one access zone of a cluster", func() {
+			_, err := load(`{"clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs", "zones": [
+				{"name": "z1", "smartconnect": "z1.example.com", "orgs": ["org"]},
+				{"name": "z2", "smartconnect": "z2.example.com", "orgs": ["org"]}]}]}`)
+			Expect(err).To(MatchError(ContainSubstring("org org is mapped to both access zone z1 and z2 on cluster a")))
+		})
+
+		It("rejects catalogs that use access zones a cluster does not have", func() {
+			clusters, err := load(`{"clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs"}]}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			catalog := nfsbroker.DefaultCatalog("service-name", "service-id")
+			catalog.Services[0].Plans[0].Zone = "finance"
+			Expect(clusters.CheckCatalog(catalog)).To(MatchError("plan 5GB of service service-name uses access zone finance, which cluster a does not have"))
+		})
+
+		It("rejects catalogs that pin plans to unknown clusters", func() {
+			clusters, err := load(`{"clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs"}]}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			catalog := nfsbroker.DefaultCatalog("service-name", "service-id")
+			catalog.Services[0].Plans[0].Cluster = "b"
+			Expect(clusters.CheckCatalog(catalog)).To(MatchError("plan 5GB of service service-name is pinned to unknown cluster b"))
+		})
+
+		It("rejects catalogs with import plans that are not pinned when there are several clusters", func() {
+			clusters, err := load(`{"clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs/volumes"}, {"name": "b", "endpoint": "https://b:8080", "volume_path": "/ifs/volumes"}]}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			catalog := nfsbroker.DefaultCatalog("service-name", "service-id")
+			catalog.Services[0].Plans[0].Import = &nfsbroker.ImportPolicy{Prefixes: []string{"/ifs/legacy"}}
+			Expect(clusters.CheckCatalog(catalog)).To(MatchError("plan 5GB of service service-name adopts directories, so it has to be pinned to a cluster"))
+
+			catalog.Services[0].Plans[0].Cluster = "b"
+			Expect(clusters.CheckCatalog(catalog)).To(Succeed())
+		})
+
+		It("rejects catalogs with import plans that adopt directories from where the broker keeps its own", func() {
+			clusters, err := load(`{"clusters": [{"name": "a", "endpoint": "https://a:8080", "volume_path": "/ifs/volumes", "trash_path": "/ifs/trash", "zones": [
+				{"name": "finance", "smartconnect": "finance.example.com", "volume_path": "/ifs/finance/volumes"}]}]}`)
+			Expect(err).NotTo(HaveOccurred())
+
+			catalog := nfsbroker.DefaultCatalog("service-name", "service-id")
+			for prefix, overlapped := range map[string]string{
+				"/ifs":                 "/ifs/trash",
+				"/ifs/volumes/legacy":  "/ifs/volumes",
+				"/ifs/trash":           "/ifs/trash",
+				"/ifs/finance/volumes": "/ifs/finance/volumes",
+			} {
+				catalog.Services[0].Plans[0].Import = &nfsbroker.ImportPolicy{Prefixes: []string{"/ifs/legacy", prefix}}
+				Expect(clusters.CheckCatalog(catalog)).To(MatchError(fmt.Sprintf("plan 5GB of service service-name adopts directories from %s, which overlaps %s, where cluster a keeps the directories of instances", prefix, overlapped)))
+			}
+
+			catalog.Services[0].Plans[0].Import = &nfsbroker.ImportPolicy{Prefixes: []string{"/ifs/legacy", "/ifs/finance/legacy"}}
+			Expect(clusters.CheckCatalog(catalog)).To(Succeed())
+		})
+	})
+
+	Describe("placement", func() {
+		var (
+			ctx     context.Context
+			tempDir string
+			east    *isilonfakes.FakeOneFS
+			west    *isilonfakes.FakeOneFS
+			catalog *nfsbroker.Catalog
+			broker  *nfsbroker.Broker
+		)
+
+		cluster := func(name string, fake *isilonfakes.FakeOneFS, capacity int64, orgs ...string) nfsbroker.Cluster {
+			return nfsbroker.Cluster{
+				Name: name,
+				Config: isilon.Config{
+					Endpoint:   fake.URL,
+					Username:   "admin",
+					Password:   "password",
+					VolumePath: "/ifs/volumes",
+				},
+				Capacity: capacity,
+				Orgs:     orgs,
+			}
+		}
+
+		newBroker := func(policy string, members ...nfsbroker.Cluster) {
+			clusters, err := nfsbroker.NewClusters(policy, members...)
+			Expect(err).NotTo(HaveOccurred())
+
+			logger := lagertest.NewTestLogger("test-broker")
+			store := brokerstore.NewStore(logger, "", "", "", "", "", "", "", filepath.Join(tempDir, "service-name-services.json"))
+			broker = nfsbroker.New(
+				logger,
+				catalog, tempDir,
+				&os_fake.FakeOs{},
+				nil,
+				store,
+				nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+				clusters,
+				nil,
+			)
+		}
+
+		provision := func(instanceID, planID, orgGUID string) error {
+			_, err := broker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, OrganizationGUID: orgGUID}, false)
+			return err
+		}
+
+		BeforeEach(func() {
+			ctx = context.TODO()
+
+			var err error
+			tempDir, err = ioutil.TempDir("", "placement")
+			Expect(err).NotTo(HaveOccurred())
+
+			east = isilonfakes.NewFakeOneFS("admin", "password")
+			east.MkdirAll("/ifs/volumes")
+			west = isilonfakes.NewFakeOneFS("admin", "password")
+			west.MkdirAll("/ifs/volumes")
+
+			catalog = nfsbroker.DefaultCatalog("service-name", "service-id")
+		})
+
+		AfterEach(func() {
+			east.Close()
+			west.Close()
+			os.RemoveAll(tempDir)
+		})
+
+		Context("with the most-free-space policy", func() {
+			BeforeEach(func() {
+				newBroker(nfsbroker.PlacementMostFreeSpace, cluster("east", east, 15*nfsbroker.GB), cluster("west", west, 12*nfsbroker.GB))
+			})
+
+			It("places each instance on the cluster with the most unallocated capacity", func() {
+				Expect(provision("instance-1", "10", "org")).To(Succeed())
+				Expect(east.DirectoryExists("/ifs/volumes/instance-1")).To(BeTrue())
+
+				Expect(provision("instance-2", "5", "org")).To(Succeed())
+				Expect(west.DirectoryExists("/ifs/volumes/instance-2")).To(BeTrue())
+			})
+
+			It("refuses instances that no cluster has room for", func() {
+				Expect(provision("instance-1", "10", "org")).To(Succeed())
+				Expect(provision("instance-2", "10", "org")).To(Succeed())
+				Expect(provision("instance-3", "10", "org")).To(MatchError("no isilon cluster has 10737418240 bytes of capacity left"))
+			})
+
+			It("does not grow an instance beyond the capacity of its cluster", func() {
+				Expect(provision("instance-1", "10", "org")).To(Succeed())
+				Expect(provision("instance-2", "10", "org")).To(Succeed())
+
+				catalog.Services[0].Plans = append(catalog.Services[0].Plans, nfsbroker.CatalogPlan{ID: "15", Name: "15GB", Size: "15GB"})
+				_, err := broker.Update(ctx, "instance-2", brokerapi.UpdateDetails{PlanID: "15"}, false)
+				Expect(err).To(MatchError(ContainSubstring("cluster west does not have the capacity to grow instance instance-2")))
+			})
+		})
+
+		Context("with the round-robin policy", func() {
+			BeforeEach(func() {
+				newBroker(nfsbroker.PlacementRoundRobin, cluster("east", east, 0), cluster("west", west, 0))
+			})
+
+			It("takes turns between the clusters", func() {
+				Expect(provision("instance-1", "5", "org")).To(Succeed())
+				Expect(provision("instance-2", "5", "org")).To(Succeed())
+				Expect(provision("instance-3", "5", "org")).To(Succeed())
+
+				Expect(east.DirectoryExists("/ifs/volumes/instance-1")).To(BeTrue())
+				Expect(west.DirectoryExists("/ifs/volumes/instance-2")).To(BeTrue())
+				Expect(east.DirectoryExists("/ifs/volumes/instance-3")).To(BeTrue())
+			})
+		})
+
+		Context("when a cluster has an NFS host", func() {
+			BeforeEach(func() {
+				withHost := cluster("east", east, 0)
+				withHost.NFSHost = "nfs-east.example.com"
+				newBroker(nfsbroker.PlacementRoundRobin, withHost)
+			})
+
+			It("binds through the NFS host rather than the API endpoint", func() {
+				Expect(provision("instance-1", "5", "org")).To(Succeed())
+
+				binding, err := broker.Bind(ctx, "instance-1", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://nfs-east.example.com/ifs/volumes/instance-1"))
+			})
+		})
+
+		Context("with the plan policy", func() {
+			BeforeEach(func() {
+				catalog.Services[0].Plans[1].Cluster = "west"
+				newBroker(nfsbroker.PlacementPlan, cluster("east", east, 0), cluster("west", west, 0))
+			})
+
+			It("places instances of pinned plans on their cluster", func() {
+				Expect(provision("instance-1", "10", "org")).To(Succeed())
+				Expect(west.DirectoryExists("/ifs/volumes/instance-1")).To(BeTrue())
+			})
+
+			It("places instances of other plans on the first cluster", func() {
+				Expect(provision("instance-1", "5", "org")).To(Succeed())
+				Expect(east.DirectoryExists("/ifs/volumes/instance-1")).To(BeTrue())
+			})
+		})
+
+		Context("with the org policy", func() {
+			BeforeEach(func() {
+				newBroker(nfsbroker.PlacementOrg, cluster("east", east, 0), cluster("west", west, 0, "org-west"))
+			})
+
+			It("places instances on the cluster that lists their org", func() {
+				Expect(provision("instance-1", "5", "org-west")).To(Succeed())
+				Expect(west.DirectoryExists("/ifs/volumes/instance-1")).To(BeTrue())
+
+				Expect(provision("instance-2", "5", "org-other")).To(Succeed())
+				Expect(east.DirectoryExists("/ifs/volumes/instance-2")).To(BeTrue())
+			})
+
+			It("deprovisions and binds against the cluster the instance was placed on", func() {
+				Expect(provision("instance-1", "5", "org-west")).To(Succeed())
+
+				bindParameters, err := json.Marshal(map[string]interface{}{})
+				Expect(err).NotTo(HaveOccurred())
+				binding, err := broker.Bind(ctx, "instance-1", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: bindParameters})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://127.0.0.1/ifs/volumes/instance-1"))
+
+				_, err = broker.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(west.DirectoryExists("/ifs/volumes/instance-1")).To(BeFalse())
+			})
+		})
+
+		Context("with access zones", func() {
+			BeforeEach(func() {
+				east.MkdirAll("/ifs/finance/volumes")
+
+				zoned := cluster("east", east, 0)
+				zoned.Zones = []*nfsbroker.Zone{
+					{Name: "finance", SmartConnect: "finance.nfs.example.com", VolumePath: "/ifs/finance/volumes", Orgs: []string{"org-finance"}},
+					{Name: "research", SmartConnect: "research.nfs.example.com"},
+				}
+				catalog.Services[0].Plans[1].Zone = "research"
+				newBroker(nfsbroker.PlacementRoundRobin, zoned)
+			})
+
+			It("exports instances of plans without a zone from the System zone", func() {
+				Expect(provision("instance-1", "5", "org")).To(Succeed())
+				export, ok := east.Export("/ifs/volumes/instance-1")
+				Expect(ok).To(BeTrue())
+				Expect(export.Zone).To(Equal("System"))
+			})
+
+			It("exports instances from the zone of their plan", func() {
+				Expect(provision("instance-1", "10", "org")).To(Succeed())
+				export, ok := east.Export("/ifs/volumes/instance-1")
+				Expect(ok).To(BeTrue())
+				Expect(export.Zone).To(Equal("research"))
+			})
+
+			It("exports instances of mapped orgs from their zone, whatever the plan", func() {
+				Expect(provision("instance-1", "10", "org-finance")).To(Succeed())
+
+				binding, err := broker.Bind(ctx, "instance-1", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://finance.nfs.example.com/ifs/finance/volumes/instance-1"))
+
+				Expect(east.DirectoryExists("/ifs/finance/volumes/instance-1")).To(BeTrue())
+				export, ok := east.Export("/ifs/finance/volumes/instance-1")
+				Expect(ok).To(BeTrue())
+				Expect(export.Zone).To(Equal("finance"))
+			})
+
+			It("shares one connection between the zones of a cluster", func() {
+				Expect(provision("instance-1", "5", "org")).To(Succeed())
+				Expect(provision("instance-2", "5", "org-finance")).To(Succeed())
+
+				Expect(east.DirectoryExists("/ifs/volumes/instance-1")).To(BeTrue())
+				Expect(east.DirectoryExists("/ifs/finance/volumes/instance-2")).To(BeTrue())
+				Expect(east.Connections()).To(Equal(1))
+			})
+
+			It("binds through the zone's SmartConnect name and unexports from the zone", func() {
+				Expect(provision("instance-1", "10", "org")).To(Succeed())
+
+				binding, err := broker.Bind(ctx, "instance-1", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://research.nfs.example.com/ifs/volumes/instance-1"))
+
+				_, err = broker.Deprovision(ctx, "instance-1", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(east.ExportCount()).To(Equal(0))
+				Expect(east.DirectoryExists("/ifs/volumes/instance-1")).To(BeFalse())
+			})
+		})
+
+		Context("when the cluster is given a client", func() {
+			var client *rootedClient
+
+			BeforeEach(func() {
+				east.MkdirAll("/ifs/finance/volumes")
+				east.MkdirAll("/ifs/legacy/app")
+				catalog.Services[0].Plans = append(catalog.Services[0].Plans, nfsbroker.CatalogPlan{ID: "import", Name: "import", Size: "10GB", Import: &nfsbroker.ImportPolicy{Prefixes: []string{"/ifs/legacy"}}})
+
+				given := cluster("east", east, 0)
+				client = &rootedClient{Client: isilon.NewClient(given.Config)}
+				given.Client = client
+				given.Zones = []*nfsbroker.Zone{
+					{Name: "finance", SmartConnect: "finance.nfs.example.com", VolumePath: "/ifs/finance/volumes", Orgs: []string{"org-finance"}},
+				}
+				newBroker(nfsbroker.PlacementRoundRobin, given)
+			})
+
+			It("manages zones and adopted directories through it", func() {
+				_, err := broker.Provision(ctx, "instance-1", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "import", OrganizationGUID: "org", RawParameters: json.RawMessage(`{"path": "/ifs/legacy/app"}`)}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(client.roots).To(ContainElement("/ifs/finance/volumes"))
+				Expect(client.roots).To(ContainElement("/ifs/legacy"))
+			})
+		})
+	})
+})
+
+// rootedClient records the volume paths clients are derived for.
+type rootedClient struct {
+	isilon.Client
+	roots []string
+}
+
+func (c *rootedClient) At(volumePath string) isilon.Client {
+	c.roots = append(c.roots, volumePath)
+	return c.Client.At(volumePath)
+}
@@ -0,0 +1,178 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// ExportPolicy lists the hosts allowed to mount an instance's export, as IP
+// addresses or CIDR networks. Hosts in RootClients keep root access, and
+// hosts in ReadOnlyClients may only read.
+type ExportPolicy struct {
+	Clients         []string `json:"clients,omitempty"`
+	RootClients     []string `json:"root_clients,omitempty"`
+	ReadOnlyClients []string `json:"read_only_clients,omitempty"`
+}
+
+func (p ExportPolicy) validate() error {
+	for _, list := range []struct {
+		name    string
+		entries []string
+	}{
+		{"clients", p.Clients},
+		{"root_clients", p.RootClients},
+		{"read_only_clients", p.ReadOnlyClients},
+	} {
+		for _, entry := range list.entries {
+			if net.ParseIP(entry) != nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("%s: %q is not an IP address or CIDR network", list.name, entry)
+			}
+		}
+	}
+	return nil
+}
+
+// overriddenBy replaces every list that the org override sets.
+func (p ExportPolicy) overriddenBy(override ExportPolicy) ExportPolicy {
+	if override.Clients != nil {
+		p.Clients = override.Clients
+	}
+	if override.RootClients != nil {
+		p.RootClients = override.RootClients
+	}
+	if override.ReadOnlyClients != nil {
+		p.ReadOnlyClients = override.ReadOnlyClients
+	}
+	return p
+}
+
+// exportClients is the export policy that applies to an instance of a plan
+// in an org. Plans without a policy leave their exports open to every host.
+func (c *Catalog) exportClients(planID, orgGUID string) isilon.ExportClients {
+	policy := ExportPolicy{}
+	if plan, ok := c.plan(planID); ok && plan.Export != nil {
+		policy = *plan.Export
+	}
+	if override, ok := c.OrgExports[orgGUID]; ok {
+		policy = policy.overriddenBy(override)
+	}
+	return isilon.ExportClients{
+		Clients:         policy.Clients,
+		RootClients:     policy.RootClients,
+		ReadOnlyClients: policy.ReadOnlyClients,
+	}
+}
+
+// sameExportClients reports whether a and b allow the same hosts in the same
+// way.
+func sameExportClients(a, b isilon.ExportClients) bool {
+	return sameHosts(a.Clients, b.Clients) && sameHosts(a.RootClients, b.RootClients) && sameHosts(a.ReadOnlyClients, b.ReadOnlyClients)
+}
+
+func sameHosts(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// ExportClientsResult is the outcome of re-applying the export policy to one
+// instance.
+type ExportClientsResult struct {
+	InstanceID      string   `json:"instance_id"`
+	Clients         []string `json:"clients"`
+	RootClients     []string `json:"root_clients"`
+	ReadOnlyClients []string `json:"read_only_clients"`
+	Error           string   `json:"error,omitempty"`
+}
+
+// ReapplyExportClients sets the client lists of every instance's export to
+// what the catalog currently says, for when the allowed networks change.
+// Instances that are still being created or deleted, and instances that are
+// only shared over SMB, are skipped. A failure on one instance, or another
+// request working on it, does not stop the others; check each result's Error.
+func (b *Broker) ReapplyExportClients(ctx context.Context) ([]ExportClientsResult, error) {
+	logger := b.logger.Session("reapply-export-clients")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	ids, err := b.instanceIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ExportClientsResult{}
+	for _, instanceID := range ids {
+		if result, ok := b.reapplyExportClients(ctx, logger, instanceID); ok {
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// reapplyExportClients sets the client lists of one instance's export while
+// holding its lock, so that it cannot race a request working on the instance,
+// such as a synchronous deprovision. It returns false for an instance that is
+// skipped; an instance that is busy is reported with an error instead.
+func (b *Broker) reapplyExportClients(ctx context.Context, logger lager.Logger, instanceID string) (ExportClientsResult, bool) {
+	unlock, lockErr := b.lockInstance(instanceID)
+	if lockErr == nil {
+		defer unlock()
+	}
+
+	details, fp, err := b.retrieveInstance(instanceID)
+	if err != nil {
+		return ExportClientsResult{}, false
+	}
+	if op := fp.Operation; op != nil && (op.Type == operationDeprovision || op.State != brokerapi.Succeeded) {
+		return ExportClientsResult{}, false
+	}
+	if plan, ok := b.catalog.plan(details.PlanID); ok && !plan.SMB.exportsNFS() {
+		return ExportClientsResult{}, false
+	}
+
+	clients := b.catalog.exportClients(details.PlanID, details.OrganizationGUID)
+	result := ExportClientsResult{
+		InstanceID:      instanceID,
+		Clients:         append([]string{}, clients.Clients...),
+		RootClients:     append([]string{}, clients.RootClients...),
+		ReadOnlyClients: append([]string{}, clients.ReadOnlyClients...),
+	}
+	if lockErr != nil {
+		result.Error = lockErr.Error()
+		return result, true
+	}
+	if err := b.setExportClients(ctx, logger, instanceID, details, fp); err != nil {
+		result.Error = err.Error()
+	}
+	return result, true
+}
+
+func (b *Broker) setExportClients(ctx context.Context, logger lager.Logger, instanceID string, details brokerstore.ServiceInstance, fp InstanceFingerprint) error {
+	_, zone, name, err := b.instanceVolume(instanceID, fp)
+	if err != nil {
+		return err
+	}
+
+	clients := b.catalog.exportClients(details.PlanID, details.OrganizationGUID)
+	if err := zone.Client.SetExportClients(ctx, name, zone.exportZone(), clients); err != nil {
+		logger.Error("failed-to-set-export-clients", err, lager.Data{"instanceID": instanceID})
+		return fmt.Errorf("failed to set isilon export clients for %s with error %s", instanceID, err)
+	}
+	logger.Info("set-export-clients", lager.Data{"instanceID": instanceID, "clients": clients})
+	return nil
+}
@@ -0,0 +1,133 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// What deprovisioning does with an adopted directory.
+const (
+	// ImportRelease removes the export and quota but leaves the directory and
+	// its data where they are.
+	ImportRelease = "release"
+	// ImportDelete deletes the directory like that of any other instance.
+	ImportDelete = "delete"
+)
+
+// ImportPolicy makes a plan adopt existing directories instead of creating
+// new ones. Each instance names its directory with the path provision
+// parameter, which must lie under one of Prefixes, such as "/ifs/legacy".
+type ImportPolicy struct {
+	Prefixes []string `json:"prefixes"`
+	// OnDelete is ImportRelease or ImportDelete, and defaults to release.
+	OnDelete string `json:"on_delete,omitempty"`
+}
+
+func (p ImportPolicy) validate() error {
+	if len(p.Prefixes) == 0 {
+		return errors.New("prefixes: at least one prefix is needed")
+	}
+	for _, prefix := range p.Prefixes {
+		if !path.IsAbs(prefix) || path.Clean(prefix) != prefix || prefix == "/" {
+			return fmt.Errorf("prefixes: %q is not a clean absolute path below /", prefix)
+		}
+	}
+	switch p.OnDelete {
+	case "", ImportRelease, ImportDelete:
+	default:
+		return fmt.Errorf("on_delete: must be %s or %s", ImportRelease, ImportDelete)
+	}
+	return nil
+}
+
+// allows reports whether dir lies strictly inside one of the prefixes.
+func (p ImportPolicy) allows(dir string) bool {
+	if !path.IsAbs(dir) || path.Clean(dir) != dir {
+		return false
+	}
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(dir, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// overlaps reports whether either of two clean absolute paths is, or lies
+// inside, the other.
+func overlaps(a, b string) bool {
+	return a == b || strings.HasPrefix(a, b+"/") || strings.HasPrefix(b, a+"/")
+}
+
+// deletes reports whether deprovisioning deletes adopted directories. Without
+// a policy, as when the plan has left the catalog, they are kept.
+func (p *ImportPolicy) deletes() bool {
+	return p != nil && p.OnDelete == ImportDelete
+}
+
+// placeImport checks that an instance of plan can adopt the directory dir,
+// and returns the cluster it is on and the zone it is exported from, rooted
+// at the directory's parent, having reserved the directory and its capacity.
+func (b *Broker) placeImport(ctx context.Context, instanceID string, plan CatalogPlan, orgGUID, dir string, size int64) (*Cluster, *Zone, error) {
+	if !plan.Import.allows(dir) {
+		return nil, nil, fmt.Errorf("path %s is not under any of the prefixes plan %s may adopt directories from", dir, plan.Name)
+	}
+
+	cluster, ok := b.clusters.Get(plan.Cluster)
+	if !ok {
+		return nil, nil, fmt.Errorf("plan %s is pinned to cluster %s, which is not configured", plan.Name, plan.Cluster)
+	}
+	zone, err := cluster.zoneFor(plan, orgGUID)
+	if err != nil {
+		return nil, nil, err
+	}
+	zone = cluster.zoneAt(zone, path.Dir(dir))
+
+	names, err := zone.Client.ListVolumes(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list isilon directories in %s with error %s", zone.VolumePath, err)
+	}
+	if !inArray(names, path.Base(dir)) {
+		return nil, nil, fmt.Errorf("directory %s does not exist on cluster %s", dir, cluster.Name)
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ids, err := b.instanceIDsLocked()
+	if err != nil {
+		return nil, nil, err
+	}
+	// adopting the directory of another instance, or one around or inside
+	// it, would hand its data to a second instance
+	for _, id := range ids {
+		_, fp, err := b.retrieveInstanceLocked(id)
+		if err != nil || fp.Cluster != cluster.Name {
+			continue
+		}
+		switch {
+		case fp.VolumePath == dir:
+			return nil, nil, fmt.Errorf("directory %s is already adopted by instance %s", dir, id)
+		case overlaps(dir, fp.VolumePath):
+			return nil, nil, fmt.Errorf("directory %s overlaps %s, the directory of instance %s", dir, fp.VolumePath, id)
+		}
+	}
+	for id, r := range b.reserved {
+		if r.importPath != "" && overlaps(dir, r.importPath) && r.cluster == cluster.Name {
+			return nil, nil, fmt.Errorf("directory %s overlaps %s, which instance %s is adopting", dir, r.importPath, id)
+		}
+	}
+
+	allocated, err := b.allocatedLocked()
+	if err != nil {
+		return nil, nil, err
+	}
+	if !b.clusters.fits(cluster, size, allocated) {
+		return nil, nil, fmt.Errorf("cluster %s, which directory %s is on, does not have %d bytes of capacity left", cluster.Name, dir, size)
+	}
+	b.reserved[instanceID] = reservation{cluster: cluster.Name, size: size, importPath: dir}
+	return cluster, zone, nil
+}
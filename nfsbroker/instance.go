@@ -0,0 +1,394 @@
+package nfsbroker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// instanceIndexID is the store record listing every instance this broker
+// manages. brokerstore cannot enumerate its own records, so the broker keeps
+// the list itself in order to resume operations and walk its instances.
+const instanceIndexID = "isilon-nfs-broker-instance-index"
+
+// fingerprintVersion is recorded in every fingerprint the broker writes.
+// Fingerprints without a version hold a volume path built from the
+// GOISILON_VOLUMEPATH environment variable, which the broker never set, so
+// the path has to be rebuilt from the configured volume path.
+const fingerprintVersion = 1
+
+// InstanceFingerprint is what the broker keeps in the ServiceFingerPrint
+// field of each brokerstore.ServiceInstance. AdvisoryLimit and SoftLimit are
+// the quota thresholds in bytes, zero when unset, CloneSource is the
+// directory a cloned instance was copied from, and ImportPath is the existing
+// directory an instance adopted. Directory is where the layout put the
+// instance's directory, relative to the volume path of its zone; instances
+// from before layouts, and adopted directories, have none. Ownership is what
+// the root directory was given when the instance was created, and Created is
+// what the broker made for it on the cluster.
+type InstanceFingerprint struct {
+	Version       int             `json:"version,omitempty"`
+	VolumePath    string          `json:"volume_path"`
+	Cluster       string          `json:"cluster,omitempty"`
+	Zone          string          `json:"zone,omitempty"`
+	Size          int64           `json:"size,omitempty"`
+	AdvisoryLimit int64           `json:"advisory_limit,omitempty"`
+	SoftLimit     int64           `json:"soft_limit,omitempty"`
+	Snapshots     *SnapshotPolicy `json:"snapshots,omitempty"`
+	CloneSource   string          `json:"clone_source,omitempty"`
+	ImportPath    string          `json:"import_path,omitempty"`
+	Directory     string          `json:"directory,omitempty"`
+	Ownership     *Ownership      `json:"ownership,omitempty"`
+	Created       *Created        `json:"created,omitempty"`
+	Operation     *Operation      `json:"operation,omitempty"`
+}
+
+// Created lists the OneFS objects the broker made for an instance, by the
+// names and IDs OneFS knows them by, so that deleting the instance removes
+// them and leaves alone whatever else is on its directory, such as the
+// snapshots an adopted directory already had. Snapshots are the
+// ones taken through the admin API; the ones taken by the snapshot schedule
+// name it. Instances from before it was recorded have none.
+type Created struct {
+	SnapshotSchedule  string  `json:"snapshot_schedule,omitempty"`
+	ReplicationPolicy string  `json:"replication_policy,omitempty"`
+	Share             string  `json:"share,omitempty"`
+	Snapshots         []int64 `json:"snapshots,omitempty"`
+}
+
+// tookSnapshot reports whether the broker took a snapshot of the instance.
+func (c *Created) tookSnapshot(snapshot isilon.Snapshot) bool {
+	if c.SnapshotSchedule != "" && snapshot.Schedule == c.SnapshotSchedule {
+		return true
+	}
+	for _, id := range c.Snapshots {
+		if id == snapshot.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeName is the name of an instance's directory in the volume path of
+// the zone returned by instanceVolume.
+func (fp InstanceFingerprint) volumeName(instanceID string) string {
+	switch {
+	case fp.ImportPath != "":
+		return path.Base(fp.ImportPath)
+	case fp.Directory != "":
+		return path.Base(fp.Directory)
+	}
+	return instanceID
+}
+
+// Operation is the last provision or deprovision run against an instance.
+type Operation struct {
+	Type        string                       `json:"type"`
+	State       brokerapi.LastOperationState `json:"state"`
+	Description string                       `json:"description,omitempty"`
+}
+
+// fingerprintFrom decodes a stored fingerprint. Depending on the store it
+// comes back as the struct itself or as the generic result of decoding JSON;
+// instances created before fingerprints were structured hold a bare volume
+// path string.
+func fingerprintFrom(raw interface{}) (InstanceFingerprint, error) {
+	switch fp := raw.(type) {
+	case nil:
+		return InstanceFingerprint{}, nil
+	case InstanceFingerprint:
+		return fp, nil
+	case *InstanceFingerprint:
+		return *fp, nil
+	case string:
+		return InstanceFingerprint{VolumePath: fp}, nil
+	}
+
+	bytes, err := json.Marshal(raw)
+	if err != nil {
+		return InstanceFingerprint{}, err
+	}
+	var fp InstanceFingerprint
+	if err := json.Unmarshal(bytes, &fp); err != nil {
+		return InstanceFingerprint{}, fmt.Errorf("failed to decode instance fingerprint with error %s", err)
+	}
+	return fp, nil
+}
+
+// migrateFingerprint brings a fingerprint written by an older broker up to
+// date, reporting whether anything changed. The cluster and zone are recorded
+// explicitly so that the instance stays put if the clusters are reordered.
+func (b *Broker) migrateFingerprint(instanceID string, fp InstanceFingerprint) (InstanceFingerprint, bool, error) {
+	if fp.Version >= fingerprintVersion {
+		return fp, false, nil
+	}
+
+	cluster, zone, err := b.instanceZone(instanceID, fp)
+	if err != nil {
+		return fp, false, err
+	}
+	fp.Version = fingerprintVersion
+	fp.Cluster = cluster.Name
+	fp.Zone = zone.Name
+	fp.VolumePath = zone.instancePath(instanceID)
+	return fp, true, nil
+}
+
+// migrateInstances rewrites the fingerprints of every indexed instance that
+// was created by an older broker. Instances from before the index existed
+// are migrated when they are next bound.
+func (b *Broker) migrateInstances(logger lager.Logger) {
+	logger = logger.Session("migrate-instances")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	ids, err := b.instanceIDsLocked()
+	if err != nil {
+		logger.Error("failed-to-list-instances", err)
+		return
+	}
+
+	migrated := 0
+	for _, instanceID := range ids {
+		details, fp, err := b.retrieveInstanceLocked(instanceID)
+		if err != nil {
+			logger.Error("failed-to-retrieve-instance", err, lager.Data{"instanceID": instanceID})
+			continue
+		}
+		if b.migrateInstanceLocked(logger, instanceID, details, fp) != fp {
+			migrated++
+		}
+	}
+
+	if migrated > 0 {
+		if err := b.store.Save(logger); err != nil {
+			logger.Error("failed-to-save-state", err)
+		}
+	}
+}
+
+// migrateInstanceLocked migrates and stores one instance's fingerprint,
+// returning the fingerprint to use. Failures are logged rather than returned,
+// so that an instance the broker cannot migrate keeps working as before.
+func (b *Broker) migrateInstanceLocked(logger lager.Logger, instanceID string, details brokerstore.ServiceInstance, fp InstanceFingerprint) InstanceFingerprint {
+	migrated, changed, err := b.migrateFingerprint(instanceID, fp)
+	if err != nil {
+		logger.Error("failed-to-migrate-instance", err, lager.Data{"instanceID": instanceID})
+		return fp
+	}
+	if !changed {
+		return fp
+	}
+
+	if err := b.updateInstanceLocked(instanceID, details, migrated); err != nil {
+		logger.Error("failed-to-store-migrated-instance", err, lager.Data{"instanceID": instanceID})
+		return migrated
+	}
+	if err := b.indexInstanceLocked(instanceID); err != nil {
+		logger.Error("failed-to-index-migrated-instance", err, lager.Data{"instanceID": instanceID})
+	}
+	logger.Info("migrated-instance", lager.Data{"instanceID": instanceID, "from": fp.VolumePath, "to": migrated.VolumePath})
+	return migrated
+}
+
+// lockInstance keeps other requests off an instance until the returned
+// function is called, failing with ErrConcurrentInstanceAccess while another
+// request holds it. Asynchronous operations outlive the request that starts
+// them, so they are guarded by the operation in progress recorded with the
+// instance instead.
+func (b *Broker) lockInstance(instanceID string) (func(), error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.busy[instanceID] {
+		return nil, ErrConcurrentInstanceAccess
+	}
+	b.busy[instanceID] = true
+	return func() {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		delete(b.busy, instanceID)
+	}, nil
+}
+
+// checkProvisioned fails with ErrConcurrentInstanceAccess while an operation
+// on an instance is in progress, and when its last operation did not leave it
+// provisioned. Instances provisioned synchronously record no operation.
+func checkProvisioned(instanceID string, fp InstanceFingerprint, action string) error {
+	op := fp.Operation
+	switch {
+	case op == nil:
+		return nil
+	case op.State == brokerapi.InProgress:
+		return ErrConcurrentInstanceAccess
+	case op.Type != operationProvision || op.State != brokerapi.Succeeded:
+		return fmt.Errorf("instance %s cannot be %s while its last %s is %s", instanceID, action, op.Type, op.State)
+	}
+	return nil
+}
+
+// retrieveInstance is RetrieveInstanceDetails plus the decoded fingerprint.
+func (b *Broker) retrieveInstance(instanceID string) (brokerstore.ServiceInstance, InstanceFingerprint, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.retrieveInstanceLocked(instanceID)
+}
+
+func (b *Broker) retrieveInstanceLocked(instanceID string) (brokerstore.ServiceInstance, InstanceFingerprint, error) {
+	details, err := b.store.RetrieveInstanceDetails(instanceID)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, InstanceFingerprint{}, err
+	}
+	fp, err := fingerprintFrom(details.ServiceFingerPrint)
+	if err != nil {
+		return brokerstore.ServiceInstance{}, InstanceFingerprint{}, err
+	}
+	return details, fp, nil
+}
+
+// updateInstanceLocked replaces a stored instance record.
+func (b *Broker) updateInstanceLocked(instanceID string, details brokerstore.ServiceInstance, fp InstanceFingerprint) error {
+	details.ServiceFingerPrint = fp
+	return b.replaceRecordLocked(instanceID, details)
+}
+
+// replaceRecordLocked replaces a stored record, or creates it if there is
+// none. The store has no update operation, so this is a delete followed by a
+// create, and when the create fails the previous record is put back rather
+// than lost.
+func (b *Broker) replaceRecordLocked(id string, record brokerstore.ServiceInstance) error {
+	previous, err := b.store.RetrieveInstanceDetails(id)
+	existed := err == nil
+	if existed {
+		if err := b.store.DeleteInstanceDetails(id); err != nil {
+			return err
+		}
+	}
+	if err := b.store.CreateInstanceDetails(id, record); err != nil {
+		if existed {
+			if restoreErr := b.store.CreateInstanceDetails(id, previous); restoreErr != nil {
+				return fmt.Errorf("%s; failed to restore the previous record of %s with error %s", err, id, restoreErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// indexLocked returns the contents of an index record such as
+// instanceIndexID. A store that has never held the index is empty, but once
+// the broker has read the index, losing it would lose track of what it
+// listed, so from then on a missing index is an error.
+func (b *Broker) indexLocked(id string) (interface{}, error) {
+	record, err := b.store.RetrieveInstanceDetails(id)
+	if err == nil && record.ServiceFingerPrint == nil {
+		err = errors.New("the record is empty")
+	}
+	if err != nil {
+		if b.indexes[id] {
+			return nil, fmt.Errorf("failed to read %s, which the store held before, with error %s", id, err)
+		}
+		return nil, nil
+	}
+	b.indexes[id] = true
+	return record.ServiceFingerPrint, nil
+}
+
+func (b *Broker) instanceIDs() ([]string, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.instanceIDsLocked()
+}
+
+func (b *Broker) instanceIDsLocked() ([]string, error) {
+	index, err := b.indexLocked(instanceIndexID)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return []string{}, nil
+	}
+
+	bytes, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	if err := json.Unmarshal(bytes, &ids); err != nil {
+		return nil, fmt.Errorf("failed to decode instance index with error %s", err)
+	}
+	return ids, nil
+}
+
+func (b *Broker) writeIndexLocked(ids []string) error {
+	return b.replaceRecordLocked(instanceIndexID, brokerstore.ServiceInstance{ServiceFingerPrint: ids})
+}
+
+func (b *Broker) indexInstanceLocked(instanceID string) error {
+	ids, err := b.instanceIDsLocked()
+	if err != nil {
+		return err
+	}
+	if inArray(ids, instanceID) {
+		return nil
+	}
+	return b.writeIndexLocked(append(ids, instanceID))
+}
+
+func (b *Broker) unindexInstanceLocked(instanceID string) error {
+	ids, err := b.instanceIDsLocked()
+	if err != nil {
+		return err
+	}
+	remaining := []string{}
+	for _, id := range ids {
+		if id != instanceID {
+			remaining = append(remaining, id)
+		}
+	}
+	if len(remaining) == len(ids) {
+		return nil
+	}
+	return b.writeIndexLocked(remaining)
+}
+
+// allocatedLocked adds up the quota handed out on each cluster, including
+// the quota reserved for instances that are still being provisioned.
+func (b *Broker) allocatedLocked() (map[string]int64, error) {
+	ids, err := b.instanceIDsLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	allocated := map[string]int64{}
+	for _, id := range ids {
+		details, fp, err := b.retrieveInstanceLocked(id)
+		if err != nil {
+			continue
+		}
+		cluster, ok := b.clusters.Get(fp.Cluster)
+		if !ok {
+			continue
+		}
+		size, err := b.instanceSize(details, fp)
+		if err != nil {
+			continue
+		}
+		allocated[cluster.Name] += size
+	}
+	for _, r := range b.reserved {
+		allocated[r.cluster] += r.size
+	}
+	return allocated, nil
+}
@@ -0,0 +1,140 @@
+package nfsbroker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+)
+
+// DefaultLayout puts the directory of every instance straight in the volume
+// path of its zone, named after the instance.
+const DefaultLayout = "{{.InstanceID}}"
+
+// NameLookup finds the names of orgs and spaces, which layouts may use in
+// place of their GUIDs.
+type NameLookup interface {
+	OrgName(ctx context.Context, guid string) (string, error)
+	SpaceName(ctx context.Context, guid string) (string, error)
+}
+
+// Layout decides where in the volume path of its zone the directory of a new
+// instance goes. It is a text/template, such as
+// "{{.OrgGUID}}/{{.SpaceGUID}}/{{.InstanceID}}", executed against a
+// layoutData. The last element of the path has to contain the instance ID,
+// as it names the export and the share as well as the directory.
+type Layout struct {
+	text     string
+	template *template.Template
+	names    NameLookup
+}
+
+// layoutData is what a layout can refer to. OrgName and SpaceName are only
+// looked up when the layout uses them.
+type layoutData struct {
+	ctx   context.Context
+	names NameLookup
+
+	InstanceID string
+	OrgGUID    string
+	SpaceGUID  string
+	PlanName   string
+}
+
+func (d layoutData) OrgName() (string, error) {
+	if d.names == nil {
+		return "", errors.New("no Cloud Controller is configured to look up org names")
+	}
+	name, err := d.names.OrgName(d.ctx, d.OrgGUID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the name of org %s with error %s", d.OrgGUID, err)
+	}
+	return pathElement(name), nil
+}
+
+func (d layoutData) SpaceName() (string, error) {
+	if d.names == nil {
+		return "", errors.New("no Cloud Controller is configured to look up space names")
+	}
+	name, err := d.names.SpaceName(d.ctx, d.SpaceGUID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the name of space %s with error %s", d.SpaceGUID, err)
+	}
+	return pathElement(name), nil
+}
+
+// pathElement makes a name safe to use as one element of a path.
+func pathElement(name string) string {
+	name = strings.Replace(name, "/", "_", -1)
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// sampleNames stands in for the Cloud Controller while a layout is checked.
+type sampleNames struct{}
+
+func (sampleNames) OrgName(context.Context, string) (string, error)   { return "org-name", nil }
+func (sampleNames) SpaceName(context.Context, string) (string, error) { return "space-name", nil }
+
+// NewLayout parses and checks a layout. names may be nil when the layout
+// does not use OrgName or SpaceName.
+func NewLayout(text string, names NameLookup) (*Layout, error) {
+	tmpl, err := template.New("layout").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid directory layout %q: %s", text, err)
+	}
+	layout := &Layout{text: text, template: tmpl, names: names}
+
+	sample := layoutData{
+		InstanceID: "instance-id",
+		OrgGUID:    "org-guid",
+		SpaceGUID:  "space-guid",
+		PlanName:   "plan-name",
+	}
+	if names != nil {
+		sample.names = sampleNames{}
+	}
+	dir, err := layout.execute(sample)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(path.Base(dir), sample.InstanceID) {
+		return nil, fmt.Errorf("invalid directory layout %q: the last element of the path must contain {{.InstanceID}}", text)
+	}
+	return layout, nil
+}
+
+// resolve is the directory of a new instance, relative to the volume path of
+// its zone. A nil layout is the DefaultLayout.
+func (l *Layout) resolve(ctx context.Context, instanceID, orgGUID, spaceGUID, planName string) (string, error) {
+	if l == nil {
+		return instanceID, nil
+	}
+	return l.execute(layoutData{
+		ctx:        ctx,
+		names:      l.names,
+		InstanceID: instanceID,
+		OrgGUID:    orgGUID,
+		SpaceGUID:  spaceGUID,
+		PlanName:   planName,
+	})
+}
+
+func (l *Layout) execute(data layoutData) (string, error) {
+	buffer := &bytes.Buffer{}
+	if err := l.template.Execute(buffer, data); err != nil {
+		return "", fmt.Errorf("failed to resolve directory layout %q with error %s", l.text, err)
+	}
+	dir := buffer.String()
+	for _, element := range strings.Split(dir, "/") {
+		if element == "" || element == "." || element == ".." {
+			return "", fmt.Errorf("directory layout %q resolved to %q, which is not a relative path without empty, . or .. elements", l.text, dir)
+		}
+	}
+	return dir, nil
+}
@@ -0,0 +1,117 @@
+package nfsbroker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/nfsbroker"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Layout", func() {
+	It("accepts layouts that end with the instance ID", func() {
+		for _, layout := range []string{
+			nfsbroker.DefaultLayout,
+			"{{.OrgGUID}}/{{.SpaceGUID}}/{{.InstanceID}}",
+			"{{.PlanName}}/instance-{{.InstanceID}}",
+		} {
+			_, err := nfsbroker.NewLayout(layout, nil)
+			Expect(err).NotTo(HaveOccurred(), layout)
+		}
+	})
+
+	It("rejects layouts it cannot use", func() {
+		for layout, message := range map[string]string{
+			"{{.OrgGUID}":                     "invalid directory layout",
+			"{{.Org}}/{{.InstanceID}}":        "can't evaluate field Org",
+			"{{.InstanceID}}/{{.SpaceGUID}}":  "the last element of the path must contain {{.InstanceID}}",
+			"/{{.InstanceID}}":                "which is not a relative path",
+			"{{.OrgGUID}}/../{{.InstanceID}}": "which is not a relative path",
+			"{{.OrgName}}/{{.InstanceID}}":    "no Cloud Controller is configured to look up org names",
+		} {
+			_, err := nfsbroker.NewLayout(layout, nil)
+			Expect(err).To(MatchError(ContainSubstring(message)), layout)
+		}
+	})
+
+	Context("given a Cloud Controller", func() {
+		var (
+			server    *httptest.Server
+			tokens    int
+			expired   bool
+			lookups   []string
+			names     *nfsbroker.CloudController
+			orgName   string
+			lookupErr error
+		)
+
+		BeforeEach(func() {
+			tokens, expired, lookups = 0, false, nil
+			mux := http.NewServeMux()
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]interface{}{"links": map[string]interface{}{"uaa": map[string]string{"href": server.URL + "/uaa"}}})
+			})
+			mux.HandleFunc("/uaa/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+				if id, secret, ok := r.BasicAuth(); !ok || id != "broker" || secret != "secret" || r.FormValue("grant_type") != "client_credentials" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				tokens++
+				json.NewEncoder(w).Encode(map[string]string{"access_token": "token", "token_type": "bearer"})
+			})
+			mux.HandleFunc("/v3/organizations/", func(w http.ResponseWriter, r *http.Request) {
+				lookups = append(lookups, r.URL.Path)
+				if expired || r.Header.Get("Authorization") != "bearer token" {
+					expired = false
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if r.URL.Path != "/v3/organizations/org-guid" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(map[string]string{"guid": "org-guid", "name": "my/org"})
+			})
+			server = httptest.NewServer(mux)
+			names = nfsbroker.NewCloudController(server.URL, "broker", "secret")
+		})
+
+		AfterEach(func() {
+			server.Close()
+		})
+
+		JustBeforeEach(func() {
+			orgName, lookupErr = names.OrgName(context.TODO(), "org-guid")
+		})
+
+		It("looks up names with a UAA token, which it keeps", func() {
+			Expect(lookupErr).NotTo(HaveOccurred())
+			Expect(orgName).To(Equal("my/org"))
+
+			_, err := names.OrgName(context.TODO(), "org-guid")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tokens).To(Equal(1))
+		})
+
+		It("gets a new token when the one it has expires", func() {
+			expired = true
+			_, err := names.OrgName(context.TODO(), "org-guid")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(tokens).To(Equal(2))
+		})
+
+		It("reports orgs it cannot find", func() {
+			_, err := names.OrgName(context.TODO(), "other-guid")
+			Expect(err).To(MatchError(ContainSubstring("404")))
+		})
+
+		It("checks layouts that use names without looking any up", func() {
+			_, err := nfsbroker.NewLayout("{{.OrgName}}/{{.InstanceID}}", names)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(lookups).To(HaveLen(1))
+		})
+	})
+})
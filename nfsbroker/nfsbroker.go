@@ -5,9 +5,8 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
+	"net/http"
 	"path"
-	"strconv"
 	"sync"
 
 	"crypto/md5"
@@ -16,8 +15,8 @@ import (
 	"code.cloudfoundry.org/goshims/osshim"
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
 	"github.com/pivotal-cf/brokerapi"
-	"github.com/thecodeteam/goisilon"
 )
 
 const (
@@ -35,75 +34,99 @@ const (
 	KB int64 = 1 << (10 * iota)
 	MB
 	GB
+	TB
+	PB
 )
 
-type staticState struct {
-	ServiceName string `json:"ServiceName"`
-	ServiceId   string `json:"ServiceId"`
-}
+// ErrConcurrentInstanceAccess is returned for a request against an instance
+// while another request or an asynchronous operation on it is in progress.
+// The platform reports it to the user as a 422, and the request can be made
+// again once the other has finished.
+var ErrConcurrentInstanceAccess = brokerapi.NewFailureResponse(
+	errors.New("another operation for this service instance is in progress"),
+	http.StatusUnprocessableEntity,
+	"concurrent-instance-access",
+)
 
 type lock interface {
 	Lock()
 	Unlock()
 }
 
-type clientConfig struct {
-}
-
 type Broker struct {
-	logger  lager.Logger
-	dataDir string
-	os      osshim.Os
-	mutex   lock
-	clock   clock.Clock
-	static  staticState
-	store   brokerstore.Store
-	config  Config
-	isilonClientConfig
-}
-
-type isilonClientConfig struct {
-	insecure string
-	endpoint string
-	username string
-	password string
-	group    string
-	volPath  string
+	logger   lager.Logger
+	dataDir  string
+	os       osshim.Os
+	mutex    lock
+	clock    clock.Clock
+	catalog  *Catalog
+	store    brokerstore.Store
+	config   Config
+	clusters *Clusters
+	layout   *Layout
+	// busy holds the instances a request is working on, guarded by mutex.
+	busy map[string]bool
+	// indexes holds the index records that have been read from the store,
+	// guarded by mutex.
+	indexes map[string]bool
+	// reserved holds what the instances being provisioned were placed with,
+	// guarded by mutex.
+	reserved map[string]reservation
+	// metrics holds the counters and gauges of Reconcile.
+	metrics *reconcileMetrics
 }
 
 func New(
 	logger lager.Logger,
-	serviceName, serviceId, dataDir string,
+	catalog *Catalog,
+	dataDir string,
 	os osshim.Os,
 	clock clock.Clock,
 	store brokerstore.Store,
 	config *Config,
-	isilConf map[string]string,
+	clusters *Clusters,
+	layout *Layout,
 ) *Broker {
+	theBroker := NewOffline(logger, catalog, dataDir, os, clock, store, config, clusters, layout)
+	theBroker.resumeOperations(logger)
+
+	return theBroker
+}
 
+// NewOffline returns a broker for one-off work, such as a single reconcile,
+// while the broker itself is not running. It restores and migrates the store
+// as New does, but leaves operations that were in progress to be resumed by
+// the running broker.
+func NewOffline(
+	logger lager.Logger,
+	catalog *Catalog,
+	dataDir string,
+	os osshim.Os,
+	clock clock.Clock,
+	store brokerstore.Store,
+	config *Config,
+	clusters *Clusters,
+	layout *Layout,
+) *Broker {
 	theBroker := Broker{
-		logger:  logger,
-		dataDir: dataDir,
-		os:      os,
-		mutex:   &sync.Mutex{},
-		clock:   clock,
-		store:   store,
-		static: staticState{
-			ServiceName: serviceName,
-			ServiceId:   serviceId,
-		},
-		config: *config,
-		isilonClientConfig: isilonClientConfig{
-			isilConf["insecure"],
-			isilConf["endpoint"],
-			isilConf["username"],
-			isilConf["password"],
-			isilConf["group"],
-			isilConf["volpath"],
-		},
+		logger:   logger,
+		dataDir:  dataDir,
+		os:       os,
+		mutex:    &sync.Mutex{},
+		clock:    clock,
+		store:    store,
+		catalog:  catalog,
+		config:   *config,
+		clusters: clusters,
+		layout:   layout,
+		busy:     map[string]bool{},
+		indexes:  map[string]bool{},
+		reserved: map[string]reservation{},
+		metrics:  newReconcileMetrics(),
 	}
 
 	theBroker.store.Restore(logger)
+	theBroker.migrateInstances(logger)
 
 	return &theBroker
 }
@@ -113,174 +136,274 @@ func (b *Broker) Services(_ context.Context) []brokerapi.Service {
 	logger.Info("start")
 	defer logger.Info("end")
 
-	return []brokerapi.Service{{
-		ID:            b.static.ServiceId,
-		Name:          b.static.ServiceName,
-		Description:   "DELL EMC Isilon",
-		Bindable:      true,
-		PlanUpdatable: false,
-		Tags:          []string{"nfs", "isilon"},
-		Requires:      []brokerapi.RequiredPermission{PermissionVolumeMount},
-
-		Plans: []brokerapi.ServicePlan{
-			{
-				ID:          "5",
-				Name:        "5GB",
-				Description: "5GB Dell EMC Isilon NFS Share.",
-			},
-			{
-				ID:          "10",
-				Name:        "10GB",
-				Description: "10GB Dell EMC Isilon NFS Share.",
-			},
-		},
-	}}
+	services := []brokerapi.Service{}
+	for _, service := range b.catalog.Services {
+		plans := []brokerapi.ServicePlan{}
+		for _, plan := range service.Plans {
+			plans = append(plans, brokerapi.ServicePlan{
+				ID:          plan.ID,
+				Name:        plan.Name,
+				Description: plan.Description,
+				Free:        plan.Free,
+				Metadata:    plan.Metadata,
+			})
+		}
+
+		services = append(services, brokerapi.Service{
+			ID:            service.ID,
+			Name:          service.Name,
+			Description:   service.Description,
+			Bindable:      true,
+			PlanUpdatable: true,
+			Tags:          service.Tags,
+			Requires:      []brokerapi.RequiredPermission{PermissionVolumeMount},
+			Metadata:      service.Metadata,
+			Plans:         plans,
+		})
+	}
+	return services
 }
 
-func (b *Broker) Provision(context context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (_ brokerapi.ProvisionedServiceSpec, e error) {
+func (b *Broker) Provision(ctx context.Context, instanceID string, details brokerapi.ProvisionDetails, asyncAllowed bool) (_ brokerapi.ProvisionedServiceSpec, e error) {
 	logger := b.logger.Session("provision").WithData(lager.Data{"instanceID": instanceID, "details": details})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	if b.isilonClientConfig.insecure == "" {
-		b.isilonClientConfig.insecure = "false"
-	} // set default to false
-
-	cliIsInsecure, _ := strconv.ParseBool(b.isilonClientConfig.insecure)
-	client, e := goisilon.NewClientWithArgs(
-		context,
-		b.endpoint,
-		cliIsInsecure,
-		b.username,
-		b.group,
-		b.password,
-		b.volPath)
+	params, e := parseProvisionParameters(details.RawParameters)
 	if e != nil {
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to create isilon client %s with error %s", instanceID, e)
+		return brokerapi.ProvisionedServiceSpec{}, e
 	}
 
-	// Create Volume
-	_, e = client.CreateVolume(context, instanceID)
+	unlock, e := b.lockInstance(instanceID)
 	if e != nil {
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to create isilon volume %s with error %s", instanceID, e)
+		return brokerapi.ProvisionedServiceSpec{}, e
 	}
+	defer unlock()
 
-	// Create Export
-	_, e = client.ExportVolume(context, instanceID)
+	size, e := b.planSize(details.PlanID, params.Size)
 	if e != nil {
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to create isilon export %s with error %s", instanceID, e)
+		return brokerapi.ProvisionedServiceSpec{}, e
 	}
-
-	// Create Quota
-	n, e := strconv.ParseInt(details.PlanID, 10, 64)
+	if !b.catalog.offers(details.ServiceID, details.PlanID) {
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("plan %s does not belong to service %s", details.PlanID, details.ServiceID)
+	}
+	plan, _ := b.catalog.plan(details.PlanID)
+	snapshots, e := plan.snapshotPolicyFor(params.Snapshots)
 	if e != nil {
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to convert plan size to bytes for plan - %s", details.PlanID)
+		return brokerapi.ProvisionedServiceSpec{}, e
+	}
+	if params.Snapshot != "" && params.SourceInstance == "" {
+		return brokerapi.ProvisionedServiceSpec{}, errors.New("the snapshot parameter needs a source_instance to take the snapshot from")
 	}
-	size := n * GB
-	if size == 0 {
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("plan size must be greater than 0 bytes")
+	if plan.Import != nil && params.Path == "" {
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("plan %s adopts an existing directory, which the path parameter has to name", plan.Name)
 	}
-	e = client.SetQuotaSize(context, instanceID, size)
+	if plan.Import == nil && params.Path != "" {
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("plan %s does not adopt existing directories", plan.Name)
+	}
+	if params.Path != "" && (params.SourceInstance != "" || params.Snapshots != nil) {
+		return brokerapi.ProvisionedServiceSpec{}, errors.New("an adopted directory cannot be a clone or have a snapshot schedule")
+	}
+	if params.Path != "" && (params.UID != nil || params.GID != nil || params.Mode != "") {
+		return brokerapi.ProvisionedServiceSpec{}, errors.New("an adopted directory keeps its owner and mode")
+	}
+	ownership, e := plan.ownershipFor(params.UID, params.GID, params.Mode)
 	if e != nil {
-		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to set isilon quota for %s with error %s", instanceID, e)
+		return brokerapi.ProvisionedServiceSpec{}, e
+	}
+	// copying the data can take far longer than the cloud controller waits
+	// for a synchronous provision
+	if params.SourceInstance != "" && !asyncAllowed {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrAsyncRequired
+	}
+
+	fingerprint := InstanceFingerprint{
+		Version:   fingerprintVersion,
+		Size:      size,
+		Snapshots: snapshots,
+		Ownership: ownership,
+	}
+	instanceDetails := brokerstore.ServiceInstance{
+		ServiceID:          details.ServiceID,
+		PlanID:             details.PlanID,
+		OrganizationGUID:   details.OrganizationGUID,
+		SpaceGUID:          details.SpaceGUID,
+		ServiceFingerPrint: fingerprint,
 	}
 
 	b.mutex.Lock()
-	defer b.mutex.Unlock()
+	conflicts := b.instanceConflicts(instanceDetails, instanceID)
+	b.mutex.Unlock()
+	if conflicts {
+		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	}
+
+	var cluster *Cluster
+	var zone *Zone
+	name := instanceID
+	switch {
+	case params.Path != "":
+		cluster, zone, e = b.placeImport(ctx, instanceID, plan, details.OrganizationGUID, params.Path, size)
+		fingerprint.ImportPath = params.Path
+		name = path.Base(params.Path)
+	case params.SourceInstance != "":
+		cluster, fingerprint.CloneSource, e = b.placeClone(ctx, instanceID, params.SourceInstance, params.Snapshot, details.OrganizationGUID, size)
+	default:
+		cluster, e = b.placeInstance(instanceID, plan, details.OrganizationGUID, size)
+	}
+	if e != nil {
+		return brokerapi.ProvisionedServiceSpec{}, e
+	}
+	defer b.unreserve(instanceID)
+	if zone == nil {
+		zone, e = cluster.zoneFor(plan, details.OrganizationGUID)
+		if e != nil {
+			return brokerapi.ProvisionedServiceSpec{}, e
+		}
+	}
+	if fingerprint.ImportPath == "" {
+		fingerprint.Directory, e = b.layout.resolve(ctx, instanceID, details.OrganizationGUID, details.SpaceGUID, plan.Name)
+		if e != nil {
+			return brokerapi.ProvisionedServiceSpec{}, e
+		}
+		zone = cluster.zoneAt(zone, path.Dir(zone.instancePath(fingerprint.Directory)))
+		name = path.Base(fingerprint.Directory)
+	}
+	logger.Info("placed-instance", lager.Data{"cluster": cluster.Name, "zone": zone.Name, "cloneSource": fingerprint.CloneSource, "importPath": fingerprint.ImportPath, "directory": fingerprint.Directory})
+	fingerprint.Cluster = cluster.Name
+	fingerprint.Zone = zone.Name
+	fingerprint.VolumePath = zone.instancePath(name)
+
+	spec, e := b.instanceSpec(instanceDetails, fingerprint)
+	if e != nil {
+		return brokerapi.ProvisionedServiceSpec{}, e
+	}
+	fingerprint.AdvisoryLimit = spec.limits.Advisory
+	fingerprint.SoftLimit = spec.limits.Soft
+	fingerprint.Created = createdResources(name, spec)
+	instanceDetails.ServiceFingerPrint = fingerprint
+
+	steps := &rollback{}
 	defer func() {
-		out := b.store.Save(logger)
-		if e == nil {
-			e = out
+		if e != nil {
+			e = steps.run(logger, e)
 		}
 	}()
 
-	volumePath := os.Getenv("GOISILON_VOLUMEPATH") + "/" + instanceID
-	instanceDetails := brokerstore.ServiceInstance{
-		details.ServiceID,
-		details.PlanID,
-		details.OrganizationGUID,
-		details.SpaceGUID,
-		volumePath}
-
-	if b.instanceConflicts(instanceDetails, instanceID) {
-		return brokerapi.ProvisionedServiceSpec{}, brokerapi.ErrInstanceAlreadyExists
+	if asyncAllowed {
+		description := "creating isilon volume"
+		if spec.cloneSource != "" {
+			description = "copying " + spec.cloneSource + " to a new isilon volume"
+		}
+		if spec.importPath != "" {
+			description = "adopting " + spec.importPath
+		}
+		fingerprint.Operation = &Operation{Type: operationProvision, State: brokerapi.InProgress, Description: description}
+		instanceDetails.ServiceFingerPrint = fingerprint
+	} else {
+		e = b.createInstanceResources(ctx, zone, name, spec, steps)
+		if e != nil {
+			return brokerapi.ProvisionedServiceSpec{}, e
+		}
 	}
 
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
 	e = b.store.CreateInstanceDetails(instanceID, instanceDetails)
 	if e != nil {
 		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to store instance details %s", instanceID)
 	}
+	steps.add("delete-instance-details", func() error {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.store.DeleteInstanceDetails(instanceID)
+	})
+
+	e = b.indexInstanceLocked(instanceID)
+	if e != nil {
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to add instance %s to the instance index with error %s", instanceID, e)
+	}
+	// the instance's own record counts its capacity from now on
+	delete(b.reserved, instanceID)
+	steps.add("unindex-instance", func() error {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.unindexInstanceLocked(instanceID)
+	})
+
+	e = b.store.Save(logger)
+	if e != nil {
+		return brokerapi.ProvisionedServiceSpec{}, fmt.Errorf("failed to save state for instance %s with error %s", instanceID, e)
+	}
 
 	logger.Info("service-instance-created", lager.Data{"instanceDetails": instanceDetails})
 
+	if asyncAllowed {
+		b.runOperation(logger, instanceID, operationProvision, b.provisionWork(logger, zone, name, spec))
+		return brokerapi.ProvisionedServiceSpec{IsAsync: true, OperationData: operationProvision}, nil
+	}
 	return brokerapi.ProvisionedServiceSpec{IsAsync: false}, nil
 }
 
-func (b *Broker) Deprovision(context context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (_ brokerapi.DeprovisionServiceSpec, e error) {
-	logger := b.logger.Session("deprovision")
+func (b *Broker) Deprovision(ctx context.Context, instanceID string, details brokerapi.DeprovisionDetails, asyncAllowed bool) (_ brokerapi.DeprovisionServiceSpec, e error) {
+	logger := b.logger.Session("deprovision").WithData(lager.Data{"instanceID": instanceID})
 	logger.Info("start")
 	defer logger.Info("end")
 
-	if b.insecure == "" {
-		b.insecure = "false"
-	} // set default to false
-
-	cliIsInsecure, _ := strconv.ParseBool(b.insecure)
-	client, e := goisilon.NewClientWithArgs(
-		context,
-		b.endpoint,
-		cliIsInsecure,
-		b.username,
-		b.group,
-		b.password,
-		b.volPath)
+	unlock, e := b.lockInstance(instanceID)
 	if e != nil {
-		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("failed to delete isilon client %s with error %s", instanceID, e)
+		return brokerapi.DeprovisionServiceSpec{}, e
 	}
+	defer unlock()
 
-	// Delete Export
-	e = client.UnexportVolume(context, instanceID)
-	if e != nil {
-		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("failed to delete isilon export %s with error %s", instanceID, e)
+	instanceDetails, fingerprint, err := b.retrieveInstance(instanceID)
+	if err != nil {
+		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if op := fingerprint.Operation; op != nil && op.State == brokerapi.InProgress {
+		return brokerapi.DeprovisionServiceSpec{}, ErrConcurrentInstanceAccess
 	}
 
-	// Delete Quota
-	e = client.ClearQuota(context, instanceID)
+	cluster, zone, _, e := b.instanceVolume(instanceID, fingerprint)
 	if e != nil {
-		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("failed to unset isilon quota for %s with error %s", instanceID, e)
+		return brokerapi.DeprovisionServiceSpec{}, e
 	}
 
-	// Delete Volume
-	e = client.DeleteVolume(context, instanceID)
-	if e != nil {
-		return brokerapi.DeprovisionServiceSpec{}, fmt.Errorf("failed to delete isilon volume %s with error %s", instanceID, e)
+	// a failed asynchronous provision has already cleaned up after itself, so
+	// there is nothing left on the cluster to delete
+	work := b.deprovisionWork(logger, cluster, zone, instanceID, instanceDetails, fingerprint)
+	if op := fingerprint.Operation; op != nil && op.Type == operationProvision && op.State == brokerapi.Failed {
+		work = func(context.Context) error { return nil }
 	}
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-	defer func() {
-		out := b.store.Save(logger)
-		if e == nil {
-			e = out
+	if asyncAllowed {
+		e = b.recordOperation(logger, instanceID, Operation{Type: operationDeprovision, State: brokerapi.InProgress, Description: "deleting isilon volume"})
+		if e != nil {
+			return brokerapi.DeprovisionServiceSpec{}, e
 		}
-	}()
+		b.runOperation(logger, instanceID, operationDeprovision, work)
+		return brokerapi.DeprovisionServiceSpec{IsAsync: true, OperationData: operationDeprovision}, nil
+	}
 
-	_, err := b.store.RetrieveInstanceDetails(instanceID)
-	if err != nil {
-		return brokerapi.DeprovisionServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	e = work(ctx)
+	if e != nil {
+		return brokerapi.DeprovisionServiceSpec{}, e
 	}
 
-	err = b.store.DeleteInstanceDetails(instanceID)
-	if err != nil {
-		return brokerapi.DeprovisionServiceSpec{}, err
+	e = b.forgetInstance(logger, instanceID)
+	if e != nil {
+		return brokerapi.DeprovisionServiceSpec{}, e
 	}
 
-	return brokerapi.DeprovisionServiceSpec{IsAsync: false, OperationData: "deprovision"}, nil
+	return brokerapi.DeprovisionServiceSpec{IsAsync: false, OperationData: operationDeprovision}, nil
 }
 
 func (b *Broker) Bind(context context.Context, instanceID string, bindingID string, bindDetails brokerapi.BindDetails) (_ brokerapi.Binding, e error) {
 	logger := b.logger.Session("bind")
-	logger.Info("start", lager.Data{"bindingID": bindingID, "details": bindDetails})
+	// the parameters, which may hold a keytab or password, are left out of
+	// the log
+	logger.Info("start", lager.Data{"bindingID": bindingID, "instanceID": instanceID, "appGUID": bindDetails.AppGUID})
 	defer logger.Info("end")
 
 	b.mutex.Lock()
@@ -297,6 +420,16 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 	if err != nil {
 		return brokerapi.Binding{}, brokerapi.ErrInstanceDoesNotExist
 	}
+	if b.busy[instanceID] {
+		return brokerapi.Binding{}, ErrConcurrentInstanceAccess
+	}
+	fingerprint, err := fingerprintFrom(instanceDetails.ServiceFingerPrint)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	if err := checkProvisioned(instanceID, fingerprint, "bound"); err != nil {
+		return brokerapi.Binding{}, err
+	}
 
 	if bindDetails.AppGUID == "" {
 		return brokerapi.Binding{}, brokerapi.ErrAppGuidNotProvided
@@ -311,57 +444,102 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 		return brokerapi.Binding{}, err
 	}
 
+	// instances of plans that are no longer in the catalog keep the NFS
+	// export and AUTH_SYS flavor they were created with
+	plan, _ := b.catalog.plan(instanceDetails.PlanID)
+	protocol, err := bindProtocol(plan, opts)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+	var credentials map[string]interface{}
+	driver := DefaultDriver
+	if protocol == ProtocolSMB {
+		credentials, err = smbMountConfig(opts)
+		driver = plan.SMB.driver()
+	} else {
+		credentials, err = kerberosMountConfig(plan.Name, plan.Security, opts)
+		if plan.Security != nil {
+			driver = plan.Security.driver()
+		}
+	}
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
 	if b.bindingConflicts(bindingID, bindDetails) {
 		return brokerapi.Binding{}, brokerapi.ErrBindingAlreadyExists
 	}
 
 	logger.Info("retrieved-instance-details", lager.Data{"instanceDetails": instanceDetails})
 
-	err = b.store.CreateBindingDetails(bindingID, bindDetails)
+	fingerprint = b.migrateInstanceLocked(logger, instanceID, instanceDetails, fingerprint)
+
+	_, zone, err := b.instanceZone(instanceID, fingerprint)
 	if err != nil {
 		return brokerapi.Binding{}, err
 	}
+	source := fmt.Sprintf("nfs://%s%s", zone.Host(), fingerprint.VolumePath)
+
+	var mountConfig map[string]interface{}
+	if protocol == ProtocolSMB {
+		source = fmt.Sprintf("//%s/%s", zone.Host(), fingerprint.volumeName(instanceID))
+		mountConfig = map[string]interface{}{"source": source}
+	} else {
+		// TODO--brokerConfig is not re-entrant because it stores state in SetEntries--we should modify it to
+		// TODO--be stateless.  Until we do that, we will just make a local copy, but we should really
+		// TODO--refactor this to something more efficient.
+		tempConfig := b.config.Copy()
+		if err := tempConfig.SetEntries(logger, source, opts, []string{
+			"share", "mount", Username, Secret, secParameter, protocolParameter, "readonly",
+		}); err != nil {
+			logger.Info("parameters-error-assign-entries", lager.Data{
+				"given_source":  source,
+				"given_options": withoutSecrets(opts),
+				"mount":         tempConfig.mount,
+				"sloppy_mount":  tempConfig.sloppyMount,
+			})
+			return brokerapi.Binding{}, err
+		}
 
-	source := fmt.Sprintf("nfs://%s", instanceDetails.ServiceFingerPrint)
-
-	// TODO--brokerConfig is not re-entrant because it stores state in SetEntries--we should modify it to
-	// TODO--be stateless.  Until we do that, we will just make a local copy, but we should really
-	// TODO--refactor this to something more efficient.
-	tempConfig := b.config.Copy()
-	if err := tempConfig.SetEntries(logger, source, opts, []string{
-		"share", "mount", "kerberosPrincipal", "kerberosKeytab", "readonly",
-	}); err != nil {
-		logger.Info("parameters-error-assign-entries", lager.Data{
-			"given_source":  source,
-			"given_options": opts,
-			"mount":         tempConfig.mount,
-			"sloppy_mount":  tempConfig.sloppyMount,
-		})
-		return brokerapi.Binding{}, err
+		mountConfig = tempConfig.MountConfig()
+		mountConfig["source"] = tempConfig.Share(source)
+		if plan.Security == nil {
+			defaultOwnership(mountConfig, tempConfig.mount.Allowed, fingerprint.Ownership)
+		}
 	}
 
-	mountConfig := tempConfig.MountConfig()
-	mountConfig["source"] = tempConfig.Share(source)
 	if mode == "r" {
 		mountConfig["readonly"] = true
 		mode = "rw"
 	}
 
-	logger.Info("volume-service-binding", lager.Data{"Driver": "nfsv3driver", "mountConfig": mountConfig, "source": source})
+	logger.Info("volume-service-binding", lager.Data{"Driver": driver, "mountConfig": mountConfig, "source": source})
+
+	// the keytab or password is left out of the log
+	for k, v := range credentials {
+		mountConfig[k] = v
+	}
 
 	s, err := b.hash(mountConfig)
 	if err != nil {
-		logger.Error("error-calculating-volume-id", err, lager.Data{"config": mountConfig, "bindingID": bindingID, "instanceID": instanceID})
+		logger.Error("error-calculating-volume-id", err, lager.Data{"bindingID": bindingID, "instanceID": instanceID})
 		return brokerapi.Binding{}, err
 	}
 	volumeId := fmt.Sprintf("%s-%s", instanceID, s)
 
+	// the binding is only stored once nothing else can fail, as a binding
+	// the platform never got back would make it retry into a conflict
+	err = b.store.CreateBindingDetails(bindingID, bindDetails)
+	if err != nil {
+		return brokerapi.Binding{}, err
+	}
+
 	ret := brokerapi.Binding{
 		Credentials: struct{}{}, // if nil, cloud controller chokes on response
 		VolumeMounts: []brokerapi.VolumeMount{{
 			ContainerDir: evaluateContainerPath(opts, instanceID),
 			Mode:         mode,
-			Driver:       "nfsv3driver",
+			Driver:       driver,
 			DeviceType:   "shared",
 			Device: brokerapi.SharedDevice{
 				VolumeId:    volumeId,
@@ -372,6 +550,19 @@ func (b *Broker) Bind(context context.Context, instanceID string, bindingID stri
 	return ret, nil
 }
 
+// withoutSecrets is opts with the Kerberos keytab and SMB password masked,
+// for the log.
+func withoutSecrets(opts map[string]interface{}) map[string]interface{} {
+	masked := map[string]interface{}{}
+	for k, v := range opts {
+		if k == Secret || k == smbPassword {
+			v = "[REDACTED]"
+		}
+		masked[k] = v
+	}
+	return masked
+}
+
 func (b *Broker) hash(mountConfig map[string]interface{}) (string, error) {
 	var (
 		bytes []byte
@@ -411,8 +602,202 @@ func (b *Broker) Unbind(context context.Context, instanceID string, bindingID st
 	return nil
 }
 
-func (b *Broker) Update(context context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (brokerapi.UpdateServiceSpec, error) {
-	panic("not implemented")
+func (b *Broker) Update(ctx context.Context, instanceID string, details brokerapi.UpdateDetails, asyncAllowed bool) (_ brokerapi.UpdateServiceSpec, e error) {
+	logger := b.logger.Session("update").WithData(lager.Data{"instanceID": instanceID, "details": details})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	unlock, e := b.lockInstance(instanceID)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, e
+	}
+	defer unlock()
+
+	instanceDetails, fingerprint, err := b.retrieveInstance(instanceID)
+	if err != nil {
+		return brokerapi.UpdateServiceSpec{}, brokerapi.ErrInstanceDoesNotExist
+	}
+	if e := checkProvisioned(instanceID, fingerprint, "updated"); e != nil {
+		return brokerapi.UpdateServiceSpec{}, e
+	}
+
+	planID := details.PlanID
+	if planID == "" {
+		planID = instanceDetails.PlanID
+	}
+	if planID != instanceDetails.PlanID && !b.catalog.offers(instanceDetails.ServiceID, planID) {
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("plan %s does not belong to service %s", planID, instanceDetails.ServiceID)
+	}
+
+	params, e := parseProvisionParameters(details.RawParameters)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, e
+	}
+	if params.Snapshots != nil {
+		return brokerapi.UpdateServiceSpec{}, errors.New("the snapshot schedule of an instance can only be chosen when it is created")
+	}
+	if params.Path != "" {
+		return brokerapi.UpdateServiceSpec{}, errors.New("the directory an instance adopts can only be chosen when it is created")
+	}
+	if plan, ok := b.catalog.plan(planID); ok && (plan.Import != nil) != (fingerprint.ImportPath != "") {
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("instance %s cannot move between plans that adopt directories and plans that do not", instanceID)
+	}
+	if plan, ok := b.catalog.plan(planID); ok && planID != instanceDetails.PlanID {
+		previous, _ := b.catalog.plan(instanceDetails.PlanID)
+		if !sameProtocols(previous.SMB, plan.SMB) {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("instance %s cannot move between plans that share instances over different protocols", instanceID)
+		}
+	}
+
+	size, e := b.planSize(planID, params.Size)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, e
+	}
+	previousSize, e := b.instanceSize(instanceDetails, fingerprint)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, e
+	}
+	limits, e := b.planLimits(planID, size)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, e
+	}
+
+	// an update that changes nothing still re-applies thresholds that have
+	// changed in the catalog since the quota was set
+	if planID == instanceDetails.PlanID && size == previousSize &&
+		limits.Advisory == fingerprint.AdvisoryLimit && limits.Soft == fingerprint.SoftLimit {
+		return brokerapi.UpdateServiceSpec{IsAsync: false}, nil
+	}
+
+	cluster, zone, name, e := b.instanceVolume(instanceID, fingerprint)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, e
+	}
+
+	if size > previousSize && cluster.Capacity > 0 {
+		b.mutex.Lock()
+		allocated, err := b.allocatedLocked()
+		b.mutex.Unlock()
+		if err != nil {
+			return brokerapi.UpdateServiceSpec{}, err
+		}
+		if allocated[cluster.Name]-previousSize+size > cluster.Capacity {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("cluster %s does not have the capacity to grow instance %s to %d bytes", cluster.Name, instanceID, size)
+		}
+	}
+
+	if size < previousSize {
+		used, err := zone.Client.QuotaUsage(ctx, name)
+		if err != nil {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("failed to read isilon quota usage for %s with error %s", instanceID, err)
+		}
+		if used > size {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("cannot shrink instance %s to %d bytes: %d bytes are in use", instanceID, size, used)
+		}
+	}
+
+	steps := &rollback{}
+	defer func() {
+		if e != nil {
+			e = steps.run(logger, e)
+		}
+	}()
+
+	// the previous grace period is not recorded, so a rollback takes it from
+	// the previous plan
+	previousLimits, err := b.planLimits(instanceDetails.PlanID, previousSize)
+	if err != nil {
+		previousLimits = isilon.QuotaLimits{Hard: previousSize}
+	}
+	previousLimits.Advisory, previousLimits.Soft = fingerprint.AdvisoryLimit, fingerprint.SoftLimit
+
+	e = zone.Client.SetQuota(ctx, name, limits)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("failed to resize isilon quota for %s with error %s", instanceID, e)
+	}
+	steps.add("restore-quota-size", func() error {
+		return zone.Client.SetQuota(ctx, name, previousLimits)
+	})
+
+	previousPlan, _ := b.catalog.plan(instanceDetails.PlanID)
+	newPlan, _ := b.catalog.plan(planID)
+	if !sameSecurity(previousPlan.Security, newPlan.Security) {
+		e = setSecurity(ctx, zone, name, newPlan.Security)
+		if e != nil {
+			return brokerapi.UpdateServiceSpec{}, e
+		}
+		steps.add("restore-export-security", func() error {
+			return setSecurity(ctx, zone, name, previousPlan.Security)
+		})
+	}
+	previousClients := b.catalog.exportClients(instanceDetails.PlanID, instanceDetails.OrganizationGUID)
+	clients := b.catalog.exportClients(planID, instanceDetails.OrganizationGUID)
+	if newPlan.SMB.exportsNFS() && !sameExportClients(previousClients, clients) {
+		e = zone.Client.SetExportClients(ctx, name, zone.exportZone(), clients)
+		if e != nil {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("failed to set isilon export clients for %s with error %s", instanceID, e)
+		}
+		steps.add("restore-export-clients", func() error {
+			return zone.Client.SetExportClients(ctx, name, zone.exportZone(), previousClients)
+		})
+	}
+	if !sameReplication(previousPlan.Replication, newPlan.Replication) {
+		e = setReplication(ctx, zone.Client, name, newPlan.Replication)
+		if e != nil {
+			return brokerapi.UpdateServiceSpec{}, e
+		}
+		steps.add("restore-replication-policy", func() error {
+			return setReplication(ctx, zone.Client, name, previousPlan.Replication)
+		})
+	}
+	if previousPlan.StoragePool != newPlan.StoragePool {
+		e = setStoragePool(ctx, zone.Client, name, newPlan.StoragePool)
+		if e != nil {
+			return brokerapi.UpdateServiceSpec{}, e
+		}
+		steps.add("restore-storage-pool", func() error {
+			return setStoragePool(ctx, zone.Client, name, previousPlan.StoragePool)
+		})
+		e = zone.Client.MoveToStoragePool(ctx, name)
+		if e != nil {
+			return brokerapi.UpdateServiceSpec{}, fmt.Errorf("failed to start isilon smartpools job for %s with error %s", instanceID, e)
+		}
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	previousDetails, previousFingerprint := instanceDetails, fingerprint
+	instanceDetails.PlanID = planID
+	fingerprint.Size = size
+	fingerprint.AdvisoryLimit = limits.Advisory
+	fingerprint.SoftLimit = limits.Soft
+	if fingerprint.Created != nil && !sameReplication(previousPlan.Replication, newPlan.Replication) {
+		created := *fingerprint.Created
+		created.ReplicationPolicy = ""
+		if newPlan.Replication != nil {
+			created.ReplicationPolicy = isilon.ReplicationPolicyName(name)
+		}
+		fingerprint.Created = &created
+	}
+	e = b.updateInstanceLocked(instanceID, instanceDetails, fingerprint)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("failed to store instance details %s", instanceID)
+	}
+	steps.add("restore-instance-details", func() error {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		return b.updateInstanceLocked(instanceID, previousDetails, previousFingerprint)
+	})
+
+	e = b.store.Save(logger)
+	if e != nil {
+		return brokerapi.UpdateServiceSpec{}, fmt.Errorf("failed to save state for instance %s with error %s", instanceID, e)
+	}
+
+	logger.Info("service-instance-updated", lager.Data{"planID": planID, "size": size})
+
+	return brokerapi.UpdateServiceSpec{IsAsync: false}, nil
 }
 
 func (b *Broker) LastOperation(_ context.Context, instanceID string, operationData string) (brokerapi.LastOperation, error) {
@@ -420,13 +805,132 @@ func (b *Broker) LastOperation(_ context.Context, instanceID string, operationDa
 	logger.Info("start")
 	defer logger.Info("end")
 
-	b.mutex.Lock()
-	defer b.mutex.Unlock()
-
 	switch operationData {
+	case operationProvision, operationDeprovision:
 	default:
 		return brokerapi.LastOperation{}, errors.New("unrecognized operationData")
 	}
+
+	_, fingerprint, err := b.retrieveInstance(instanceID)
+	if err != nil {
+		// a finished deprovision removes the instance, which the cloud
+		// controller expects to be reported as gone
+		return brokerapi.LastOperation{}, brokerapi.ErrInstanceDoesNotExist
+	}
+
+	op := fingerprint.Operation
+	if op == nil || op.Type != operationData {
+		return brokerapi.LastOperation{}, fmt.Errorf("no %s operation recorded for instance %s", operationData, instanceID)
+	}
+
+	return brokerapi.LastOperation{State: op.State, Description: op.Description}, nil
+}
+
+// planSize is the quota size of an instance of a plan in the catalog, taking
+// into account the size requested through parameters on custom plans.
+func (b *Broker) planSize(planID string, requested string) (int64, error) {
+	plan, ok := b.catalog.plan(planID)
+	if !ok {
+		return 0, fmt.Errorf("plan %s is not in the service catalog", planID)
+	}
+	return plan.sizeFor(requested)
+}
+
+// planLimits are the quota thresholds of an instance of a plan with a hard
+// limit of size bytes.
+func (b *Broker) planLimits(planID string, size int64) (isilon.QuotaLimits, error) {
+	plan, ok := b.catalog.plan(planID)
+	if !ok {
+		return isilon.QuotaLimits{}, fmt.Errorf("plan %s is not in the service catalog", planID)
+	}
+	return quotaLimits(size, plan.Thresholds)
+}
+
+// instanceSize is the quota size an instance was provisioned with. Instances
+// created before the size was recorded fall back to their plan.
+func (b *Broker) instanceSize(details brokerstore.ServiceInstance, fingerprint InstanceFingerprint) (int64, error) {
+	if fingerprint.Size > 0 {
+		return fingerprint.Size, nil
+	}
+	return b.planSize(details.PlanID, "")
+}
+
+// reservation is what an instance being provisioned was placed with: the
+// capacity it takes on its cluster and, for an adopted directory, the
+// directory. It holds them from the moment the instance is placed until the
+// instance is stored, so that requests placed meanwhile cannot be given the
+// same capacity or directory.
+type reservation struct {
+	cluster    string
+	size       int64
+	importPath string
+}
+
+// unreserve releases what an instance was placed with, once it has been
+// stored or has failed to be.
+func (b *Broker) unreserve(instanceID string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.reserved, instanceID)
+}
+
+// placeInstance picks the cluster a new instance goes on, and reserves its
+// capacity there.
+func (b *Broker) placeInstance(instanceID string, plan CatalogPlan, orgGUID string, size int64) (*Cluster, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	allocated, err := b.allocatedLocked()
+	if err != nil {
+		return nil, err
+	}
+	cluster, err := b.clusters.place(plan, orgGUID, size, allocated)
+	if err != nil {
+		return nil, err
+	}
+	b.reserved[instanceID] = reservation{cluster: cluster.Name, size: size}
+	return cluster, nil
+}
+
+// instanceCluster is the cluster an instance was created on.
+func (b *Broker) instanceCluster(instanceID string, fingerprint InstanceFingerprint) (*Cluster, error) {
+	cluster, ok := b.clusters.Get(fingerprint.Cluster)
+	if !ok {
+		return nil, fmt.Errorf("instance %s is on cluster %s, which is not configured", instanceID, fingerprint.Cluster)
+	}
+	return cluster, nil
+}
+
+// instanceZone is the cluster and access zone an instance was created in.
+func (b *Broker) instanceZone(instanceID string, fingerprint InstanceFingerprint) (*Cluster, *Zone, error) {
+	cluster, err := b.instanceCluster(instanceID, fingerprint)
+	if err != nil {
+		return nil, nil, err
+	}
+	zone, ok := cluster.Zone(fingerprint.Zone)
+	if !ok {
+		return nil, nil, fmt.Errorf("instance %s is in access zone %s, which is not configured on cluster %s", instanceID, fingerprint.Zone, cluster.Name)
+	}
+	return cluster, zone, nil
+}
+
+// instanceVolume is instanceZone along with the name of the instance's
+// directory. An adopted directory, or one the layout nests below the volume
+// path, is managed through a copy of its zone that is rooted at the
+// directory's parent.
+func (b *Broker) instanceVolume(instanceID string, fingerprint InstanceFingerprint) (*Cluster, *Zone, string, error) {
+	cluster, zone, err := b.instanceZone(instanceID, fingerprint)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	switch {
+	case fingerprint.ImportPath != "":
+		zone = cluster.zoneAt(zone, path.Dir(fingerprint.ImportPath))
+	case fingerprint.Directory != "":
+		zone = cluster.zoneAt(zone, path.Dir(zone.instancePath(fingerprint.Directory)))
+	}
+	return cluster, zone, fingerprint.volumeName(instanceID), nil
 }
 
 func (b *Broker) instanceConflicts(details brokerstore.ServiceInstance, instanceID string) bool {
@@ -1,9 +1,13 @@
 package nfsbroker_test
 
 import (
-	"bytes"
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
 
+	"code.cloudfoundry.org/clock/fakeclock"
 	"code.cloudfoundry.org/lager/lagertest"
 	"github.com/pivotal-cf/brokerapi"
 
@@ -15,6 +19,8 @@ import (
 	"code.cloudfoundry.org/lager"
 	"code.cloudfoundry.org/service-broker-store/brokerstore"
 	"code.cloudfoundry.org/service-broker-store/brokerstore/brokerstorefakes"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon/isilonfakes"
 	"github.com/nimbus-cloud/isilon-nfs-broker/nfsbroker"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -27,6 +33,8 @@ var _ = Describe("Broker", func() {
 		logger    lager.Logger
 		ctx       context.Context
 		fakeStore *brokerstorefakes.FakeStore
+		fakeOneFS *isilonfakes.FakeOneFS
+		clusters  *nfsbroker.Clusters
 	)
 
 	BeforeEach(func() {
@@ -34,6 +42,24 @@ var _ = Describe("Broker", func() {
 		ctx = context.TODO()
 		fakeOs = &os_fake.FakeOs{}
 		fakeStore = &brokerstorefakes.FakeStore{}
+
+		fakeOneFS = isilonfakes.NewFakeOneFS("admin", "password")
+		fakeOneFS.MkdirAll("/ifs/volumes")
+		var err error
+		clusters, err = nfsbroker.NewClusters(nfsbroker.PlacementRoundRobin, nfsbroker.Cluster{
+			Name: "default",
+			Config: isilon.Config{
+				Endpoint:   fakeOneFS.URL,
+				Username:   "admin",
+				Password:   "password",
+				VolumePath: "/ifs/volumes",
+			},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		fakeOneFS.Close()
 	})
 
 	Context("when creating first time", func() {
@@ -42,11 +68,13 @@ var _ = Describe("Broker", func() {
 			mounts.ReadConf("sloppy_mount,allow_other,allow_root,multithread,default_permissions,fusenfs_uid,fusenfs_gid,uid,gid", "sloppy_mount:true")
 			broker = nfsbroker.New(
 				logger,
-				"service-name", "service-id", "/fake-dir",
+				nfsbroker.DefaultCatalog("service-name", "service-id"), "/fake-dir",
 				fakeOs,
 				nil,
 				fakeStore,
 				nfsbroker.NewNfsBrokerConfig(mounts),
+				clusters,
+				nil,
 			)
 		})
 
@@ -55,15 +83,17 @@ var _ = Describe("Broker", func() {
 				result := broker.Services(ctx)[0]
 				Expect(result.ID).To(Equal("service-id"))
 				Expect(result.Name).To(Equal("service-name"))
-				Expect(result.Description).To(Equal("Existing NFSv3 volumes (see: https://code.cloudfoundry.org/nfs-volume-release/)"))
+				Expect(result.Description).To(Equal("DELL EMC Isilon"))
 				Expect(result.Bindable).To(Equal(true))
-				Expect(result.PlanUpdatable).To(Equal(false))
+				Expect(result.PlanUpdatable).To(Equal(true))
 				Expect(result.Tags).To(ContainElement("nfs"))
+				Expect(result.Tags).To(ContainElement("isilon"))
 				Expect(result.Requires).To(ContainElement(brokerapi.RequiredPermission("volume_mount")))
 
-				Expect(result.Plans[0].Name).To(Equal("Existing"))
-				Expect(result.Plans[0].ID).To(Equal("Existing"))
-				Expect(result.Plans[0].Description).To(Equal("A preexisting filesystem"))
+				Expect(result.Plans[0].Name).To(Equal("5GB"))
+				Expect(result.Plans[0].ID).To(Equal("5"))
+				Expect(result.Plans[1].Name).To(Equal("10GB"))
+				Expect(result.Plans[1].ID).To(Equal("10"))
 			})
 		})
 
@@ -79,11 +109,7 @@ var _ = Describe("Broker", func() {
 
 			BeforeEach(func() {
 				instanceID = "some-instance-id"
-
-				configuration := map[string]interface{}{"share": "server/some-share"}
-				buf := &bytes.Buffer{}
-				_ = json.NewEncoder(buf).Encode(configuration)
-				provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
+				provisionDetails = brokerapi.ProvisionDetails{PlanID: "5", ServiceID: "service-id", OrganizationGUID: "org-guid", SpaceGUID: "space-guid"}
 				asyncAllowed = false
 				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{}, errors.New("not found"))
 			})
@@ -104,53 +130,182 @@ var _ = Describe("Broker", func() {
 				Expect(fakeStore.SaveCallCount()).Should(BeNumerically(">", 0))
 			})
 
-			Context("create-service was given invalid JSON", func() {
+			It("creates a directory for the instance under the volume path", func() {
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeTrue())
+			})
+
+			It("exports the instance directory", func() {
+				_, ok := fakeOneFS.Export("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+			})
+
+			It("sets a hard quota of the plan size on the instance directory", func() {
+				quota, ok := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(quota.Enforced).To(BeTrue())
+				Expect(*quota.Thresholds.Hard).To(Equal(5 * nfsbroker.GB))
+			})
+
+			It("stores the instance details", func() {
+				Expect(fakeStore.CreateInstanceDetailsCallCount()).To(BeNumerically(">=", 1))
+				id, details := fakeStore.CreateInstanceDetailsArgsForCall(0)
+				Expect(id).To(Equal(instanceID))
+				Expect(details.PlanID).To(Equal("5"))
+				Expect(details.OrganizationGUID).To(Equal("org-guid"))
+				Expect(details.SpaceGUID).To(Equal("space-guid"))
+			})
+
+			Context("when the plan is not in the catalog", func() {
 				BeforeEach(func() {
-					badJson := []byte("{this is not json")
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(badJson)}
+					provisionDetails.PlanID = "Existing"
+				})
+
+				It("errors without touching the cluster", func() {
+					Expect(err).To(MatchError("plan Existing is not in the service catalog"))
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				})
+			})
+
+			Context("when the plan belongs to another service", func() {
+				BeforeEach(func() {
+					provisionDetails.ServiceID = "other-service-id"
+				})
+
+				It("errors without touching the cluster", func() {
+					Expect(err).To(MatchError("plan 5 does not belong to service other-service-id"))
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				})
+			})
+
+			Context("when the directory cannot be created", func() {
+				BeforeEach(func() {
+					fakeOneFS.FailRequests("PUT", "/namespace/ifs/volumes/some-instance-id")
 				})
 
 				It("errors", func() {
-					Expect(err).To(Equal(brokerapi.ErrRawParamsInvalid))
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("failed to create isilon volume some-instance-id"))
 				})
 
+				It("does not store the instance", func() {
+					Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+				})
 			})
-			Context("create-service was given valid JSON but no 'share' key", func() {
+
+			Context("when the export cannot be created", func() {
 				BeforeEach(func() {
-					configuration := map[string]interface{}{"unknown key": "server:/some-share"}
-					buf := &bytes.Buffer{}
-					_ = json.NewEncoder(buf).Encode(configuration)
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
+					fakeOneFS.FailRequests("POST", "/platform/2/protocols/nfs/exports")
 				})
 
 				It("errors", func() {
-					Expect(err).To(Equal(errors.New("config requires a \"share\" key")))
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("failed to create isilon export some-instance-id"))
+				})
+
+				It("removes the directory it created", func() {
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				})
+
+				It("reports that the cleanup succeeded", func() {
+					Expect(err.Error()).To(ContainSubstring("partially created resources were cleaned up"))
 				})
 			})
 
-			Context("create-service was given a server share with colon after server", func() {
+			Context("when the quota cannot be set", func() {
 				BeforeEach(func() {
-					configuration := map[string]interface{}{"share": "server:/some-share"}
-					buf := &bytes.Buffer{}
-					_ = json.NewEncoder(buf).Encode(configuration)
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
+					fakeOneFS.FailRequests("POST", "/platform/1/quota/quotas")
 				})
 
 				It("errors", func() {
-					Expect(err).To(Equal(errors.New("syntax error for share: no colon allowed after server")))
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("failed to set isilon quota for some-instance-id"))
+				})
+
+				It("removes the export and directory it created", func() {
+					Expect(fakeOneFS.ExportCount()).To(Equal(0))
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				})
+
+				It("does not store the instance", func() {
+					Expect(fakeStore.CreateInstanceDetailsCallCount()).To(Equal(0))
+				})
+
+				Context("when the directory cannot be removed either", func() {
+					BeforeEach(func() {
+						fakeOneFS.FailRequests("DELETE", "/namespace/ifs/volumes/some-instance-id")
+					})
+
+					It("still removes the export", func() {
+						Expect(fakeOneFS.ExportCount()).To(Equal(0))
+					})
+
+					It("reports that the cleanup failed", func() {
+						Expect(err.Error()).To(ContainSubstring("failed to set isilon quota for some-instance-id"))
+						Expect(err.Error()).To(ContainSubstring("cleanup of partially created resources failed"))
+						Expect(err.Error()).To(ContainSubstring("delete-volume"))
+					})
 				})
 			})
 
-			Context("create-service was given a server share with colon after nfs directory", func() {
+			Context("when the cluster rejects the credentials", func() {
 				BeforeEach(func() {
-					configuration := map[string]interface{}{"share": "server/some-share:dir/"}
-					buf := &bytes.Buffer{}
-					_ = json.NewEncoder(buf).Encode(configuration)
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
+					clusters, err := nfsbroker.NewClusters(nfsbroker.PlacementRoundRobin, nfsbroker.Cluster{
+						Name: "default",
+						Config: isilon.Config{
+							Endpoint:   fakeOneFS.URL,
+							Username:   "admin",
+							Password:   "wrong",
+							VolumePath: "/ifs/volumes",
+						},
+					})
+					Expect(err).NotTo(HaveOccurred())
+
+					broker = nfsbroker.New(
+						logger,
+						nfsbroker.DefaultCatalog("service-name", "service-id"), "/fake-dir",
+						fakeOs,
+						nil,
+						fakeStore,
+						nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+						clusters,
+						nil,
+					)
 				})
 
-				It("should not error", func() {
+				It("errors", func() {
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("failed to create isilon client"))
+				})
+			})
+
+			It("connects to the cluster once for all its requests", func() {
+				_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, asyncAllowed)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeOneFS.Connections()).To(Equal(1))
+			})
+
+			It("connects again once the cluster can be reached again", func() {
+				fakeOneFS.SetUnreachable(true)
+				_, err := broker.Provision(ctx, "other-instance-id", provisionDetails, asyncAllowed)
+				Expect(err).To(HaveOccurred())
+
+				fakeOneFS.SetUnreachable(false)
+				_, err = broker.Provision(ctx, "other-instance-id", provisionDetails, asyncAllowed)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/other-instance-id")).To(BeTrue())
+				Expect(fakeOneFS.Connections()).To(Equal(2))
+			})
+
+			Context("when the session has expired", func() {
+				BeforeEach(func() {
+					fakeOneFS.ExpireSession()
+				})
+
+				It("connects again and carries on", func() {
 					Expect(err).NotTo(HaveOccurred())
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeTrue())
+					Expect(fakeOneFS.Connections()).To(Equal(2))
 				})
 			})
 
@@ -172,6 +327,12 @@ var _ = Describe("Broker", func() {
 				It("should error", func() {
 					Expect(err).To(Equal(brokerapi.ErrInstanceAlreadyExists))
 				})
+
+				It("does not touch the cluster", func() {
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+					Expect(fakeOneFS.ExportCount()).To(Equal(0))
+					Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+				})
 			})
 
 			Context("when the service instance creation fails", func() {
@@ -182,6 +343,12 @@ var _ = Describe("Broker", func() {
 				It("should error", func() {
 					Expect(err).To(HaveOccurred())
 				})
+
+				It("removes the quota, export and directory it created", func() {
+					Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+					Expect(fakeOneFS.ExportCount()).To(Equal(0))
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				})
 			})
 
 			Context("when the save fails", func() {
@@ -191,6 +358,18 @@ var _ = Describe("Broker", func() {
 
 				It("should error", func() {
 					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).To(ContainSubstring("partially created resources were cleaned up"))
+				})
+
+				It("removes the stored instance details", func() {
+					Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(Equal(1))
+					Expect(fakeStore.DeleteInstanceDetailsArgsForCall(0)).To(Equal(instanceID))
+				})
+
+				It("removes the quota, export and directory it created", func() {
+					Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+					Expect(fakeOneFS.ExportCount()).To(Equal(0))
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
 				})
 			})
 
@@ -198,18 +377,15 @@ var _ = Describe("Broker", func() {
 
 		Context(".Deprovision", func() {
 			var (
-				instanceID       string
-				asyncAllowed     bool
-				provisionDetails brokerapi.ProvisionDetails
+				instanceID   string
+				asyncAllowed bool
 
 				err error
 			)
 
 			BeforeEach(func() {
 				instanceID = "some-instance-id"
-				provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing"}
 				asyncAllowed = true
-
 			})
 
 			JustBeforeEach(func() {
@@ -223,25 +399,24 @@ var _ = Describe("Broker", func() {
 				})
 
 				It("should fail", func() {
-					Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+					Expect(err).To(HaveOccurred())
 				})
 			})
 
 			Context("given an existing instance", func() {
 				var (
-					previousSaveCallCount int
+					previousSaveCallCount   int
+					previousDeleteCallCount int
 				)
 
 				BeforeEach(func() {
-					instanceID = "some-instance-id"
+					_, err := broker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+					Expect(err).NotTo(HaveOccurred())
 
-					configuration := map[string]interface{}{"share": "server:/some-share"}
-					buf := &bytes.Buffer{}
-					_ = json.NewEncoder(buf).Encode(configuration)
-					provisionDetails = brokerapi.ProvisionDetails{PlanID: "Existing", RawParameters: json.RawMessage(buf.Bytes())}
 					asyncAllowed = false
 					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{ServiceID: instanceID}, nil)
 					previousSaveCallCount = fakeStore.SaveCallCount()
+					previousDeleteCallCount = fakeStore.DeleteInstanceDetailsCallCount()
 				})
 
 				It("should succeed", func() {
@@ -252,6 +427,19 @@ var _ = Describe("Broker", func() {
 					Expect(fakeStore.SaveCallCount()).To(Equal(previousSaveCallCount + 1))
 				})
 
+				It("removes the export, quota and directory from the cluster", func() {
+					_, ok := fakeOneFS.Export("/ifs/volumes/some-instance-id")
+					Expect(ok).To(BeFalse())
+					_, ok = fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+					Expect(ok).To(BeFalse())
+					Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				})
+
+				It("deletes the instance details", func() {
+					Expect(fakeStore.DeleteInstanceDetailsCallCount()).To(BeNumerically(">", previousDeleteCallCount))
+					Expect(fakeStore.DeleteInstanceDetailsArgsForCall(previousDeleteCallCount)).To(Equal(instanceID))
+				})
+
 				Context("when deletion of the instance fails", func() {
 					BeforeEach(func() {
 						fakeStore.DeleteInstanceDetailsReturns(errors.New("badness"))
@@ -261,15 +449,26 @@ var _ = Describe("Broker", func() {
 						Expect(err).To(HaveOccurred())
 					})
 				})
-			})
 
-			Context("when the save fails", func() {
-				BeforeEach(func() {
-					fakeStore.SaveReturns(errors.New("badness"))
+				Context("when the directory cannot be deleted", func() {
+					BeforeEach(func() {
+						fakeOneFS.FailRequests("DELETE", "/namespace/ifs/volumes/some-instance-id")
+					})
+
+					It("should error", func() {
+						Expect(err).To(HaveOccurred())
+						Expect(err.Error()).To(ContainSubstring("failed to delete isilon volume some-instance-id"))
+					})
 				})
 
-				It("should error", func() {
-					Expect(err).To(HaveOccurred())
+				Context("when the save fails", func() {
+					BeforeEach(func() {
+						fakeStore.SaveReturns(errors.New("badness"))
+					})
+
+					It("should error", func() {
+						Expect(err).To(HaveOccurred())
+					})
 				})
 			})
 		})
@@ -279,6 +478,11 @@ var _ = Describe("Broker", func() {
 				_, err := broker.LastOperation(ctx, "non-existant", "provision")
 				Expect(err).To(HaveOccurred())
 			})
+
+			It("errors when the operation data is not recognized", func() {
+				_, err := broker.LastOperation(ctx, "some-instance-id", "rebuild")
+				Expect(err).To(MatchError("unrecognized operationData"))
+			})
 		})
 
 		Context(".Bind", func() {
@@ -295,7 +499,7 @@ var _ = Describe("Broker", func() {
 				uid = "1234"
 				gid = "5678"
 
-				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{ServiceID: instanceID, ServiceFingerPrint: "server:/some-share"}, nil)
+				fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{ServiceID: instanceID, ServiceFingerPrint: nfsbroker.InstanceFingerprint{Version: 1, VolumePath: "/ifs/volumes/some-share", Cluster: "default"}}, nil)
 				fakeStore.RetrieveBindingDetailsReturns(brokerapi.BindDetails{}, errors.New("yar"))
 
 				bindParameters = map[string]interface{}{
@@ -313,7 +517,7 @@ var _ = Describe("Broker", func() {
 				}
 			})
 
-			It("passes `share` from create-service into `mountConfig.ip` on the bind response", func() {
+			It("builds the mount source from the host of the instance's cluster and its volume path", func() {
 				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
 				Expect(err).NotTo(HaveOccurred())
 
@@ -321,7 +525,7 @@ var _ = Describe("Broker", func() {
 
 				v, ok := mc["source"].(string)
 				Expect(ok).To(BeTrue())
-				Expect(v).To(Equal("nfs://server:/some-share"))
+				Expect(v).To(Equal("nfs://127.0.0.1/ifs/volumes/some-share"))
 				v, ok = mc["uid"].(string)
 				Expect(ok).To(BeTrue())
 				Expect(v).To(Equal(uid))
@@ -330,6 +534,33 @@ var _ = Describe("Broker", func() {
 				Expect(v).To(Equal(gid))
 			})
 
+			Context("when the instance was created by an older broker", func() {
+				BeforeEach(func() {
+					fakeStore.RetrieveInstanceDetailsReturns(brokerstore.ServiceInstance{ServiceID: instanceID, ServiceFingerPrint: "/some-instance-id"}, nil)
+				})
+
+				It("rebuilds the volume path from the configured volume path", func() {
+					binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://127.0.0.1/ifs/volumes/some-instance-id"))
+				})
+
+				It("stores the migrated fingerprint", func() {
+					_, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
+					Expect(err).NotTo(HaveOccurred())
+
+					Expect(fakeStore.CreateInstanceDetailsCallCount()).To(BeNumerically(">=", 1))
+					id, details := fakeStore.CreateInstanceDetailsArgsForCall(0)
+					Expect(id).To(Equal(instanceID))
+					Expect(details.ServiceFingerPrint).To(Equal(nfsbroker.InstanceFingerprint{
+						Version:    1,
+						VolumePath: "/ifs/volumes/some-instance-id",
+						Cluster:    "default",
+						Zone:       "System",
+					}))
+				})
+			})
+
 			It("includes empty credentials to prevent CAPI crash", func() {
 				binding, err := broker.Bind(ctx, instanceID, "binding-id", bindDetails)
 				Expect(err).NotTo(HaveOccurred())
@@ -489,11 +720,13 @@ var _ = Describe("Broker", func() {
 					mounts.ReadConf("", "")
 					broker = nfsbroker.New(
 						logger,
-						"service-name", "service-id", "/fake-dir",
+						nfsbroker.DefaultCatalog("service-name", "service-id"), "/fake-dir",
 						fakeOs,
 						nil,
 						fakeStore,
 						nfsbroker.NewNfsBrokerConfig(mounts),
+						clusters,
+						nil,
 					)
 				})
 
@@ -522,11 +755,13 @@ var _ = Describe("Broker", func() {
 					mounts.ReadConf("", "sloppy_mount:true")
 					broker = nfsbroker.New(
 						logger,
-						"service-name", "service-id", "/fake-dir",
+						nfsbroker.DefaultCatalog("service-name", "service-id"), "/fake-dir",
 						fakeOs,
 						nil,
 						fakeStore,
 						nfsbroker.NewNfsBrokerConfig(mounts),
+						clusters,
+						nil,
 					)
 				})
 
@@ -560,11 +795,13 @@ var _ = Describe("Broker", func() {
 					mounts.ReadConf("allow_root", "")
 					broker = nfsbroker.New(
 						logger,
-						"service-name", "service-id", "/fake-dir",
+						nfsbroker.DefaultCatalog("service-name", "service-id"), "/fake-dir",
 						fakeOs,
 						nil,
 						fakeStore,
 						nfsbroker.NewNfsBrokerConfig(mounts),
+						clusters,
+						nil,
 					)
 				})
 
@@ -615,7 +852,7 @@ var _ = Describe("Broker", func() {
 				fakeStore.RetrieveBindingDetailsReturns(bindDetails, nil)
 			})
 			It("unbinds a bound service instance from an app", func() {
-				err := broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+				err := broker.Unbind(ctx, instanceID, "binding-id", brokerapi.UnbindDetails{})
 				Expect(err).NotTo(HaveOccurred())
 			})
 
@@ -660,4 +897,1279 @@ var _ = Describe("Broker", func() {
 			})
 		})
 	})
-})
+
+	Context("given a file backed store", func() {
+		var (
+			tempDir string
+			store   brokerstore.Store
+			catalog *nfsbroker.Catalog
+		)
+
+		BeforeEach(func() {
+			var err error
+			tempDir, err = ioutil.TempDir("", "nfsbroker")
+			Expect(err).NotTo(HaveOccurred())
+
+			catalog = nfsbroker.DefaultCatalog("service-name", "service-id")
+			catalog.Services[0].Plans = append(catalog.Services[0].Plans,
+				nfsbroker.CatalogPlan{ID: "20", Name: "20GB", Size: "20GB"},
+				nfsbroker.CatalogPlan{ID: "custom", Name: "custom", MinSize: "1GB", MaxSize: "100GB"},
+				nfsbroker.CatalogPlan{ID: "kerberos", Name: "kerberos", Size: "10GB", Security: &nfsbroker.SecurityPolicy{Flavors: []string{"krb5p", "krb5i"}}},
+				nfsbroker.CatalogPlan{ID: "smb", Name: "smb", Size: "10GB", SMB: &nfsbroker.SMBPolicy{}},
+				nfsbroker.CatalogPlan{ID: "smb-only", Name: "smb-only", Size: "10GB", SMB: &nfsbroker.SMBPolicy{NoNFS: true}},
+				nfsbroker.CatalogPlan{ID: "replicated", Name: "replicated", Size: "10GB", Replication: &nfsbroker.ReplicationPolicy{TargetHost: "dr.example.com", TargetPath: "/ifs/dr", Frequency: nfsbroker.SnapshotsDaily}},
+				nfsbroker.CatalogPlan{ID: "owned", Name: "owned", Size: "10GB", Ownership: &nfsbroker.OwnershipPolicy{UID: intPtr(1000), GID: intPtr(1000), Mode: "775", UIDRange: &nfsbroker.IDRange{Min: 1000, Max: 65000}, GIDRange: &nfsbroker.IDRange{Min: 1000, Max: 65000}}},
+				nfsbroker.CatalogPlan{ID: "performance", Name: "performance", Size: "10GB", StoragePool: "performance-pool"},
+				nfsbroker.CatalogPlan{ID: "archive", Name: "archive", Size: "10GB", StoragePool: "archive-pool"},
+				nfsbroker.CatalogPlan{ID: "import", Name: "import", Size: "10GB", Import: &nfsbroker.ImportPolicy{Prefixes: []string{"/ifs/legacy"}}},
+				nfsbroker.CatalogPlan{ID: "import-delete", Name: "import-delete", Size: "20GB", Import: &nfsbroker.ImportPolicy{Prefixes: []string{"/ifs/legacy"}, OnDelete: nfsbroker.ImportDelete}},
+			)
+
+			store = brokerstore.NewStore(logger, "", "", "", "", "", "", "", filepath.Join(tempDir, "service-name-services.json"))
+			broker = nfsbroker.New(
+				logger,
+				catalog, tempDir,
+				fakeOs,
+				nil,
+				store,
+				nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+				clusters,
+				nil,
+			)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(tempDir)
+		})
+
+		It("provisions, binds, unbinds and deprovisions an instance on the cluster", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "10", OrganizationGUID: "org-guid", SpaceGUID: "space-guid"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			quota, ok := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+			Expect(ok).To(BeTrue())
+			Expect(*quota.Thresholds.Hard).To(Equal(10 * nfsbroker.GB))
+
+			bindParameters, err := json.Marshal(map[string]interface{}{})
+			Expect(err).NotTo(HaveOccurred())
+			binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: bindParameters})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(ContainSubstring("some-instance-id"))
+
+			err = broker.Unbind(ctx, "some-instance-id", "binding-id", brokerapi.UnbindDetails{})
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+			Expect(fakeOneFS.ExportCount()).To(Equal(0))
+			Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+
+			_, err = store.RetrieveInstanceDetails("some-instance-id")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("deprovisions an instance whose resources were already removed by hand", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+			Expect(client.UnexportVolume(ctx, "some-instance-id", "")).To(Succeed())
+			Expect(client.ClearQuota(ctx, "some-instance-id")).To(Succeed())
+			Expect(client.DeleteVolume(ctx, "some-instance-id")).To(Succeed())
+
+			_, err = broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = store.RetrieveInstanceDetails("some-instance-id")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("treats a volume in the System zone without an export as unexported", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+			Expect(client.UnexportVolume(ctx, "some-instance-id", "")).To(Succeed())
+			Expect(client.UnexportVolume(ctx, "some-instance-id", "")).To(Succeed())
+			Expect(fakeOneFS.ExportCount()).To(Equal(0))
+		})
+
+		It("refuses to move an instance to a plan of another service", func() {
+			catalog.Services = append(catalog.Services, nfsbroker.CatalogService{ID: "other-service-id", Name: "other-service", Plans: []nfsbroker.CatalogPlan{{ID: "other", Name: "other", Size: "20GB"}}})
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "other"}, false)
+			Expect(err).To(MatchError("plan other does not belong to service service-id"))
+
+			quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+			Expect(*quota.Thresholds.Hard).To(Equal(5 * nfsbroker.GB))
+		})
+
+		It("does not keep a binding it failed to create", func() {
+			Expect(store.CreateInstanceDetails("some-instance-id", brokerstore.ServiceInstance{
+				PlanID:             "5",
+				ServiceFingerPrint: nfsbroker.InstanceFingerprint{Version: 1, Cluster: "gone", VolumePath: "/ifs/volumes/some-instance-id"},
+			})).To(Succeed())
+
+			_, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+			Expect(err).To(MatchError("instance some-instance-id is on cluster gone, which is not configured"))
+
+			_, err = store.RetrieveBindingDetails("binding-id")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("refuses to carry on without an instance index it has read before", func() {
+			for _, instanceID := range []string{"first-instance-id", "second-instance-id"} {
+				_, err := broker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(store.DeleteInstanceDetails("isilon-nfs-broker-instance-index")).To(Succeed())
+
+			_, err := broker.Provision(ctx, "third-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+			Expect(err).To(MatchError(ContainSubstring("failed to read isilon-nfs-broker-instance-index")))
+		})
+
+		It("keeps an instance record it failed to replace", func() {
+			_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+			Expect(err).NotTo(HaveOccurred())
+
+			failing := &failingStore{Store: store, failCreate: "some-instance-id"}
+			broker = nfsbroker.New(logger, catalog, tempDir, fakeOs, nil, failing, nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()), clusters, nil)
+
+			_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "10"}, false)
+			Expect(err).To(HaveOccurred())
+
+			details, err := store.RetrieveInstanceDetails("some-instance-id")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(details.PlanID).To(Equal("5"))
+		})
+
+		It("reports an unknown instance as gone without touching the cluster", func() {
+			fakeOneFS.MkdirAll("/ifs/volumes/unknown-instance-id")
+
+			_, err := broker.Deprovision(ctx, "unknown-instance-id", brokerapi.DeprovisionDetails{}, false)
+			Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+			Expect(fakeOneFS.DirectoryExists("/ifs/volumes/unknown-instance-id")).To(BeTrue())
+		})
+
+		Context("given a custom plan", func() {
+			provision := func(parameters string) error {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "custom", RawParameters: json.RawMessage(parameters)}, false)
+				return err
+			}
+
+			It("creates a quota of the requested size", func() {
+				Expect(provision(`{"size": "25GB"}`)).To(Succeed())
+
+				quota, ok := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(*quota.Thresholds.Hard).To(Equal(25 * nfsbroker.GB))
+			})
+
+			It("stores the requested size with the instance", func() {
+				Expect(provision(`{"size": "25GB"}`)).To(Succeed())
+
+				details, err := store.RetrieveInstanceDetails("some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				bytes, err := json.Marshal(details.ServiceFingerPrint)
+				Expect(err).NotTo(HaveOccurred())
+				var fingerprint nfsbroker.InstanceFingerprint
+				Expect(json.Unmarshal(bytes, &fingerprint)).To(Succeed())
+				Expect(fingerprint.Size).To(Equal(25 * nfsbroker.GB))
+			})
+
+			It("resizes the quota when a new size is requested", func() {
+				Expect(provision(`{"size": "25GB"}`)).To(Succeed())
+
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{RawParameters: json.RawMessage(`{"size": "50GB"}`)}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(*quota.Thresholds.Hard).To(Equal(50 * nfsbroker.GB))
+			})
+
+			It("rejects sizes outside the plan limits without touching the cluster", func() {
+				Expect(provision(`{"size": "2TB"}`)).To(MatchError("size 2TB is outside the limits of plan custom, which are 1GB to 100GB"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+			})
+
+			It("requires a size", func() {
+				Expect(provision(``)).To(MatchError("plan custom requires a size parameter between 1GB and 100GB"))
+			})
+
+			It("rejects sizes that cannot be parsed", func() {
+				Expect(provision(`{"size": "lots"}`)).To(MatchError(ContainSubstring(`size "lots" must be a whole number`)))
+			})
+
+			It("rejects unknown parameters", func() {
+				Expect(provision(`{"size": "25GB", "colour": "blue"}`)).To(MatchError(ContainSubstring("invalid parameters")))
+			})
+
+			It("does not accept a size on a fixed size plan", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5", RawParameters: json.RawMessage(`{"size": "25GB"}`)}, false)
+				Expect(err).To(MatchError("plan 5GB has a fixed size and does not accept a size parameter"))
+			})
+		})
+
+		Context(".Update", func() {
+			var (
+				updateDetails brokerapi.UpdateDetails
+				err           error
+			)
+
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "10"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				updateDetails = brokerapi.UpdateDetails{PlanID: "5", PreviousValues: brokerapi.PreviousValues{PlanID: "10"}}
+			})
+
+			JustBeforeEach(func() {
+				_, err = broker.Update(ctx, "some-instance-id", updateDetails, false)
+			})
+
+			It("resizes the quota to the new plan size", func() {
+				Expect(err).NotTo(HaveOccurred())
+				quota, ok := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(*quota.Thresholds.Hard).To(Equal(5 * nfsbroker.GB))
+			})
+
+			It("stores the new plan", func() {
+				Expect(err).NotTo(HaveOccurred())
+				details, err := store.RetrieveInstanceDetails("some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(details.PlanID).To(Equal("5"))
+			})
+
+			Context("when the instance uses more than the new plan allows", func() {
+				BeforeEach(func() {
+					fakeOneFS.SetQuotaUsage("/ifs/volumes/some-instance-id", isilonfakes.FakeQuotaUsage{Logical: 6 * nfsbroker.GB})
+				})
+
+				It("refuses to shrink the quota", func() {
+					Expect(err).To(MatchError("cannot shrink instance some-instance-id to 5368709120 bytes: 6442450944 bytes are in use"))
+					quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+					Expect(*quota.Thresholds.Hard).To(Equal(10 * nfsbroker.GB))
+
+					details, err := store.RetrieveInstanceDetails("some-instance-id")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(details.PlanID).To(Equal("10"))
+				})
+
+				Context("when the new plan is larger", func() {
+					BeforeEach(func() {
+						updateDetails.PlanID = "20"
+					})
+
+					It("grows the quota", func() {
+						Expect(err).NotTo(HaveOccurred())
+						quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+						Expect(*quota.Thresholds.Hard).To(Equal(20 * nfsbroker.GB))
+					})
+				})
+			})
+
+			Context("when the quota cannot be resized", func() {
+				BeforeEach(func() {
+					fakeOneFS.FailRequests("PUT", "/platform/1/quota/quotas")
+				})
+
+				It("errors and keeps the previous plan", func() {
+					Expect(err).To(MatchError(ContainSubstring("failed to resize isilon quota for some-instance-id")))
+					details, err := store.RetrieveInstanceDetails("some-instance-id")
+					Expect(err).NotTo(HaveOccurred())
+					Expect(details.PlanID).To(Equal("10"))
+				})
+			})
+
+			Context("when the instance does not exist", func() {
+				It("returns instance does not exist", func() {
+					_, err := broker.Update(ctx, "other-instance-id", updateDetails, false)
+					Expect(err).To(Equal(brokerapi.ErrInstanceDoesNotExist))
+				})
+			})
+		})
+
+		Context("when asynchronous operations are allowed", func() {
+			lastOperation := func() (brokerapi.LastOperationState, error) {
+				op, err := broker.LastOperation(ctx, "some-instance-id", "provision")
+				return op.State, err
+			}
+
+			It("provisions the instance in the background", func() {
+				spec, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(spec.IsAsync).To(BeTrue())
+				Expect(spec.OperationData).To(Equal("provision"))
+
+				Eventually(lastOperation).Should(Equal(brokerapi.Succeeded))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeTrue())
+				_, ok := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+			})
+
+			It("reports a failed provision and cleans up after it", func() {
+				fakeOneFS.FailRequests("POST", "/platform/1/quota/quotas")
+
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, true)
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(lastOperation).Should(Equal(brokerapi.Failed))
+				op, err := broker.LastOperation(ctx, "some-instance-id", "provision")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op.Description).To(ContainSubstring("failed to set isilon quota for some-instance-id"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				Expect(fakeOneFS.ExportCount()).To(Equal(0))
+
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).To(MatchError("instance some-instance-id cannot be bound while its last provision is failed"))
+
+				_, err = broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("refuses to deprovision, update or bind an instance while it is being provisioned", func() {
+				Expect(store.CreateInstanceDetails("some-instance-id", brokerstore.ServiceInstance{
+					PlanID: "5",
+					ServiceFingerPrint: nfsbroker.InstanceFingerprint{
+						Version:    1,
+						Cluster:    "default",
+						VolumePath: "/ifs/volumes/some-instance-id",
+						Operation:  &nfsbroker.Operation{Type: "provision", State: brokerapi.InProgress},
+					},
+				})).To(Succeed())
+
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, true)
+				Expect(err).To(Equal(nfsbroker.ErrConcurrentInstanceAccess))
+
+				_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "10"}, false)
+				Expect(err).To(Equal(nfsbroker.ErrConcurrentInstanceAccess))
+
+				_, err = broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).To(Equal(nfsbroker.ErrConcurrentInstanceAccess))
+				_, err = store.RetrieveBindingDetails("binding-id")
+				Expect(err).To(HaveOccurred())
+
+				_, err = store.RetrieveInstanceDetails("some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("deprovisions the instance in the background", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				spec, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, true)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(spec.IsAsync).To(BeTrue())
+				Expect(spec.OperationData).To(Equal("deprovision"))
+
+				Eventually(func() error {
+					_, err := broker.LastOperation(ctx, "some-instance-id", "deprovision")
+					return err
+				}).Should(Equal(brokerapi.ErrInstanceDoesNotExist))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+			})
+
+			It("reports a failed deprovision", func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5"}, false)
+				Expect(err).NotTo(HaveOccurred())
+				fakeOneFS.FailRequests("DELETE", "/namespace/ifs/volumes/some-instance-id")
+
+				_, err = broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, true)
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(func() brokerapi.LastOperationState {
+					op, _ := broker.LastOperation(ctx, "some-instance-id", "deprovision")
+					return op.State
+				}).Should(Equal(brokerapi.Failed))
+				_, err = store.RetrieveInstanceDetails("some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("resumes operations that were in progress when the broker restarted", func() {
+				Expect(store.CreateInstanceDetails("some-instance-id", brokerstore.ServiceInstance{
+					PlanID: "5",
+					ServiceFingerPrint: nfsbroker.InstanceFingerprint{
+						VolumePath: "/ifs/volumes/some-instance-id",
+						Operation:  &nfsbroker.Operation{Type: "provision", State: brokerapi.InProgress},
+					},
+				})).To(Succeed())
+				Expect(store.CreateInstanceDetails("isilon-nfs-broker-instance-index", brokerstore.ServiceInstance{
+					ServiceFingerPrint: []string{"some-instance-id"},
+				})).To(Succeed())
+				Expect(store.Save(logger)).To(Succeed())
+
+				store = brokerstore.NewStore(logger, "", "", "", "", "", "", "", filepath.Join(tempDir, "service-name-services.json"))
+				broker = nfsbroker.New(
+					logger,
+					catalog, tempDir,
+					fakeOs,
+					nil,
+					store,
+					nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+					clusters,
+					nil,
+				)
+
+				Eventually(lastOperation).Should(Equal(brokerapi.Succeeded))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeTrue())
+			})
+
+			It("leaves operations in progress to the running broker when offline", func() {
+				Expect(store.CreateInstanceDetails("some-instance-id", brokerstore.ServiceInstance{
+					PlanID: "5",
+					ServiceFingerPrint: nfsbroker.InstanceFingerprint{
+						VolumePath: "/ifs/volumes/some-instance-id",
+						Operation:  &nfsbroker.Operation{Type: "provision", State: brokerapi.InProgress},
+					},
+				})).To(Succeed())
+				Expect(store.CreateInstanceDetails("isilon-nfs-broker-instance-index", brokerstore.ServiceInstance{
+					ServiceFingerPrint: []string{"some-instance-id"},
+				})).To(Succeed())
+				Expect(store.Save(logger)).To(Succeed())
+
+				store = brokerstore.NewStore(logger, "", "", "", "", "", "", "", filepath.Join(tempDir, "service-name-services.json"))
+				broker = nfsbroker.NewOffline(
+					logger,
+					catalog, tempDir,
+					fakeOs,
+					nil,
+					store,
+					nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+					clusters,
+					nil,
+				)
+
+				Consistently(lastOperation).Should(Equal(brokerapi.InProgress))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+			})
+		})
+
+		Context("given plans with quota thresholds", func() {
+			fingerprint := func() nfsbroker.InstanceFingerprint {
+				details, err := store.RetrieveInstanceDetails("some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				bytes, err := json.Marshal(details.ServiceFingerPrint)
+				Expect(err).NotTo(HaveOccurred())
+				var fp nfsbroker.InstanceFingerprint
+				Expect(json.Unmarshal(bytes, &fp)).To(Succeed())
+				return fp
+			}
+
+			BeforeEach(func() {
+				thresholds := &nfsbroker.QuotaThresholds{AdvisoryPercent: 80, SoftPercent: 90, SoftGrace: "7d"}
+				catalog.Services[0].Plans[1].Thresholds = thresholds
+				catalog.Services[0].Plans[2].Thresholds = thresholds
+
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "10"}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("sets the advisory and soft thresholds with the quota", func() {
+				quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(*quota.Thresholds.Hard).To(Equal(10 * nfsbroker.GB))
+				Expect(*quota.Thresholds.Advisory).To(Equal(10 * nfsbroker.GB / 100 * 80))
+				Expect(*quota.Thresholds.Soft).To(Equal(10 * nfsbroker.GB / 100 * 90))
+				Expect(*quota.Thresholds.SoftGrace).To(Equal(int64(7 * 24 * 60 * 60)))
+			})
+
+			It("reads the thresholds back as they were set, so that they can be set again", func() {
+				client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+				quota, err := client.Quota(ctx, "some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(quota.Limits).To(Equal(isilon.QuotaLimits{
+					Hard:      10 * nfsbroker.GB,
+					Advisory:  10 * nfsbroker.GB / 100 * 80,
+					Soft:      10 * nfsbroker.GB / 100 * 90,
+					SoftGrace: 7 * 24 * time.Hour,
+				}))
+
+				Expect(client.SetQuota(ctx, "some-instance-id", quota.Limits)).To(Succeed())
+			})
+
+			It("records the thresholds on the instance", func() {
+				Expect(fingerprint().AdvisoryLimit).To(Equal(10 * nfsbroker.GB / 100 * 80))
+				Expect(fingerprint().SoftLimit).To(Equal(10 * nfsbroker.GB / 100 * 90))
+			})
+
+			It("re-applies the thresholds when the instance is resized", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "20"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(*quota.Thresholds.Advisory).To(Equal(20 * nfsbroker.GB / 100 * 80))
+				Expect(*quota.Thresholds.Soft).To(Equal(20 * nfsbroker.GB / 100 * 90))
+				Expect(fingerprint().SoftLimit).To(Equal(20 * nfsbroker.GB / 100 * 90))
+			})
+
+			It("clears the thresholds when the new plan has none", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "5"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(*quota.Thresholds.Hard).To(Equal(5 * nfsbroker.GB))
+				Expect(quota.Thresholds.Advisory).To(BeNil())
+				Expect(quota.Thresholds.Soft).To(BeNil())
+				Expect(fingerprint().AdvisoryLimit).To(BeZero())
+			})
+
+			It("re-applies thresholds changed in the catalog on an update that changes nothing else", func() {
+				catalog.Services[0].Plans[1].Thresholds = &nfsbroker.QuotaThresholds{AdvisoryPercent: 50}
+
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				quota, _ := fakeOneFS.Quota("/ifs/volumes/some-instance-id")
+				Expect(*quota.Thresholds.Advisory).To(Equal(10 * nfsbroker.GB / 100 * 50))
+				Expect(quota.Thresholds.Soft).To(BeNil())
+			})
+		})
+
+		Context("when cloning an instance", func() {
+			clone := func(parameters string, orgGUID string) error {
+				_, err := broker.Provision(ctx, "clone-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "10", OrganizationGUID: orgGUID, RawParameters: json.RawMessage(parameters)}, true)
+				return err
+			}
+
+			cloneState := func() (brokerapi.LastOperationState, error) {
+				op, err := broker.LastOperation(ctx, "clone-id", "provision")
+				return op.State, err
+			}
+
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5", OrganizationGUID: "org-guid"}, false)
+				Expect(err).NotTo(HaveOccurred())
+				fakeOneFS.MkdirAll("/ifs/volumes/some-instance-id/old-data")
+			})
+
+			It("copies the source instance's data", func() {
+				Expect(clone(`{"source_instance": "some-instance-id"}`, "org-guid")).To(Succeed())
+
+				Eventually(cloneState).Should(Equal(brokerapi.Succeeded))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id/old-data")).To(BeTrue())
+				export, ok := fakeOneFS.Export("/ifs/volumes/clone-id")
+				Expect(ok).To(BeTrue())
+				Expect(export.Paths).To(ConsistOf("/ifs/volumes/clone-id"))
+				quota, _ := fakeOneFS.Quota("/ifs/volumes/clone-id")
+				Expect(*quota.Thresholds.Hard).To(Equal(10 * nfsbroker.GB))
+			})
+
+			It("copies the data of a snapshot of the source instance", func() {
+				fakeOneFS.TakeSnapshot("/ifs/volumes/some-instance-id", "nightly")
+				fakeOneFS.MkdirAll("/ifs/volumes/some-instance-id/new-data")
+
+				Expect(clone(`{"source_instance": "some-instance-id", "snapshot": "nightly"}`, "org-guid")).To(Succeed())
+
+				Eventually(cloneState).Should(Equal(brokerapi.Succeeded))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id/old-data")).To(BeTrue())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id/new-data")).To(BeFalse())
+			})
+
+			It("rejects a source instance of another org", func() {
+				Expect(clone(`{"source_instance": "some-instance-id"}`, "other-org-guid")).To(MatchError("source instance some-instance-id belongs to another org"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id")).To(BeFalse())
+			})
+
+			It("rejects unknown source instances and snapshots", func() {
+				Expect(clone(`{"source_instance": "missing"}`, "org-guid")).To(MatchError("source instance missing does not exist"))
+				Expect(clone(`{"source_instance": "some-instance-id", "snapshot": "missing"}`, "org-guid")).To(MatchError("source instance some-instance-id has no snapshot missing"))
+				Expect(clone(`{"snapshot": "nightly"}`, "org-guid")).To(MatchError(ContainSubstring("needs a source_instance")))
+			})
+
+			It("rejects a source instance holding more data than the clone can", func() {
+				fakeOneFS.SetQuotaUsage("/ifs/volumes/some-instance-id", isilonfakes.FakeQuotaUsage{Logical: 11 * nfsbroker.GB})
+
+				Expect(clone(`{"source_instance": "some-instance-id"}`, "org-guid")).To(MatchError(ContainSubstring("do not fit")))
+			})
+
+			It("requires an asynchronous provision", func() {
+				_, err := broker.Provision(ctx, "clone-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "10", OrganizationGUID: "org-guid", RawParameters: json.RawMessage(`{"source_instance": "some-instance-id"}`)}, false)
+				Expect(err).To(Equal(brokerapi.ErrAsyncRequired))
+			})
+
+			It("fails to copy a snapshot holding more data than the clone can", func() {
+				fakeOneFS.SetQuotaUsage("/ifs/volumes/some-instance-id", isilonfakes.FakeQuotaUsage{Logical: 11 * nfsbroker.GB})
+				fakeOneFS.TakeSnapshot("/ifs/volumes/some-instance-id", "nightly")
+				fakeOneFS.SetQuotaUsage("/ifs/volumes/some-instance-id", isilonfakes.FakeQuotaUsage{Logical: nfsbroker.GB})
+
+				Expect(clone(`{"source_instance": "some-instance-id", "snapshot": "nightly"}`, "org-guid")).To(Succeed())
+
+				Eventually(cloneState).Should(Equal(brokerapi.Failed))
+				op, err := broker.LastOperation(ctx, "clone-id", "provision")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op.Description).To(ContainSubstring("disk quota exceeded"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id")).To(BeFalse())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.clone-id.copying")).To(BeFalse())
+				_, ok := fakeOneFS.Quota("/ifs/volumes/.clone-id.copying")
+				Expect(ok).To(BeFalse())
+			})
+
+			It("copies a snapshot that fits, and leaves the quota on the clone only", func() {
+				fakeOneFS.SetQuotaUsage("/ifs/volumes/some-instance-id", isilonfakes.FakeQuotaUsage{Logical: 4 * nfsbroker.GB})
+				fakeOneFS.TakeSnapshot("/ifs/volumes/some-instance-id", "nightly")
+
+				Expect(clone(`{"source_instance": "some-instance-id", "snapshot": "nightly"}`, "org-guid")).To(Succeed())
+
+				Eventually(cloneState).Should(Equal(brokerapi.Succeeded))
+				_, ok := fakeOneFS.Quota("/ifs/volumes/.clone-id.copying")
+				Expect(ok).To(BeFalse())
+				quota, ok := fakeOneFS.Quota("/ifs/volumes/clone-id")
+				Expect(ok).To(BeTrue())
+				Expect(*quota.Thresholds.Hard).To(Equal(10 * nfsbroker.GB))
+			})
+
+			It("keeps a copy already in place, as a provision resumed after a restart finds it", func() {
+				fakeOneFS.MkdirAll("/ifs/volumes/clone-id/copied-data")
+
+				Expect(clone(`{"source_instance": "some-instance-id"}`, "org-guid")).To(Succeed())
+
+				Eventually(cloneState).Should(Equal(brokerapi.Succeeded))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id/copied-data")).To(BeTrue())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id/old-data")).To(BeFalse())
+			})
+
+			It("reports a failed copy and removes the partial clone", func() {
+				fakeOneFS.FailRequests("POST", "/namespace/ifs/volumes/.clone-id.copying")
+
+				Expect(clone(`{"source_instance": "some-instance-id"}`, "org-guid")).To(Succeed())
+
+				Eventually(cloneState).Should(Equal(brokerapi.Failed))
+				op, err := broker.LastOperation(ctx, "clone-id", "provision")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(op.Description).To(ContainSubstring("failed to copy /ifs/volumes/some-instance-id to isilon volume clone-id"))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/clone-id")).To(BeFalse())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/.clone-id.copying")).To(BeFalse())
+			})
+		})
+
+		Context("given a Kerberos plan", func() {
+			bind := func(parameters map[string]interface{}) (brokerapi.Binding, error) {
+				raw, err := json.Marshal(parameters)
+				Expect(err).NotTo(HaveOccurred())
+				return broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: raw})
+			}
+
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "kerberos"}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("exports the instance with the plan's flavors only", func() {
+				export, ok := fakeOneFS.Export("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(export.SecurityFlavors).To(Equal([]string{"krb5p", "krb5i"}))
+			})
+
+			It("passes the principal and keytab to the NFSv4 driver with the plan's first flavor", func() {
+				binding, err := bind(map[string]interface{}{nfsbroker.Username: "app@EXAMPLE.COM", nfsbroker.Secret: "some keytab data"})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts[0].Driver).To(Equal("nfsv4driver"))
+				mc := binding.VolumeMounts[0].Device.MountConfig
+				Expect(mc["sec"]).To(Equal("krb5p"))
+				Expect(mc["kerberosPrincipal"]).To(Equal("app@EXAMPLE.COM"))
+				Expect(mc["kerberosKeytab"]).To(Equal("some keytab data"))
+			})
+
+			It("leaves the keytab out of the log", func() {
+				_, err := bind(map[string]interface{}{nfsbroker.Username: "app@EXAMPLE.COM", nfsbroker.Secret: "some keytab data", "frobnicate": "1"})
+				Expect(err).To(MatchError(ContainSubstring("Not allowed options: frobnicate")))
+				_, err = bind(map[string]interface{}{nfsbroker.Username: "app@EXAMPLE.COM", nfsbroker.Secret: "some keytab data"})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(logger.(*lagertest.TestLogger).Buffer().Contents())).NotTo(ContainSubstring("some keytab data"))
+			})
+
+			It("mounts with another of the plan's flavors when asked to", func() {
+				binding, err := bind(map[string]interface{}{nfsbroker.Username: "app@EXAMPLE.COM", nfsbroker.Secret: "some keytab data", "sec": "krb5i"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["sec"]).To(Equal("krb5i"))
+			})
+
+			It("rejects bindings without a principal and keytab, or with a flavor the plan does not allow", func() {
+				_, err := bind(map[string]interface{}{nfsbroker.Username: "app@EXAMPLE.COM"})
+				Expect(err).To(MatchError("plan kerberos uses Kerberos, so kerberosPrincipal and kerberosKeytab parameters are required"))
+
+				_, err = bind(map[string]interface{}{nfsbroker.Username: "app@EXAMPLE.COM", nfsbroker.Secret: "some keytab data", "sec": "krb5"})
+				Expect(err).To(MatchError(ContainSubstring("sec krb5 is not one of the flavors plan kerberos allows")))
+
+				_, err = store.RetrieveBindingDetails("binding-id")
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("rejects a flavor on a plan without Kerberos", func() {
+				_, err := broker.Provision(ctx, "other-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "10"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				raw, err := json.Marshal(map[string]interface{}{"sec": "krb5p"})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Bind(ctx, "other-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: raw})
+				Expect(err).To(MatchError("plan 10GB does not use Kerberos, so it does not accept a sec parameter"))
+			})
+
+			It("changes the export's flavors when the instance moves between plans", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "10"}, false)
+				Expect(err).NotTo(HaveOccurred())
+				export, _ := fakeOneFS.Export("/ifs/volumes/some-instance-id")
+				Expect(export.SecurityFlavors).To(Equal([]string{"unix"}))
+
+				_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "kerberos"}, false)
+				Expect(err).NotTo(HaveOccurred())
+				export, _ = fakeOneFS.Export("/ifs/volumes/some-instance-id")
+				Expect(export.SecurityFlavors).To(Equal([]string{"krb5p", "krb5i"}))
+			})
+		})
+
+		Context("given plans shared over SMB", func() {
+			bind := func(instanceID, bindingID string, parameters map[string]interface{}) (brokerapi.Binding, error) {
+				raw, err := json.Marshal(parameters)
+				Expect(err).NotTo(HaveOccurred())
+				return broker.Bind(ctx, instanceID, bindingID, brokerapi.BindDetails{AppGUID: "guid", RawParameters: raw})
+			}
+
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "both-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "smb"}, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, err = broker.Provision(ctx, "smb-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "smb-only"}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("shares the instance directory over SMB, with or without the NFS export", func() {
+				share, ok := fakeOneFS.Share("", "both-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(share.Path).To(Equal("/ifs/volumes/both-instance-id"))
+				_, ok = fakeOneFS.Export("/ifs/volumes/both-instance-id")
+				Expect(ok).To(BeTrue())
+
+				_, ok = fakeOneFS.Share("", "smb-instance-id")
+				Expect(ok).To(BeTrue())
+				_, ok = fakeOneFS.Export("/ifs/volumes/smb-instance-id")
+				Expect(ok).To(BeFalse())
+			})
+
+			It("binds over SMB with the given credentials", func() {
+				binding, err := bind("smb-instance-id", "binding-id", map[string]interface{}{"username": "svc-app", "password": "secret", "domain": "CORP"})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(binding.VolumeMounts[0].Driver).To(Equal("smbdriver"))
+				Expect(binding.VolumeMounts[0].Device.MountConfig).To(Equal(map[string]interface{}{
+					"source":   "//127.0.0.1/smb-instance-id",
+					"username": "svc-app",
+					"password": "secret",
+					"domain":   "CORP",
+				}))
+			})
+
+			It("leaves the password out of the log", func() {
+				_, err := bind("smb-instance-id", "binding-id", map[string]interface{}{"username": "svc-app", "password": "smb-password-for-the-log", "domain": "CORP"})
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(string(logger.(*lagertest.TestLogger).Buffer().Contents())).NotTo(ContainSubstring("smb-password-for-the-log"))
+			})
+
+			It("binds over NFS unless SMB is asked for on plans with both", func() {
+				binding, err := bind("both-instance-id", "binding-id", map[string]interface{}{})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Driver).To(Equal("nfsv3driver"))
+
+				binding, err = bind("both-instance-id", "other-binding-id", map[string]interface{}{"protocol": "smb", "username": "svc-app", "password": "secret"})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Driver).To(Equal("smbdriver"))
+			})
+
+			It("rejects bindings without credentials, with unknown parameters or over a protocol the plan does not have", func() {
+				_, err := bind("smb-instance-id", "binding-id", map[string]interface{}{"username": "svc-app"})
+				Expect(err).To(MatchError("bindings over SMB need username and password parameters"))
+
+				_, err = bind("smb-instance-id", "binding-id", map[string]interface{}{"username": "svc-app", "password": "secret", "uid": "1000"})
+				Expect(err).To(MatchError("Not allowed options: uid"))
+
+				_, err = bind("smb-instance-id", "binding-id", map[string]interface{}{"protocol": "nfs"})
+				Expect(err).To(MatchError("plan smb-only is not shared over protocol nfs"))
+			})
+
+			It("removes the share on deprovision", func() {
+				_, err := broker.Deprovision(ctx, "smb-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				_, ok := fakeOneFS.Share("", "smb-instance-id")
+				Expect(ok).To(BeFalse())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/smb-instance-id")).To(BeFalse())
+			})
+
+			It("leaves a share of the same name for another directory on deprovision", func() {
+				fakeOneFS.MkdirAll("/ifs/other/smb-instance-id")
+				client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+				Expect(client.DeleteShare(ctx, "smb-instance-id", "")).To(Succeed())
+				client = isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/other"})
+				Expect(client.CreateShare(ctx, "smb-instance-id", "")).To(Succeed())
+
+				_, err := broker.Deprovision(ctx, "smb-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				share, ok := fakeOneFS.Share("", "smb-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(share.Path).To(Equal("/ifs/other/smb-instance-id"))
+			})
+
+			It("refuses to share an instance under a name another directory's share has", func() {
+				fakeOneFS.MkdirAll("/ifs/other/other-instance-id")
+				client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/other"})
+				Expect(client.CreateShare(ctx, "other-instance-id", "")).To(Succeed())
+
+				_, err := broker.Provision(ctx, "other-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "smb-only"}, false)
+				Expect(err).To(MatchError(ContainSubstring("share other-instance-id already shares /ifs/other/other-instance-id")))
+			})
+
+			It("refuses to move an instance to a plan shared over other protocols", func() {
+				_, err := broker.Update(ctx, "smb-instance-id", brokerapi.UpdateDetails{PlanID: "smb"}, false)
+				Expect(err).To(MatchError("instance smb-instance-id cannot move between plans that share instances over different protocols"))
+			})
+		})
+
+		Context("given a replicated plan", func() {
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "replicated"}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("replicates the instance to its own directory on the target cluster", func() {
+				policy, ok := fakeOneFS.SyncPolicy("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(policy.Name).To(Equal("isilon-nfs-broker-some-instance-id"))
+				Expect(policy.Action).To(Equal("sync"))
+				Expect(policy.TargetHost).To(Equal("dr.example.com"))
+				Expect(policy.TargetPath).To(Equal("/ifs/dr/some-instance-id"))
+				Expect(policy.Schedule).To(Equal("Every day at 12:00 AM"))
+				Expect(policy.Enabled).To(BeTrue())
+			})
+
+			It("removes the policy on deprovision", func() {
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeOneFS.SyncPolicyCount()).To(Equal(0))
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+			})
+
+			It("removes the policy when the instance moves to a plan that is not replicated, and restores it when it moves back", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "10"}, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeOneFS.SyncPolicyCount()).To(Equal(0))
+
+				_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "replicated"}, false)
+				Expect(err).NotTo(HaveOccurred())
+				_, ok := fakeOneFS.SyncPolicy("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+			})
+
+			It("removes everything it created when the policy cannot be created", func() {
+				fakeOneFS.FailRequests("POST", "/platform/1/sync/policies")
+
+				_, err := broker.Provision(ctx, "other-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "replicated"}, false)
+				Expect(err).To(MatchError(ContainSubstring("failed to create isilon replication policy for other-instance-id")))
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/other-instance-id")).To(BeFalse())
+				_, ok := fakeOneFS.Export("/ifs/volumes/other-instance-id")
+				Expect(ok).To(BeFalse())
+				Expect(fakeOneFS.SyncPolicyCount()).To(Equal(1))
+			})
+		})
+
+		Context("given plans on different storage pools", func() {
+			BeforeEach(func() {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "performance"}, false)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			It("stores the instance in the pool of its plan", func() {
+				policy, ok := fakeOneFS.FilePoolPolicy("isilon-nfs-broker-some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(policy.Path()).To(Equal("/ifs/volumes/some-instance-id/*"))
+				Expect(policy.StorageTarget()).To(Equal("performance-pool"))
+				Expect(fakeOneFS.Jobs()).To(BeEmpty())
+			})
+
+			It("moves the data to the new pool when the instance changes plans", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "archive"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				policy, _ := fakeOneFS.FilePoolPolicy("isilon-nfs-broker-some-instance-id")
+				Expect(policy.StorageTarget()).To(Equal("archive-pool"))
+				Expect(fakeOneFS.Jobs()).To(ConsistOf(isilonfakes.FakeJob{Type: "SmartPoolsTree", Paths: []string{"/ifs/volumes/some-instance-id"}}))
+			})
+
+			It("returns the instance to the default pool when it moves to a plan without one", func() {
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "10"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeOneFS.FilePoolPolicyCount()).To(Equal(0))
+				Expect(fakeOneFS.Jobs()).To(HaveLen(1))
+			})
+
+			It("restores the previous pool when the data cannot be moved", func() {
+				fakeOneFS.FailRequests("POST", "/platform/1/job/jobs")
+
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "archive"}, false)
+				Expect(err).To(MatchError(ContainSubstring("failed to start isilon smartpools job for some-instance-id")))
+
+				policy, _ := fakeOneFS.FilePoolPolicy("isilon-nfs-broker-some-instance-id")
+				Expect(policy.StorageTarget()).To(Equal("performance-pool"))
+			})
+
+			It("removes the policy on deprovision", func() {
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeOneFS.FilePoolPolicyCount()).To(Equal(0))
+			})
+
+			It("leaves a policy of the same name for another directory on deprovision", func() {
+				client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/volumes"})
+				Expect(client.ClearStoragePool(ctx, "some-instance-id")).To(Succeed())
+				client = isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/other"})
+				Expect(client.SetStoragePool(ctx, "some-instance-id", "other-pool")).To(Succeed())
+
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				policy, ok := fakeOneFS.FilePoolPolicy("isilon-nfs-broker-some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(policy.Path()).To(Equal("/ifs/other/some-instance-id/*"))
+			})
+
+			It("refuses to take over a policy of the same name for another directory", func() {
+				client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/other"})
+				Expect(client.SetStoragePool(ctx, "other-instance-id", "other-pool")).To(Succeed())
+
+				_, err := broker.Provision(ctx, "other-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "performance"}, false)
+				Expect(err).To(MatchError(ContainSubstring("file pool policy isilon-nfs-broker-other-instance-id already matches /ifs/other/other-instance-id/*")))
+
+				policy, _ := fakeOneFS.FilePoolPolicy("isilon-nfs-broker-other-instance-id")
+				Expect(policy.StorageTarget()).To(Equal("other-pool"))
+			})
+		})
+
+		Context("given a plan that sets the owner of its instances", func() {
+			BeforeEach(func() {
+				mounts := nfsbroker.NewNfsBrokerConfigDetails()
+				Expect(mounts.ReadConf("uid,gid", "")).To(Succeed())
+				broker = nfsbroker.New(
+					logger,
+					catalog, tempDir,
+					fakeOs,
+					nil,
+					store,
+					nfsbroker.NewNfsBrokerConfig(mounts),
+					clusters,
+					nil,
+				)
+			})
+
+			provision := func(planID, parameters string) error {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, RawParameters: json.RawMessage(parameters)}, false)
+				return err
+			}
+			bind := func(parameters string) map[string]interface{} {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(parameters)})
+				Expect(err).NotTo(HaveOccurred())
+				return binding.VolumeMounts[0].Device.MountConfig
+			}
+
+			It("gives the root directory the plan's owner, group and mode", func() {
+				Expect(provision("owned", `{}`)).To(Succeed())
+
+				dir, ok := fakeOneFS.Directory("/ifs/volumes/some-instance-id")
+				Expect(ok).To(BeTrue())
+				Expect(dir.Owner).To(Equal("UID:1000"))
+				Expect(dir.Group).To(Equal("GID:1000"))
+				Expect(dir.Mode).To(Equal("0775"))
+			})
+
+			It("lets instances choose their own within the plan's ranges, and maps bindings to them", func() {
+				Expect(provision("owned", `{"uid": 2000, "gid": 3000, "mode": "750"}`)).To(Succeed())
+
+				dir, _ := fakeOneFS.Directory("/ifs/volumes/some-instance-id")
+				Expect(dir.Owner).To(Equal("UID:2000"))
+				Expect(dir.Group).To(Equal("GID:3000"))
+				Expect(dir.Mode).To(Equal("0750"))
+
+				mountConfig := bind(`{}`)
+				Expect(mountConfig["uid"]).To(Equal("2000"))
+				Expect(mountConfig["gid"]).To(Equal("3000"))
+			})
+
+			It("leaves uid and gid options that bindings set", func() {
+				Expect(provision("owned", `{}`)).To(Succeed())
+
+				mountConfig := bind(`{"uid": "1500"}`)
+				Expect(mountConfig["uid"]).To(Equal("1500"))
+				Expect(mountConfig["gid"]).To(Equal("1000"))
+			})
+
+			It("rejects ids outside the plan's ranges, and ids on plans without ranges", func() {
+				Expect(provision("owned", `{"uid": 0}`)).To(MatchError("uid 0 is not in the range 1000-65000 allowed by plan owned"))
+				Expect(provision("10", `{"gid": 1000}`)).To(MatchError("plan 10GB does not allow choosing the gid"))
+				Expect(provision("owned", `{"mode": "rwxr-x---"}`)).To(MatchError(`mode "rwxr-x---" must be permissions in octal, from 000 to 777`))
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+			})
+
+			It("leaves the cluster's defaults on plans without ownership", func() {
+				Expect(provision("10", `{"mode": "700"}`)).To(Succeed())
+
+				dir, _ := fakeOneFS.Directory("/ifs/volumes/some-instance-id")
+				Expect(dir.Owner).NotTo(HavePrefix("UID:"))
+				Expect(dir.Mode).To(Equal("0700"))
+				Expect(bind(`{}`)).NotTo(HaveKey("uid"))
+			})
+		})
+
+		Context("given a directory layout", func() {
+			BeforeEach(func() {
+				layout, err := nfsbroker.NewLayout("{{.OrgName}}/{{.SpaceGUID}}/{{.InstanceID}}", fakeNames{"org-guid": "my/org"})
+				Expect(err).NotTo(HaveOccurred())
+				broker = nfsbroker.New(
+					logger,
+					catalog, tempDir,
+					fakeOs,
+					fakeclock.NewFakeClock(time.Now()),
+					store,
+					nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+					clusters,
+					layout,
+				)
+			})
+
+			provision := func(orgGUID string) error {
+				_, err := broker.Provision(ctx, "some-instance-id", brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: "5", OrganizationGUID: orgGUID, SpaceGUID: "space-guid"}, false)
+				return err
+			}
+
+			It("creates the instance's directory where the layout says, along with its parents", func() {
+				Expect(provision("org-guid")).To(Succeed())
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/my_org/space-guid/some-instance-id")).To(BeTrue())
+				_, ok := fakeOneFS.Export("/ifs/volumes/my_org/space-guid/some-instance-id")
+				Expect(ok).To(BeTrue())
+				_, ok = fakeOneFS.Quota("/ifs/volumes/my_org/space-guid/some-instance-id")
+				Expect(ok).To(BeTrue())
+
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://127.0.0.1/ifs/volumes/my_org/space-guid/some-instance-id"))
+			})
+
+			It("does not report the parent directories as orphaned", func() {
+				Expect(provision("org-guid")).To(Succeed())
+
+				report, err := broker.Reconcile(ctx, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(report.Drift).To(BeEmpty())
+			})
+
+			It("deletes the instance's directory and leaves its parents", func() {
+				Expect(provision("org-guid")).To(Succeed())
+
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/my_org/space-guid/some-instance-id")).To(BeFalse())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/my_org/space-guid")).To(BeTrue())
+				Expect(fakeOneFS.ExportCount()).To(Equal(0))
+				Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+			})
+
+			It("creates nothing when a name cannot be looked up", func() {
+				err := provision("other-org-guid")
+				Expect(err).To(MatchError(ContainSubstring("failed to look up the name of org other-org-guid")))
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/_")).To(BeFalse())
+				Expect(fakeOneFS.ExportCount()).To(Equal(0))
+				_, err = store.RetrieveInstanceDetails("some-instance-id")
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when adopting an existing directory", func() {
+			adopt := func(instanceID, planID, parameters string) error {
+				_, err := broker.Provision(ctx, instanceID, brokerapi.ProvisionDetails{ServiceID: "service-id", PlanID: planID, OrganizationGUID: "org-guid", RawParameters: json.RawMessage(parameters)}, false)
+				return err
+			}
+
+			BeforeEach(func() {
+				fakeOneFS.MkdirAll("/ifs/legacy/app/data")
+			})
+
+			It("exports the directory and sets its quota without touching the data", func() {
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/app"}`)).To(Succeed())
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/legacy/app/data")).To(BeTrue())
+				Expect(fakeOneFS.DirectoryExists("/ifs/volumes/some-instance-id")).To(BeFalse())
+				export, ok := fakeOneFS.Export("/ifs/legacy/app")
+				Expect(ok).To(BeTrue())
+				Expect(export.Paths).To(ConsistOf("/ifs/legacy/app"))
+				quota, ok := fakeOneFS.Quota("/ifs/legacy/app")
+				Expect(ok).To(BeTrue())
+				Expect(*quota.Thresholds.Hard).To(Equal(10 * nfsbroker.GB))
+
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://127.0.0.1/ifs/legacy/app"))
+			})
+
+			It("resizes the quota of the directory when it moves to another import plan", func() {
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/app"}`)).To(Succeed())
+
+				_, err := broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "import-delete"}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				quota, _ := fakeOneFS.Quota("/ifs/legacy/app")
+				Expect(*quota.Thresholds.Hard).To(Equal(20 * nfsbroker.GB))
+
+				_, err = broker.Update(ctx, "some-instance-id", brokerapi.UpdateDetails{PlanID: "20"}, false)
+				Expect(err).To(MatchError("instance some-instance-id cannot move between plans that adopt directories and plans that do not"))
+			})
+
+			It("keeps the directory on deprovision", func() {
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/app"}`)).To(Succeed())
+
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/legacy/app/data")).To(BeTrue())
+				Expect(fakeOneFS.ExportCount()).To(Equal(0))
+				Expect(fakeOneFS.QuotaCount()).To(Equal(0))
+			})
+
+			It("leaves the snapshots the directory already had on deprovision", func() {
+				fakeOneFS.TakeSnapshot("/ifs/legacy/app", "before-adoption")
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/app"}`)).To(Succeed())
+
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				snapshots := fakeOneFS.Snapshots("/ifs/legacy/app")
+				Expect(snapshots).To(HaveLen(1))
+				Expect(snapshots[0].Name).To(Equal("before-adoption"))
+			})
+
+			It("deletes the directory on deprovision when the plan says so", func() {
+				Expect(adopt("some-instance-id", "import-delete", `{"path": "/ifs/legacy/app"}`)).To(Succeed())
+
+				_, err := broker.Deprovision(ctx, "some-instance-id", brokerapi.DeprovisionDetails{}, false)
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(fakeOneFS.DirectoryExists("/ifs/legacy/app")).To(BeFalse())
+				Expect(fakeOneFS.DirectoryExists("/ifs/legacy")).To(BeTrue())
+			})
+
+			It("rejects directories outside the prefixes, missing directories and directories adopted already", func() {
+				fakeOneFS.MkdirAll("/ifs/other/app")
+
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/other/app"}`)).To(MatchError(ContainSubstring("path /ifs/other/app is not under any of the prefixes")))
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/../other/app"}`)).To(MatchError(ContainSubstring("is not under any of the prefixes")))
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy"}`)).To(MatchError(ContainSubstring("is not under any of the prefixes")))
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/missing"}`)).To(MatchError("directory /ifs/legacy/missing does not exist on cluster default"))
+
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/app"}`)).To(Succeed())
+				Expect(adopt("other-instance-id", "import", `{"path": "/ifs/legacy/app"}`)).To(MatchError("directory /ifs/legacy/app is already adopted by instance some-instance-id"))
+				Expect(adopt("other-instance-id", "import", `{"path": "/ifs/legacy/app/data"}`)).To(MatchError("directory /ifs/legacy/app/data overlaps /ifs/legacy/app, the directory of instance some-instance-id"))
+			})
+
+			It("requires a path on import plans only", func() {
+				Expect(adopt("some-instance-id", "import", ``)).To(MatchError(ContainSubstring("the path parameter has to name")))
+				Expect(adopt("some-instance-id", "5", `{"path": "/ifs/legacy/app"}`)).To(MatchError("plan 5GB does not adopt existing directories"))
+			})
+
+			It("leaves an existing export in place when adopting fails", func() {
+				client := isilon.NewClient(isilon.Config{Endpoint: fakeOneFS.URL, Username: "admin", Password: "password", VolumePath: "/ifs/legacy"})
+				_, err := client.ExportVolume(ctx, "app", "")
+				Expect(err).NotTo(HaveOccurred())
+				fakeOneFS.FailRequests("POST", "/platform/1/quota/quotas")
+
+				Expect(adopt("some-instance-id", "import", `{"path": "/ifs/legacy/app"}`)).NotTo(Succeed())
+
+				_, ok := fakeOneFS.Export("/ifs/legacy/app")
+				Expect(ok).To(BeTrue())
+				Expect(fakeOneFS.DirectoryExists("/ifs/legacy/app/data")).To(BeTrue())
+			})
+		})
+
+		Context("when instances were created by an older broker", func() {
+			BeforeEach(func() {
+				Expect(store.CreateInstanceDetails("some-instance-id", brokerstore.ServiceInstance{
+					PlanID:             "5",
+					ServiceFingerPrint: nfsbroker.InstanceFingerprint{VolumePath: "/some-instance-id", Size: 5 * nfsbroker.GB},
+				})).To(Succeed())
+				Expect(store.CreateInstanceDetails("isilon-nfs-broker-instance-index", brokerstore.ServiceInstance{
+					ServiceFingerPrint: []string{"some-instance-id"},
+				})).To(Succeed())
+				Expect(store.Save(logger)).To(Succeed())
+
+				store = brokerstore.NewStore(logger, "", "", "", "", "", "", "", filepath.Join(tempDir, "service-name-services.json"))
+				broker = nfsbroker.New(
+					logger,
+					catalog, tempDir,
+					fakeOs,
+					nil,
+					store,
+					nfsbroker.NewNfsBrokerConfig(nfsbroker.NewNfsBrokerConfigDetails()),
+					clusters,
+					nil,
+				)
+			})
+
+			It("migrates their fingerprints on startup", func() {
+				details, err := store.RetrieveInstanceDetails("some-instance-id")
+				Expect(err).NotTo(HaveOccurred())
+
+				bytes, err := json.Marshal(details.ServiceFingerPrint)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(bytes).To(MatchJSON(`{"version": 1, "volume_path": "/ifs/volumes/some-instance-id", "cluster": "default", "zone": "System", "size": 5368709120}`))
+			})
+
+			It("binds them to the configured volume path", func() {
+				binding, err := broker.Bind(ctx, "some-instance-id", "binding-id", brokerapi.BindDetails{AppGUID: "guid", RawParameters: json.RawMessage(`{}`)})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(binding.VolumeMounts[0].Device.MountConfig["source"]).To(Equal("nfs://127.0.0.1/ifs/volumes/some-instance-id"))
+			})
+		})
+	})
+})
+
+// fakeNames looks up org and space names from a map of GUIDs to names.
+type fakeNames map[string]string
+
+func (n fakeNames) OrgName(_ context.Context, guid string) (string, error) {
+	if name, ok := n[guid]; ok {
+		return name, nil
+	}
+	return "", errors.New("not found")
+}
+
+func (n fakeNames) SpaceName(ctx context.Context, guid string) (string, error) {
+	return n.OrgName(ctx, guid)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+// failingStore fails the first time a record with the ID failCreate is
+// created.
+type failingStore struct {
+	brokerstore.Store
+	failCreate string
+}
+
+func (s *failingStore) CreateInstanceDetails(id string, details brokerstore.ServiceInstance) error {
+	if id == s.failCreate {
+		s.failCreate = ""
+		return errors.New("badness")
+	}
+	return s.Store.CreateInstanceDetails(id, details)
+}
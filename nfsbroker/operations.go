@@ -0,0 +1,495 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	operationProvision   = "provision"
+	operationDeprovision = "deprovision"
+)
+
+// instanceSpec is everything createInstanceResources needs to know about a
+// new instance.
+type instanceSpec struct {
+	limits  isilon.QuotaLimits
+	clients isilon.ExportClients
+	// security is nil for instances exported with the AUTH_SYS flavor alone,
+	// and smb for instances that are not shared over SMB.
+	security *SecurityPolicy
+	smb      *SMBPolicy
+	// storagePool is empty for instances stored in the default pool.
+	storagePool string
+	// snapshots is nil for instances that are not snapshotted, and
+	// replication for instances that are not replicated.
+	snapshots   *SnapshotPolicy
+	replication *ReplicationPolicy
+	// cloneSource is the directory a clone is copied from, and is empty for
+	// instances that start out empty.
+	cloneSource string
+	// restoreSource is the trash directory an undeleted instance is moved
+	// back from.
+	restoreSource string
+	// importPath is the existing directory an adopted instance takes over,
+	// which is used as it is.
+	importPath string
+	// parents is the directory the layout nests a new instance's directory
+	// in, and is empty for instances straight in the volume path.
+	parents string
+	// ownership is nil for instances whose root directory keeps the
+	// cluster's default owner and mode.
+	ownership *Ownership
+}
+
+// instanceSpec rebuilds the spec of a stored instance.
+func (b *Broker) instanceSpec(details brokerstore.ServiceInstance, fp InstanceFingerprint) (instanceSpec, error) {
+	size, err := b.instanceSize(details, fp)
+	if err != nil {
+		return instanceSpec{}, err
+	}
+	limits, err := b.planLimits(details.PlanID, size)
+	if err != nil {
+		return instanceSpec{}, err
+	}
+	plan, _ := b.catalog.plan(details.PlanID)
+	parents := ""
+	if strings.Contains(fp.Directory, "/") {
+		parents = path.Dir(fp.VolumePath)
+	}
+	return instanceSpec{
+		limits:      limits,
+		clients:     b.catalog.exportClients(details.PlanID, details.OrganizationGUID),
+		security:    plan.Security,
+		smb:         plan.SMB,
+		storagePool: plan.StoragePool,
+		snapshots:   fp.Snapshots,
+		replication: plan.Replication,
+		cloneSource: fp.CloneSource,
+		importPath:  fp.ImportPath,
+		parents:     parents,
+		ownership:   fp.Ownership,
+	}, nil
+}
+
+// createInstanceResources creates the directory, with its owner and mode,
+// and the file pool policy, export, share, quota, snapshot schedule and
+// replication policy behind an instance, recording an undo step for each one
+// that succeeds. name is the instance's directory in the zone's volume path.
+// The parent directories a layout nests it in are created too, but are not
+// undone, as other instances may share them.
+//
+// An adopted directory may already have an export and a quota of its own.
+// They are taken over, and left as they were if adopting it fails.
+func (b *Broker) createInstanceResources(ctx context.Context, zone *Zone, name string, spec instanceSpec, steps *rollback) error {
+	client := zone.Client
+
+	// Create Parents
+	if spec.parents != "" {
+		if err := client.CreateDirectory(ctx, spec.parents); err != nil {
+			return fmt.Errorf("failed to create isilon directory %s with error %s", spec.parents, err)
+		}
+	}
+
+	// Create Volume
+	switch {
+	case spec.importPath != "":
+		// an adopted directory is already there
+	case spec.restoreSource != "":
+		if err := client.MoveDirectory(ctx, spec.restoreSource, zone.instancePath(name)); err != nil {
+			return fmt.Errorf("failed to move %s to isilon volume %s with error %s", spec.restoreSource, name, err)
+		}
+		steps.add("return-to-trash", func() error {
+			return client.MoveDirectory(ctx, zone.instancePath(name), spec.restoreSource)
+		})
+	case spec.cloneSource != "":
+		// a volume that is already there was copied by this provision before
+		// the broker restarted and resumed it, as instance IDs are unique
+		if err := client.CopyVolume(ctx, name, spec.cloneSource, spec.limits.Hard); err != nil && err != isilon.ErrVolumeExists {
+			return fmt.Errorf("failed to copy %s to isilon volume %s with error %s", spec.cloneSource, name, err)
+		}
+		steps.add("delete-volume", func() error {
+			return client.DeleteVolume(ctx, name)
+		})
+	default:
+		if err := client.CreateVolume(ctx, name); err != nil {
+			return fmt.Errorf("failed to create isilon volume %s with error %s", name, err)
+		}
+		steps.add("delete-volume", func() error {
+			return client.DeleteVolume(ctx, name)
+		})
+	}
+
+	// Set Storage Pool
+	if spec.storagePool != "" {
+		if err := client.SetStoragePool(ctx, name, spec.storagePool); err != nil {
+			return fmt.Errorf("failed to set isilon storage pool for %s with error %s", name, err)
+		}
+		steps.add("clear-storage-pool", func() error {
+			return client.ClearStoragePool(ctx, name)
+		})
+		// copied and restored data was written before the policy existed
+		if spec.cloneSource != "" || spec.restoreSource != "" {
+			if err := client.MoveToStoragePool(ctx, name); err != nil {
+				return fmt.Errorf("failed to start isilon smartpools job for %s with error %s", name, err)
+			}
+		}
+	}
+
+	// Set Ownership
+	if spec.ownership != nil {
+		if err := client.SetOwnership(ctx, name, spec.ownership.ownership()); err != nil {
+			return fmt.Errorf("failed to set the owner and mode of isilon volume %s with error %s", name, err)
+		}
+	}
+
+	if spec.smb.exportsNFS() {
+		// Create Export
+		exported := false
+		if spec.importPath != "" {
+			var err error
+			if exported, err = client.IsExported(ctx, name, zone.exportZone()); err != nil {
+				return fmt.Errorf("failed to read isilon export %s with error %s", name, err)
+			}
+		}
+		if _, err := client.ExportVolume(ctx, name, zone.exportZone()); err != nil {
+			return fmt.Errorf("failed to create isilon export %s with error %s", name, err)
+		}
+		if !exported {
+			steps.add("unexport-volume", func() error {
+				return client.UnexportVolume(ctx, name, zone.exportZone())
+			})
+		}
+
+		// Restrict Export
+		if err := client.SetExportClients(ctx, name, zone.exportZone(), spec.clients); err != nil {
+			return fmt.Errorf("failed to set isilon export clients for %s with error %s", name, err)
+		}
+
+		// Secure Export
+		if spec.security != nil {
+			if err := setSecurity(ctx, zone, name, spec.security); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Create Share
+	if spec.smb != nil {
+		if err := client.CreateShare(ctx, name, zone.exportZone()); err != nil {
+			return fmt.Errorf("failed to create isilon smb share %s with error %s", name, err)
+		}
+		steps.add("delete-share", func() error {
+			return client.DeleteShare(ctx, name, zone.exportZone())
+		})
+	}
+
+	// Create Quota
+	var previous *isilon.Quota
+	if spec.importPath != "" {
+		quota, err := client.Quota(ctx, name)
+		if err != nil && err != isilon.ErrQuotaNotFound {
+			return fmt.Errorf("failed to read isilon quota for %s with error %s", name, err)
+		}
+		if err == nil {
+			previous = &quota
+		}
+	}
+	if err := client.SetQuota(ctx, name, spec.limits); err != nil {
+		return fmt.Errorf("failed to set isilon quota for %s with error %s", name, err)
+	}
+	if previous != nil {
+		steps.add("restore-quota", func() error {
+			return client.SetQuota(ctx, name, previous.Limits)
+		})
+	} else {
+		steps.add("clear-quota", func() error {
+			return client.ClearQuota(ctx, name)
+		})
+	}
+
+	// Create Snapshot Schedule
+	if spec.snapshots != nil {
+		schedule, err := spec.snapshots.schedule()
+		if err != nil {
+			return err
+		}
+		if err := client.SetSnapshotSchedule(ctx, name, schedule); err != nil {
+			return fmt.Errorf("failed to create isilon snapshot schedule for %s with error %s", name, err)
+		}
+		steps.add("clear-snapshot-schedule", func() error {
+			return client.ClearSnapshotSchedule(ctx, name)
+		})
+	}
+
+	// Create Replication Policy
+	if spec.replication != nil {
+		if err := client.SetReplicationPolicy(ctx, name, spec.replication.policy(name)); err != nil {
+			return fmt.Errorf("failed to create isilon replication policy for %s with error %s", name, err)
+		}
+		steps.add("clear-replication-policy", func() error {
+			return client.ClearReplicationPolicy(ctx, name)
+		})
+	}
+
+	return nil
+}
+
+// createdResources is what createInstanceResources creates for an instance
+// besides its export, quota and file pool policy.
+func createdResources(name string, spec instanceSpec) *Created {
+	created := &Created{}
+	if spec.snapshots != nil {
+		created.SnapshotSchedule = isilon.SnapshotScheduleName(name)
+	}
+	if spec.replication != nil {
+		created.ReplicationPolicy = isilon.ReplicationPolicyName(name)
+	}
+	if spec.smb != nil {
+		created.Share = name
+	}
+	return created
+}
+
+// deleteInstanceResources removes the replication policy, snapshots, export,
+// share, quota, file pool policy and directory behind an instance.
+func (b *Broker) deleteInstanceResources(ctx context.Context, zone *Zone, name string, fp InstanceFingerprint) error {
+	if err := b.releaseInstanceResources(ctx, zone, name, fp); err != nil {
+		return err
+	}
+
+	// Delete Volume
+	if err := zone.Client.DeleteVolume(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete isilon volume %s with error %s", name, err)
+	}
+
+	return nil
+}
+
+// releaseInstanceResources removes the export, quota and file pool policy
+// behind an instance, and the replication policy, snapshot schedule,
+// snapshots and share the broker created for it, leaving only its directory
+// and whatever else is on it. Replicated data stays on the target cluster.
+//
+// Instances from before the broker recorded what it created lose every
+// snapshot of their directory, unless they adopted it, as the snapshots an
+// adopted directory already had cannot be told apart from the broker's.
+func (b *Broker) releaseInstanceResources(ctx context.Context, zone *Zone, name string, fp InstanceFingerprint) error {
+	client := zone.Client
+	created, everySnapshot := fp.Created, false
+	switch {
+	case created != nil:
+	case fp.ImportPath != "":
+		// import plans have no snapshots, replication or share
+		created = &Created{}
+	default:
+		created = &Created{
+			SnapshotSchedule:  isilon.SnapshotScheduleName(name),
+			ReplicationPolicy: isilon.ReplicationPolicyName(name),
+			Share:             name,
+		}
+		everySnapshot = true
+	}
+
+	// Delete Replication Policy
+	if created.ReplicationPolicy != "" {
+		if err := client.ClearReplicationPolicy(ctx, name); err != nil {
+			return fmt.Errorf("failed to delete isilon replication policy for %s with error %s", name, err)
+		}
+	}
+
+	// Delete Snapshots
+	if created.SnapshotSchedule != "" {
+		if err := client.ClearSnapshotSchedule(ctx, name); err != nil {
+			return fmt.Errorf("failed to delete isilon snapshot schedule for %s with error %s", name, err)
+		}
+	}
+	snapshots, err := client.ListSnapshots(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to list isilon snapshots of %s with error %s", name, err)
+	}
+	for _, snapshot := range snapshots {
+		if !everySnapshot && !created.tookSnapshot(snapshot) {
+			continue
+		}
+		if err := client.DeleteSnapshot(ctx, name, snapshot.ID); err != nil && err != isilon.ErrSnapshotNotFound {
+			return fmt.Errorf("failed to delete isilon snapshot %d of %s with error %s", snapshot.ID, name, err)
+		}
+	}
+
+	// Delete Export
+	if err := client.UnexportVolume(ctx, name, zone.exportZone()); err != nil {
+		return fmt.Errorf("failed to delete isilon export %s with error %s", name, err)
+	}
+
+	// Delete Share
+	if created.Share != "" {
+		if err := client.DeleteShare(ctx, name, zone.exportZone()); err != nil {
+			return fmt.Errorf("failed to delete isilon smb share %s with error %s", name, err)
+		}
+	}
+
+	// Delete Quota
+	if err := client.ClearQuota(ctx, name); err != nil {
+		return fmt.Errorf("failed to unset isilon quota for %s with error %s", name, err)
+	}
+
+	// Delete Storage Pool
+	if err := client.ClearStoragePool(ctx, name); err != nil {
+		return fmt.Errorf("failed to delete isilon storage pool policy for %s with error %s", name, err)
+	}
+
+	return nil
+}
+
+func (b *Broker) provisionWork(logger lager.Logger, zone *Zone, name string, spec instanceSpec) func(context.Context) error {
+	return func(ctx context.Context) error {
+		steps := &rollback{}
+		if err := b.createInstanceResources(ctx, zone, name, spec, steps); err != nil {
+			return steps.run(logger, err)
+		}
+		return nil
+	}
+}
+
+// deprovisionWork deletes an instance, or moves it to the trash when its plan
+// keeps deleted instances. An adopted directory is only released, unless its
+// plan deletes adopted directories.
+func (b *Broker) deprovisionWork(logger lager.Logger, cluster *Cluster, zone *Zone, instanceID string, details brokerstore.ServiceInstance, fp InstanceFingerprint) func(context.Context) error {
+	name := fp.volumeName(instanceID)
+	return func(ctx context.Context) error {
+		plan, ok := b.catalog.plan(details.PlanID)
+		switch {
+		case fp.ImportPath != "" && (!ok || !plan.Import.deletes()):
+			return b.releaseInstanceResources(ctx, zone, name, fp)
+		case !ok || plan.TrashRetention == "":
+			return b.deleteInstanceResources(ctx, zone, name, fp)
+		}
+		retention, err := parsePeriod("trash_retention", plan.TrashRetention)
+		if err != nil {
+			return err
+		}
+		return b.trashInstance(ctx, logger, cluster, zone, instanceID, name, details, fp, retention)
+	}
+}
+
+// runOperation performs work in the background and records its outcome
+// against the instance so that LastOperation can report it. A successful
+// deprovision removes the instance from the store altogether.
+func (b *Broker) runOperation(logger lager.Logger, instanceID, operation string, work func(context.Context) error) {
+	logger = logger.Session("operation", lager.Data{"instanceID": instanceID, "operation": operation})
+
+	go func() {
+		logger.Info("start")
+		defer logger.Info("end")
+
+		if err := work(context.Background()); err != nil {
+			logger.Error("operation-failed", err)
+			b.recordOperationOrLog(logger, instanceID, Operation{Type: operation, State: brokerapi.Failed, Description: err.Error()})
+			return
+		}
+
+		if operation == operationDeprovision {
+			if err := b.forgetInstance(logger, instanceID); err != nil {
+				logger.Error("failed-to-remove-instance-details", err)
+				b.recordOperationOrLog(logger, instanceID, Operation{Type: operation, State: brokerapi.Failed, Description: err.Error()})
+			}
+			return
+		}
+
+		b.recordOperationOrLog(logger, instanceID, Operation{Type: operation, State: brokerapi.Succeeded, Description: "isilon volume created"})
+	}()
+}
+
+func (b *Broker) recordOperationOrLog(logger lager.Logger, instanceID string, op Operation) {
+	if err := b.recordOperation(logger, instanceID, op); err != nil {
+		logger.Error("failed-to-record-operation", err, lager.Data{"state": op.State})
+	}
+}
+
+// recordOperation stores op as the last operation of an instance.
+func (b *Broker) recordOperation(logger lager.Logger, instanceID string, op Operation) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	details, fp, err := b.retrieveInstanceLocked(instanceID)
+	if err != nil {
+		return err
+	}
+	fp.Operation = &op
+	if err := b.updateInstanceLocked(instanceID, details, fp); err != nil {
+		return fmt.Errorf("failed to store instance details %s with error %s", instanceID, err)
+	}
+	if err := b.store.Save(logger); err != nil {
+		return fmt.Errorf("failed to save state for instance %s with error %s", instanceID, err)
+	}
+	return nil
+}
+
+// forgetInstance removes an instance from the store and the instance index.
+func (b *Broker) forgetInstance(logger lager.Logger, instanceID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if err := b.store.DeleteInstanceDetails(instanceID); err != nil {
+		return err
+	}
+	if err := b.unindexInstanceLocked(instanceID); err != nil {
+		return fmt.Errorf("failed to remove instance %s from the instance index with error %s", instanceID, err)
+	}
+	return b.store.Save(logger)
+}
+
+// resumeOperations restarts the background work for every operation that was
+// still in progress when the broker last stopped. Work is started over: each
+// step finds what an earlier attempt already did, a directory already moved
+// to the trash is recorded all the same, and a clone's copy is either in
+// place or copied again from the start.
+func (b *Broker) resumeOperations(logger lager.Logger) {
+	logger = logger.Session("resume-operations")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	ids, err := b.instanceIDs()
+	if err != nil {
+		logger.Error("failed-to-list-instances", err)
+		return
+	}
+
+	for _, instanceID := range ids {
+		details, fp, err := b.retrieveInstance(instanceID)
+		if err != nil {
+			logger.Error("failed-to-retrieve-instance", err, lager.Data{"instanceID": instanceID})
+			continue
+		}
+		if fp.Operation == nil || fp.Operation.State != brokerapi.InProgress {
+			continue
+		}
+
+		logger.Info("resuming", lager.Data{"instanceID": instanceID, "operation": fp.Operation.Type})
+		cluster, zone, name, err := b.instanceVolume(instanceID, fp)
+		if err != nil {
+			b.recordOperationOrLog(logger, instanceID, Operation{Type: fp.Operation.Type, State: brokerapi.Failed, Description: err.Error()})
+			continue
+		}
+
+		switch fp.Operation.Type {
+		case operationProvision:
+			spec, err := b.instanceSpec(details, fp)
+			if err != nil {
+				b.recordOperationOrLog(logger, instanceID, Operation{Type: operationProvision, State: brokerapi.Failed, Description: err.Error()})
+				continue
+			}
+			b.runOperation(logger, instanceID, operationProvision, b.provisionWork(logger, zone, name, spec))
+		case operationDeprovision:
+			b.runOperation(logger, instanceID, operationDeprovision, b.deprovisionWork(logger, cluster, zone, instanceID, details, fp))
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+)
+
+// Ownership is the owner, group and mode the root directory of an instance
+// was given when it was created. Those that are nil or empty were left to
+// the cluster's defaults.
+type Ownership struct {
+	UID  *int   `json:"uid,omitempty"`
+	GID  *int   `json:"gid,omitempty"`
+	Mode string `json:"mode,omitempty"`
+}
+
+func (o *Ownership) ownership() isilon.Ownership {
+	return isilon.Ownership{UID: o.UID, GID: o.GID, Mode: o.Mode}
+}
+
+// IDRange is an inclusive range of uids or gids.
+type IDRange struct {
+	Min int `json:"min"`
+	Max int `json:"max"`
+}
+
+func (r *IDRange) validate() error {
+	if r.Min < 0 || r.Max < r.Min {
+		return fmt.Errorf("%d-%d is not a range of ids from 0 up", r.Min, r.Max)
+	}
+	return nil
+}
+
+func (r *IDRange) contains(id int) bool {
+	return r != nil && id >= r.Min && id <= r.Max
+}
+
+// OwnershipPolicy is the owner, group and mode the root directory of every
+// instance of a plan gets, unless the instance chooses its own through the
+// uid, gid and mode provision parameters. Instances may only choose a uid or
+// gid from UIDRange or GIDRange.
+type OwnershipPolicy struct {
+	UID      *int     `json:"uid,omitempty"`
+	GID      *int     `json:"gid,omitempty"`
+	Mode     string   `json:"mode,omitempty"`
+	UIDRange *IDRange `json:"uid_range,omitempty"`
+	GIDRange *IDRange `json:"gid_range,omitempty"`
+}
+
+func (p *OwnershipPolicy) validate() error {
+	if err := validateID("uid", p.UID, "uid_range", p.UIDRange); err != nil {
+		return err
+	}
+	if err := validateID("gid", p.GID, "gid_range", p.GIDRange); err != nil {
+		return err
+	}
+	if p.Mode != "" {
+		if _, err := parseMode(p.Mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateID checks the default uid or gid of a plan, and the range its
+// instances may choose one from.
+func validateID(name string, id *int, rangeName string, r *IDRange) error {
+	if r != nil {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("%s: %s", rangeName, err)
+		}
+	}
+	if id == nil {
+		return nil
+	}
+	if *id < 0 {
+		return fmt.Errorf("%s %d must not be negative", name, *id)
+	}
+	if r != nil && !r.contains(*id) {
+		return fmt.Errorf("%s %d is not in %s %d-%d", name, *id, rangeName, r.Min, r.Max)
+	}
+	return nil
+}
+
+// parseMode checks a mode given in octal, such as "775", and returns it with
+// a leading zero, as OneFS reports it. The setuid, setgid and sticky bits
+// are not allowed.
+func parseMode(mode string) (string, error) {
+	bits, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || bits > 0777 {
+		return "", fmt.Errorf("mode %q must be permissions in octal, from 000 to 777", mode)
+	}
+	return fmt.Sprintf("%04o", bits), nil
+}
+
+// ownershipFor is the ownership of a new instance of the plan, given what it
+// asked for. It is nil when neither the plan nor the instance sets any.
+func (p CatalogPlan) ownershipFor(uid, gid *int, mode string) (*Ownership, error) {
+	policy := p.Ownership
+	if policy == nil {
+		policy = &OwnershipPolicy{}
+	}
+
+	ownership := &Ownership{UID: policy.UID, GID: policy.GID, Mode: policy.Mode}
+	if uid != nil {
+		if !policy.UIDRange.contains(*uid) {
+			return nil, idRangeError(p.Name, "uid", *uid, policy.UIDRange)
+		}
+		ownership.UID = uid
+	}
+	if gid != nil {
+		if !policy.GIDRange.contains(*gid) {
+			return nil, idRangeError(p.Name, "gid", *gid, policy.GIDRange)
+		}
+		ownership.GID = gid
+	}
+	if mode != "" {
+		ownership.Mode = mode
+	}
+	if ownership.Mode != "" {
+		var err error
+		if ownership.Mode, err = parseMode(ownership.Mode); err != nil {
+			return nil, err
+		}
+	}
+
+	if ownership.UID == nil && ownership.GID == nil && ownership.Mode == "" {
+		return nil, nil
+	}
+	return ownership, nil
+}
+
+func idRangeError(planName, name string, id int, r *IDRange) error {
+	if r == nil {
+		return fmt.Errorf("plan %s does not allow choosing the %s", planName, name)
+	}
+	return fmt.Errorf("%s %d is not in the range %d-%d allowed by plan %s", name, id, r.Min, r.Max, planName)
+}
+
+// defaultOwnership maps a binding to the owner and group the instance's root
+// directory was given, for the uid and gid mount options that are allowed
+// but were not set.
+func defaultOwnership(mountConfig map[string]interface{}, allowed []string, ownership *Ownership) {
+	if ownership == nil {
+		return
+	}
+	for option, id := range map[string]*int{"uid": ownership.UID, "gid": ownership.GID} {
+		if _, ok := mountConfig[option]; ok || id == nil || !inArray(allowed, option) {
+			continue
+		}
+		mountConfig[option] = strconv.Itoa(*id)
+	}
+}
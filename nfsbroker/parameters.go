@@ -0,0 +1,43 @@
+package nfsbroker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// provisionParameters are the arbitrary parameters accepted by provision and
+// update, as passed with cf create-service -c.
+type provisionParameters struct {
+	Size string `json:"size,omitempty"`
+
+	Snapshots *SnapshotPolicy `json:"snapshots,omitempty"`
+
+	// SourceInstance makes the new instance a copy of another instance of
+	// the same org, or of its snapshot named Snapshot.
+	SourceInstance string `json:"source_instance,omitempty"`
+	Snapshot       string `json:"snapshot,omitempty"`
+
+	// Path is the existing directory an instance of an import plan adopts.
+	Path string `json:"path,omitempty"`
+
+	// UID, GID and Mode are the owner, group and mode, in octal, of a new
+	// instance's root directory.
+	UID  *int   `json:"uid,omitempty"`
+	GID  *int   `json:"gid,omitempty"`
+	Mode string `json:"mode,omitempty"`
+}
+
+func parseProvisionParameters(raw json.RawMessage) (provisionParameters, error) {
+	params := provisionParameters{}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return params, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&params); err != nil {
+		return provisionParameters{}, fmt.Errorf("invalid parameters: %s", err)
+	}
+	return params, nil
+}
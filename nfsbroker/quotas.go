@@ -0,0 +1,58 @@
+package nfsbroker
+
+import (
+	"fmt"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+)
+
+// QuotaThresholds are the warning thresholds of a plan's quotas, as
+// percentages of the hard limit, where 0 leaves a threshold unset. OneFS
+// notifies at the advisory threshold and denies writes once usage has been
+// over the soft threshold for longer than the grace period.
+type QuotaThresholds struct {
+	AdvisoryPercent int    `json:"advisory_percent,omitempty"`
+	SoftPercent     int    `json:"soft_percent,omitempty"`
+	SoftGrace       string `json:"soft_grace,omitempty"`
+}
+
+func (t QuotaThresholds) validate() error {
+	if t.AdvisoryPercent < 0 || t.AdvisoryPercent > 99 {
+		return fmt.Errorf("advisory_percent %d must be between 1 and 99, or 0 for no advisory threshold", t.AdvisoryPercent)
+	}
+	if t.SoftPercent < 0 || t.SoftPercent > 99 {
+		return fmt.Errorf("soft_percent %d must be between 1 and 99, or 0 for no soft threshold", t.SoftPercent)
+	}
+	if t.AdvisoryPercent > 0 && t.SoftPercent > 0 && t.AdvisoryPercent >= t.SoftPercent {
+		return fmt.Errorf("advisory_percent %d must be below soft_percent %d", t.AdvisoryPercent, t.SoftPercent)
+	}
+
+	if t.SoftPercent == 0 {
+		if t.SoftGrace != "" {
+			return fmt.Errorf("soft_grace needs a soft_percent")
+		}
+		return nil
+	}
+	_, err := parsePeriod("soft_grace", t.SoftGrace)
+	return err
+}
+
+// quotaLimits works out the thresholds of a quota of size bytes. thresholds
+// may be nil, in which case there is only a hard limit.
+func quotaLimits(size int64, thresholds *QuotaThresholds) (isilon.QuotaLimits, error) {
+	limits := isilon.QuotaLimits{Hard: size}
+	if thresholds == nil {
+		return limits, nil
+	}
+
+	limits.Advisory = size / 100 * int64(thresholds.AdvisoryPercent)
+	if thresholds.SoftPercent > 0 {
+		grace, err := parsePeriod("soft_grace", thresholds.SoftGrace)
+		if err != nil {
+			return isilon.QuotaLimits{}, err
+		}
+		limits.Soft = size / 100 * int64(thresholds.SoftPercent)
+		limits.SoftGrace = grace
+	}
+	return limits, nil
+}
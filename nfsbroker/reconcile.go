@@ -0,0 +1,386 @@
+package nfsbroker
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/ifrit"
+)
+
+// The kinds of difference Reconcile finds between the store and the clusters.
+const (
+	// DriftOrphanedDirectory is a directory in a volume path that belongs to
+	// no instance.
+	DriftOrphanedDirectory = "orphaned_directory"
+	DriftMissingDirectory  = "missing_directory"
+	DriftMissingExport     = "missing_export"
+	DriftMissingShare      = "missing_share"
+	DriftMissingQuota      = "missing_quota"
+	// DriftQuotaMismatch is a quota whose hard limit is not the size of the
+	// instance.
+	DriftQuotaMismatch = "quota_mismatch"
+	// DriftCheckFailed is an instance or volume path that could not be
+	// checked at all.
+	DriftCheckFailed = "check_failed"
+)
+
+// driftKinds are all the kinds of difference, each of which is counted even
+// when there are none.
+var driftKinds = []string{DriftOrphanedDirectory, DriftMissingDirectory, DriftMissingExport, DriftMissingShare, DriftMissingQuota, DriftQuotaMismatch, DriftCheckFailed}
+
+// Drift is one difference between the store and a cluster. Expected and
+// Actual are the hard limits of a quota_mismatch in bytes.
+type Drift struct {
+	Kind       string `json:"kind"`
+	Cluster    string `json:"cluster"`
+	Zone       string `json:"zone,omitempty"`
+	InstanceID string `json:"instance_id,omitempty"`
+	Path       string `json:"path"`
+	Expected   int64  `json:"expected,omitempty"`
+	Actual     int64  `json:"actual,omitempty"`
+	Repaired   bool   `json:"repaired,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ReconcileReport is the outcome of a Reconcile run. Counts has the number of
+// differences of each kind, including kinds with none.
+type ReconcileReport struct {
+	Instances int            `json:"instances"`
+	Drift     []Drift        `json:"drift"`
+	Counts    map[string]int `json:"counts"`
+}
+
+// Reconcile compares every instance in the store with its directory, export,
+// share and quota, and every volume path with the instances in the store.
+// Each difference is logged and reported. With repair set, missing exports,
+// shares and quotas are re-created; nothing is ever deleted.
+//
+// Instances whose provision has not succeeded, instances being deleted, and
+// instances another request is working on are skipped, as their resources are
+// expected to be incomplete or changing.
+func (b *Broker) Reconcile(ctx context.Context, repair bool) (ReconcileReport, error) {
+	logger := b.logger.Session("reconcile", lager.Data{"repair": repair})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	report := ReconcileReport{Drift: []Drift{}, Counts: map[string]int{}}
+	for _, kind := range driftKinds {
+		report.Counts[kind] = 0
+	}
+	found := func(drift Drift) {
+		logger.Info("drift", lager.Data{"drift": drift})
+		report.Drift = append(report.Drift, drift)
+		report.Counts[drift.Kind]++
+	}
+
+	ids, err := b.instanceIDs()
+	if err != nil {
+		b.metrics.failures.Add(1)
+		return ReconcileReport{}, err
+	}
+
+	// the directories in every volume path, and the instances that own them
+	type volumePath struct {
+		cluster *Cluster
+		zone    *Zone
+		names   []string
+	}
+	listed := []volumePath{}
+	directories := map[string]bool{}
+	for _, cluster := range b.clusters.members {
+		for _, zone := range cluster.volumeZones() {
+			names, err := zone.Client.ListVolumes(ctx)
+			if err != nil {
+				found(Drift{Kind: DriftCheckFailed, Cluster: cluster.Name, Zone: zone.Name, Path: zone.VolumePath, Error: fmt.Sprintf("failed to list isilon volumes with error %s", err)})
+				continue
+			}
+			listed = append(listed, volumePath{cluster: cluster, zone: zone, names: names})
+			directories[volumeKey(cluster, zone.VolumePath)] = true
+			for _, name := range names {
+				directories[volumeKey(cluster, path.Join(zone.VolumePath, name))] = true
+			}
+		}
+	}
+	owned := map[string]bool{}
+
+	for _, instanceID := range ids {
+		_, fp, err := b.retrieveInstance(instanceID)
+		if err != nil {
+			continue
+		}
+		cluster, zone, name, err := b.instanceVolume(instanceID, fp)
+		if err != nil {
+			found(Drift{Kind: DriftCheckFailed, Cluster: fp.Cluster, Zone: fp.Zone, InstanceID: instanceID, Path: fp.VolumePath, Error: err.Error()})
+			continue
+		}
+		dir := zone.instancePath(name)
+		// the directories a layout nests instances in are owned by them too
+		for owner := dir; owner != "/" && owner != "."; owner = path.Dir(owner) {
+			owned[volumeKey(cluster, owner)] = true
+		}
+		// as is the copy of a clone that is still being provisioned
+		owned[volumeKey(cluster, zone.instancePath(isilon.CopyingVolume(name)))] = true
+
+		// without its directory there is nothing to export or put a quota
+		// on; when the volume path could not be listed, or the directory was
+		// adopted from outside it, it is assumed to exist
+		exists := !directories[volumeKey(cluster, zone.VolumePath)] || directories[volumeKey(cluster, dir)]
+		drift, checked := b.reconcileStored(ctx, cluster, zone, instanceID, name, exists, repair)
+		if !checked {
+			continue
+		}
+		report.Instances++
+		for _, d := range drift {
+			found(d)
+		}
+	}
+
+	for _, listing := range listed {
+		for _, name := range listing.names {
+			dir := path.Join(listing.zone.VolumePath, name)
+			if owned[volumeKey(listing.cluster, dir)] || dir == listing.cluster.TrashPath {
+				continue
+			}
+			found(Drift{Kind: DriftOrphanedDirectory, Cluster: listing.cluster.Name, Zone: listing.zone.Name, Path: dir})
+		}
+	}
+
+	b.metrics.reconciled(report, b.clock.Now())
+	logger.Info("reconciled", lager.Data{"instances": report.Instances, "counts": report.Counts})
+	return report, nil
+}
+
+// Metrics returns the counters and gauges kept by Reconcile, whose String is
+// a JSON object with a member for each of them.
+func (b *Broker) Metrics() expvar.Var {
+	return b.metrics.all
+}
+
+type reconcileMetrics struct {
+	all *expvar.Map
+	// runs and failures count the runs that completed and that failed.
+	runs     *expvar.Int
+	failures *expvar.Int
+	// lastRun is when the last run completed, in seconds since the epoch,
+	// and instances is how many instances it checked.
+	lastRun   *expvar.Int
+	instances *expvar.Int
+	// drift has the differences of each kind the last run found, while found
+	// and repaired count those found and repaired by every run.
+	drift    *expvar.Map
+	found    *expvar.Map
+	repaired *expvar.Map
+}
+
+// newReconcileMetrics returns metrics of their own rather than published
+// ones, as expvar allows a name to be published only once per process.
+func newReconcileMetrics() *reconcileMetrics {
+	m := &reconcileMetrics{
+		all:       new(expvar.Map).Init(),
+		runs:      new(expvar.Int),
+		failures:  new(expvar.Int),
+		lastRun:   new(expvar.Int),
+		instances: new(expvar.Int),
+		drift:     new(expvar.Map).Init(),
+		found:     new(expvar.Map).Init(),
+		repaired:  new(expvar.Map).Init(),
+	}
+	for _, kind := range driftKinds {
+		m.drift.Set(kind, new(expvar.Int))
+		m.found.Set(kind, new(expvar.Int))
+		m.repaired.Set(kind, new(expvar.Int))
+	}
+	m.all.Set("reconcile_runs", m.runs)
+	m.all.Set("reconcile_failures", m.failures)
+	m.all.Set("reconcile_last_run", m.lastRun)
+	m.all.Set("reconcile_instances", m.instances)
+	m.all.Set("reconcile_drift", m.drift)
+	m.all.Set("reconcile_drift_found", m.found)
+	m.all.Set("reconcile_drift_repaired", m.repaired)
+	return m
+}
+
+// reconciled records a run that completed at now.
+func (m *reconcileMetrics) reconciled(report ReconcileReport, now time.Time) {
+	for kind, count := range report.Counts {
+		m.drift.Get(kind).(*expvar.Int).Set(int64(count))
+		m.found.Add(kind, int64(count))
+	}
+	for _, drift := range report.Drift {
+		if drift.Repaired {
+			m.repaired.Add(drift.Kind, 1)
+		}
+	}
+	m.instances.Set(int64(report.Instances))
+	m.lastRun.Set(now.Unix())
+	m.runs.Add(1)
+}
+
+// reconcileStored checks an instance found in the store while holding its
+// lock, so that a repair cannot race a request working on the instance, such
+// as a synchronous deprovision. It returns false, having checked nothing,
+// when the instance is busy or is no longer provisioned.
+func (b *Broker) reconcileStored(ctx context.Context, cluster *Cluster, zone *Zone, instanceID, name string, exists bool, repair bool) ([]Drift, bool) {
+	unlock, err := b.lockInstance(instanceID)
+	if err != nil {
+		return nil, false
+	}
+	defer unlock()
+
+	// the instance may have changed since it was first read
+	details, fp, err := b.retrieveInstance(instanceID)
+	if err != nil {
+		return nil, false
+	}
+	if op := fp.Operation; op != nil && (op.Type != operationProvision || op.State != brokerapi.Succeeded) {
+		return nil, false
+	}
+
+	dir := zone.instancePath(name)
+	if !exists {
+		return []Drift{{Kind: DriftMissingDirectory, Cluster: cluster.Name, Zone: zone.Name, InstanceID: instanceID, Path: dir}}, true
+	}
+	spec, err := b.instanceSpec(details, fp)
+	if err != nil {
+		return []Drift{{Kind: DriftCheckFailed, Cluster: cluster.Name, Zone: zone.Name, InstanceID: instanceID, Path: dir, Error: err.Error()}}, true
+	}
+	return b.reconcileInstance(ctx, cluster, zone, instanceID, name, spec, repair), true
+}
+
+// reconcileInstance checks the export, share and quota of one instance, whose
+// directory is name in the zone's volume path.
+func (b *Broker) reconcileInstance(ctx context.Context, cluster *Cluster, zone *Zone, instanceID, name string, spec instanceSpec, repair bool) []Drift {
+	client := zone.Client
+	drift := func(kind string) Drift {
+		return Drift{Kind: kind, Cluster: cluster.Name, Zone: zone.Name, InstanceID: instanceID, Path: zone.instancePath(name)}
+	}
+
+	found := []Drift{}
+
+	if spec.smb.exportsNFS() {
+		exported, err := client.IsExported(ctx, name, zone.exportZone())
+		if err != nil {
+			d := drift(DriftCheckFailed)
+			d.Error = fmt.Sprintf("failed to read isilon export %s with error %s", name, err)
+			found = append(found, d)
+		} else if !exported {
+			d := drift(DriftMissingExport)
+			if repair {
+				d.Repaired, d.Error = repaired(b.repairExport(ctx, zone, name, spec))
+			}
+			found = append(found, d)
+		}
+	}
+
+	if spec.smb != nil {
+		shared, err := client.IsShared(ctx, name, zone.exportZone())
+		if err != nil {
+			d := drift(DriftCheckFailed)
+			d.Error = fmt.Sprintf("failed to read isilon smb share %s with error %s", name, err)
+			found = append(found, d)
+		} else if !shared {
+			d := drift(DriftMissingShare)
+			if repair {
+				err := client.CreateShare(ctx, name, zone.exportZone())
+				if err != nil {
+					err = fmt.Errorf("failed to create isilon smb share %s with error %s", name, err)
+				}
+				d.Repaired, d.Error = repaired(err)
+			}
+			found = append(found, d)
+		}
+	}
+
+	quota, err := client.Quota(ctx, name)
+	switch {
+	case err == isilon.ErrQuotaNotFound:
+		d := drift(DriftMissingQuota)
+		if repair {
+			err := client.SetQuota(ctx, name, spec.limits)
+			if err != nil {
+				err = fmt.Errorf("failed to set isilon quota for %s with error %s", name, err)
+			}
+			d.Repaired, d.Error = repaired(err)
+		}
+		found = append(found, d)
+	case err != nil:
+		d := drift(DriftCheckFailed)
+		d.Error = fmt.Sprintf("failed to read isilon quota for %s with error %s", name, err)
+		found = append(found, d)
+	case quota.Limits.Hard != spec.limits.Hard:
+		d := drift(DriftQuotaMismatch)
+		d.Expected, d.Actual = spec.limits.Hard, quota.Limits.Hard
+		found = append(found, d)
+	}
+
+	return found
+}
+
+func (b *Broker) repairExport(ctx context.Context, zone *Zone, name string, spec instanceSpec) error {
+	if _, err := zone.Client.ExportVolume(ctx, name, zone.exportZone()); err != nil {
+		return fmt.Errorf("failed to create isilon export %s with error %s", name, err)
+	}
+	if err := zone.Client.SetExportClients(ctx, name, zone.exportZone(), spec.clients); err != nil {
+		return fmt.Errorf("failed to set isilon export clients for %s with error %s", name, err)
+	}
+	if spec.security != nil {
+		return setSecurity(ctx, zone, name, spec.security)
+	}
+	return nil
+}
+
+func repaired(err error) (bool, string) {
+	if err != nil {
+		return false, err.Error()
+	}
+	return true, ""
+}
+
+// volumeKey identifies a directory across clusters.
+func volumeKey(cluster *Cluster, dir string) string {
+	return cluster.Name + ":" + dir
+}
+
+// volumeZones are the System zone and every other zone of the cluster with a
+// volume path of its own, so that each volume path is listed once.
+func (c *Cluster) volumeZones() []*Zone {
+	zones := []*Zone{c.system}
+	seen := map[string]bool{c.system.VolumePath: true}
+	for _, zone := range c.Zones {
+		if !seen[zone.VolumePath] {
+			seen[zone.VolumePath] = true
+			zones = append(zones, zone)
+		}
+	}
+	return zones
+}
+
+// NewReconciler returns a runner that reconciles the store with the clusters
+// every interval until it is signalled.
+func NewReconciler(logger lager.Logger, broker *Broker, clock clock.Clock, interval time.Duration, repair bool) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		logger := logger.Session("reconciler")
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+
+		close(ready)
+		for {
+			select {
+			case <-ticker.C():
+				if _, err := broker.Reconcile(context.Background(), repair); err != nil {
+					logger.Error("failed-to-reconcile", err)
+				}
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
@@ -0,0 +1,77 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+)
+
+// The replication states the usage report gives for instances of replicated
+// plans, besides the state of their latest SyncIQ job.
+const (
+	// ReplicationPending is a policy that has not run yet.
+	ReplicationPending = "pending"
+	// ReplicationMissing is an instance whose policy has been removed.
+	ReplicationMissing = "missing"
+)
+
+// ReplicationPolicy copies every instance of a plan to another cluster with
+// SyncIQ. Each instance is replicated into its own directory, named after the
+// instance, under TargetPath on TargetHost, as often as Frequency says.
+type ReplicationPolicy struct {
+	// TargetHost is the SmartConnect name or address of the target cluster.
+	TargetHost string `json:"target_host"`
+	TargetPath string `json:"target_path"`
+	// Frequency is hourly, daily or weekly, as for snapshots.
+	Frequency string `json:"frequency"`
+}
+
+func (p ReplicationPolicy) validate() error {
+	if p.TargetHost == "" {
+		return errors.New("target_host is required")
+	}
+	if path.Clean(p.TargetPath) != p.TargetPath || !strings.HasPrefix(p.TargetPath, "/ifs/") {
+		return fmt.Errorf("target_path %q must be a clean path under /ifs", p.TargetPath)
+	}
+	if _, ok := snapshotSchedules[p.Frequency]; !ok {
+		return fmt.Errorf("frequency %q must be %s, %s or %s", p.Frequency, SnapshotsHourly, SnapshotsDaily, SnapshotsWeekly)
+	}
+	return nil
+}
+
+// policy is the SyncIQ policy of the instance whose directory is name.
+func (p ReplicationPolicy) policy(name string) isilon.ReplicationPolicy {
+	return isilon.ReplicationPolicy{
+		TargetHost: p.TargetHost,
+		TargetPath: path.Join(p.TargetPath, name),
+		Schedule:   snapshotSchedules[p.Frequency],
+	}
+}
+
+// sameReplication reports whether two plans replicate their instances in the
+// same way, so that moving between them leaves the policy alone.
+func sameReplication(a, b *ReplicationPolicy) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// setReplication makes the replication policy of the instance whose directory
+// is name match policy, removing it when policy is nil.
+func setReplication(ctx context.Context, client isilon.Client, name string, policy *ReplicationPolicy) error {
+	if policy == nil {
+		if err := client.ClearReplicationPolicy(ctx, name); err != nil {
+			return fmt.Errorf("failed to delete isilon replication policy for %s with error %s", name, err)
+		}
+		return nil
+	}
+	if err := client.SetReplicationPolicy(ctx, name, policy.policy(name)); err != nil {
+		return fmt.Errorf("failed to set isilon replication policy for %s with error %s", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,55 @@
+package nfsbroker
+
+import (
+	"fmt"
+	"strings"
+
+	"code.cloudfoundry.org/lager"
+)
+
+type rollbackStep struct {
+	name string
+	undo func() error
+}
+
+// rollback records the steps of a multi-step operation so that the ones
+// which already completed can be undone, newest first, if a later one fails.
+type rollback struct {
+	steps []rollbackStep
+}
+
+func (r *rollback) add(name string, undo func() error) {
+	r.steps = append(r.steps, rollbackStep{name: name, undo: undo})
+}
+
+// run undoes every recorded step and returns cause annotated with the outcome
+// of the cleanup. A failing step does not stop the remaining ones from running.
+func (r *rollback) run(logger lager.Logger, cause error) error {
+	if len(r.steps) == 0 {
+		return cause
+	}
+
+	logger = logger.Session("rollback")
+	logger.Info("start", lager.Data{"cause": cause.Error()})
+	defer logger.Info("end")
+
+	var failures []string
+	for i := len(r.steps) - 1; i >= 0; i-- {
+		step := r.steps[i]
+		if err := step.undo(); err != nil {
+			logger.Error("step-failed", err, lager.Data{"step": step.name})
+			failures = append(failures, fmt.Sprintf("%s: %s", step.name, err))
+			continue
+		}
+		logger.Info("step-succeeded", lager.Data{"step": step.name})
+	}
+	r.steps = nil
+
+	if len(failures) > 0 {
+		logger.Error("rollback-failed", fmt.Errorf("%d of the cleanup steps failed", len(failures)))
+		return fmt.Errorf("%s; cleanup of partially created resources failed (%s)", cause, strings.Join(failures, "; "))
+	}
+
+	logger.Info("rollback-succeeded")
+	return fmt.Errorf("%s; partially created resources were cleaned up", cause)
+}
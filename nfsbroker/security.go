@@ -0,0 +1,124 @@
+package nfsbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+)
+
+// The volume drivers bindings mount through. Kerberos needs NFSv4, which the
+// nfsv3driver cannot mount.
+const (
+	DefaultDriver         = "nfsv3driver"
+	DefaultKerberosDriver = "nfsv4driver"
+)
+
+// secParameter is the bind parameter choosing which of a plan's Kerberos
+// flavors a binding mounts with.
+const secParameter = "sec"
+
+// SecurityPolicy makes the exports of a plan's instances require Kerberos.
+// Bindings of such a plan need a Kerberos principal and keytab.
+type SecurityPolicy struct {
+	// Flavors are the flavors the exports allow, out of krb5, krb5i and
+	// krb5p. Bindings mount with the first unless they pick another through
+	// the sec bind parameter.
+	Flavors []string `json:"flavors"`
+
+	// Driver is the NFSv4 volume driver bindings mount through. It defaults
+	// to nfsv4driver.
+	Driver string `json:"driver,omitempty"`
+}
+
+func (p SecurityPolicy) validate() error {
+	if len(p.Flavors) == 0 {
+		return errors.New("flavors: at least one flavor is needed")
+	}
+	seen := map[string]bool{}
+	for _, flavor := range p.Flavors {
+		switch flavor {
+		case isilon.SecurityKrb5, isilon.SecurityKrb5i, isilon.SecurityKrb5p:
+		default:
+			return fmt.Errorf("flavors: %q must be %s, %s or %s", flavor, isilon.SecurityKrb5, isilon.SecurityKrb5i, isilon.SecurityKrb5p)
+		}
+		if seen[flavor] {
+			return fmt.Errorf("flavors: %s is listed more than once", flavor)
+		}
+		seen[flavor] = true
+	}
+	return nil
+}
+
+func (p SecurityPolicy) driver() string {
+	if p.Driver == "" {
+		return DefaultKerberosDriver
+	}
+	return p.Driver
+}
+
+// exportFlavors are the security flavors of the exports of a plan with the
+// given policy. Plans without one use the AUTH_SYS flavor alone.
+func exportFlavors(policy *SecurityPolicy) []string {
+	if policy == nil {
+		return []string{isilon.SecurityUnix}
+	}
+	return policy.Flavors
+}
+
+// sameSecurity reports whether two plans export their instances with the
+// same flavors, so that moving between them leaves the export alone.
+func sameSecurity(a, b *SecurityPolicy) bool {
+	fa, fb := exportFlavors(a), exportFlavors(b)
+	if len(fa) != len(fb) {
+		return false
+	}
+	for i := range fa {
+		if fa[i] != fb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// setSecurity makes the security flavors of the export of the volume name
+// match policy.
+func setSecurity(ctx context.Context, zone *Zone, name string, policy *SecurityPolicy) error {
+	if err := zone.Client.SetExportSecurityFlavors(ctx, name, zone.exportZone(), exportFlavors(policy)); err != nil {
+		return fmt.Errorf("failed to set isilon export security flavors for %s with error %s", name, err)
+	}
+	return nil
+}
+
+// kerberosMountConfig checks the Kerberos bind parameters of a binding of a
+// plan with policy, returning the mount options the driver needs: the
+// flavor, principal and keytab.
+func kerberosMountConfig(planName string, policy *SecurityPolicy, opts map[string]interface{}) (map[string]interface{}, error) {
+	if policy == nil {
+		if _, ok := opts[secParameter]; ok {
+			return nil, fmt.Errorf("plan %s does not use Kerberos, so it does not accept a %s parameter", planName, secParameter)
+		}
+		return map[string]interface{}{}, nil
+	}
+
+	principal, _ := opts[Username].(string)
+	keytab, _ := opts[Secret].(string)
+	if principal == "" || keytab == "" {
+		return nil, fmt.Errorf("plan %s uses Kerberos, so %s and %s parameters are required", planName, Username, Secret)
+	}
+
+	flavor := policy.Flavors[0]
+	if sec, ok := opts[secParameter]; ok {
+		flavor, _ = sec.(string)
+		if !inArray(policy.Flavors, flavor) {
+			return nil, fmt.Errorf("%s %v is not one of the flavors plan %s allows: %v", secParameter, sec, planName, policy.Flavors)
+		}
+	}
+
+	return map[string]interface{}{
+		secParameter: flavor,
+		Username:     principal,
+		Secret:       keytab,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package nfsbroker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The protocols bindings mount instances over.
+const (
+	ProtocolNFS = "nfs"
+	ProtocolSMB = "smb"
+)
+
+// DefaultSMBDriver is the volume driver bindings mount SMB shares through.
+const DefaultSMBDriver = "smbdriver"
+
+// The bind parameters of a binding over SMB. protocolParameter picks the
+// protocol on plans that share their instances over both.
+const (
+	protocolParameter = "protocol"
+	smbUsername       = "username"
+	smbPassword       = "password"
+	smbDomain         = "domain"
+)
+
+// SMBPolicy shares the directory of every instance of a plan over SMB, in
+// the same access zone as its NFS export.
+type SMBPolicy struct {
+	// Driver is the volume driver bindings mount the share through. It
+	// defaults to smbdriver.
+	Driver string `json:"driver,omitempty"`
+
+	// NoNFS leaves out the NFS export, so that instances are shared over
+	// SMB alone.
+	NoNFS bool `json:"no_nfs,omitempty"`
+}
+
+func (p *SMBPolicy) driver() string {
+	if p.Driver == "" {
+		return DefaultSMBDriver
+	}
+	return p.Driver
+}
+
+// exportsNFS reports whether instances of a plan with this policy, which may
+// be nil, have an NFS export.
+func (p *SMBPolicy) exportsNFS() bool {
+	return p == nil || !p.NoNFS
+}
+
+// sameProtocols reports whether instances of two plans are shared over the
+// same protocols.
+func sameProtocols(a, b *SMBPolicy) bool {
+	return (a == nil) == (b == nil) && a.exportsNFS() == b.exportsNFS()
+}
+
+// bindProtocol is the protocol a binding of an instance of plan mounts over:
+// the protocol parameter if there is one, and otherwise NFS unless the plan
+// has no NFS export.
+func bindProtocol(plan CatalogPlan, opts map[string]interface{}) (string, error) {
+	protocol := ProtocolNFS
+	if !plan.SMB.exportsNFS() {
+		protocol = ProtocolSMB
+	}
+
+	requested, ok := opts[protocolParameter]
+	if !ok {
+		return protocol, nil
+	}
+	protocol, _ = requested.(string)
+	switch {
+	case protocol == ProtocolNFS && plan.SMB.exportsNFS():
+	case protocol == ProtocolSMB && plan.SMB != nil:
+	default:
+		return "", fmt.Errorf("plan %s is not shared over %s %v", plan.Name, protocolParameter, requested)
+	}
+	return protocol, nil
+}
+
+// smbMountConfig checks the parameters of a binding over SMB, returning the
+// credentials the driver mounts the share with.
+func smbMountConfig(opts map[string]interface{}) (map[string]interface{}, error) {
+	config := map[string]interface{}{}
+	notAllowed := []string{}
+	for k, v := range opts {
+		switch k {
+		case "mount", "readonly", protocolParameter:
+		case smbUsername, smbPassword, smbDomain:
+			value, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a string", k)
+			}
+			config[k] = value
+		default:
+			notAllowed = append(notAllowed, k)
+		}
+	}
+
+	if len(notAllowed) > 0 {
+		sort.Strings(notAllowed)
+		return nil, errors.New("Not allowed options: " + strings.Join(notAllowed, ", "))
+	}
+	username, _ := config[smbUsername].(string)
+	password, _ := config[smbPassword].(string)
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("bindings over SMB need %s and %s parameters", smbUsername, smbPassword)
+	}
+	return config, nil
+}
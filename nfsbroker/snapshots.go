@@ -0,0 +1,216 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+const (
+	SnapshotsHourly = "hourly"
+	SnapshotsDaily  = "daily"
+	SnapshotsWeekly = "weekly"
+	// SnapshotsNone turns off the snapshot schedule of a plan for one
+	// instance.
+	SnapshotsNone = "none"
+)
+
+// snapshotSchedules maps each frequency onto the OneFS schedule syntax.
+var snapshotSchedules = map[string]string{
+	SnapshotsHourly: "Every day every 1 hours",
+	SnapshotsDaily:  "Every day at 12:00 AM",
+	SnapshotsWeekly: "Every Sunday at 12:00 AM",
+}
+
+// SnapshotPolicy is how often an instance is snapshotted and for how long
+// each snapshot is kept, such as hourly snapshots kept for "7d".
+type SnapshotPolicy struct {
+	Frequency string `json:"frequency"`
+	// Retention is a whole number of hours, days or weeks, e.g. "36h", "7d"
+	// or "4w".
+	Retention string `json:"retention,omitempty"`
+}
+
+func (p SnapshotPolicy) enabled() bool {
+	return p.Frequency != SnapshotsNone
+}
+
+func (p SnapshotPolicy) validate() error {
+	if p.Frequency == SnapshotsNone {
+		if p.Retention != "" {
+			return fmt.Errorf("retention cannot be set when frequency is %s", SnapshotsNone)
+		}
+		return nil
+	}
+	if _, ok := snapshotSchedules[p.Frequency]; !ok {
+		return fmt.Errorf("frequency %q must be one of %s, %s, %s or %s", p.Frequency, SnapshotsHourly, SnapshotsDaily, SnapshotsWeekly, SnapshotsNone)
+	}
+	_, err := parsePeriod("retention", p.Retention)
+	return err
+}
+
+func (p SnapshotPolicy) schedule() (isilon.SnapshotSchedule, error) {
+	retention, err := parsePeriod("retention", p.Retention)
+	if err != nil {
+		return isilon.SnapshotSchedule{}, err
+	}
+	return isilon.SnapshotSchedule{Schedule: snapshotSchedules[p.Frequency], Retention: retention}, nil
+}
+
+var periodPattern = regexp.MustCompile(`^\s*(\d+)\s*([hdw])\s*$`)
+
+// parsePeriod converts a whole number of hours, days or weeks, such as "36h",
+// "7d" or "4w", to a duration. field names the setting in errors.
+func parsePeriod(field, period string) (time.Duration, error) {
+	match := periodPattern.FindStringSubmatch(period)
+	if match == nil {
+		return 0, fmt.Errorf("%s %q must be a whole number followed by h, d or w", field, period)
+	}
+	n, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s %q is too long", field, period)
+	}
+
+	unit := map[string]time.Duration{"h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[match[2]]
+	if n > int64((1<<63-1)/unit) {
+		return 0, fmt.Errorf("%s %q is too long", field, period)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("%s %q must be longer than 0", field, period)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// snapshotPolicyFor works out the snapshot schedule of a new instance of the
+// plan, which the snapshots provision parameter overrides. It is nil when the
+// instance is not snapshotted.
+func (p CatalogPlan) snapshotPolicyFor(requested *SnapshotPolicy) (*SnapshotPolicy, error) {
+	policy := p.Snapshots
+	if requested != nil {
+		if err := requested.validate(); err != nil {
+			return nil, fmt.Errorf("invalid snapshots parameter: %s", err)
+		}
+		policy = requested
+	}
+	if policy == nil || !policy.enabled() {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// InstanceSnapshots lists the snapshots of an instance's volume, including
+// the ones taken by its schedule.
+func (b *Broker) InstanceSnapshots(ctx context.Context, instanceID string) ([]isilon.Snapshot, error) {
+	zone, volume, err := b.snapshotVolume(instanceID)
+	if err != nil {
+		return nil, err
+	}
+	snapshots, err := zone.Client.ListSnapshots(ctx, volume)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list isilon snapshots of %s with error %s", instanceID, err)
+	}
+	return snapshots, nil
+}
+
+// CreateInstanceSnapshot takes a snapshot of an instance's volume right away.
+// OneFS names the snapshot when name is empty. The snapshot is recorded
+// against the instance, so that it goes when the instance does.
+func (b *Broker) CreateInstanceSnapshot(ctx context.Context, instanceID, name string) (isilon.Snapshot, error) {
+	unlock, err := b.lockInstance(instanceID)
+	if err != nil {
+		return isilon.Snapshot{}, err
+	}
+	defer unlock()
+
+	zone, volume, err := b.snapshotVolume(instanceID)
+	if err != nil {
+		return isilon.Snapshot{}, err
+	}
+	snapshot, err := zone.Client.CreateSnapshot(ctx, volume, name)
+	if err != nil {
+		return isilon.Snapshot{}, fmt.Errorf("failed to create isilon snapshot of %s with error %s", instanceID, err)
+	}
+
+	err = b.recordSnapshots(instanceID, func(ids []int64) []int64 {
+		return append(ids, snapshot.ID)
+	})
+	if err != nil {
+		if deleteErr := zone.Client.DeleteSnapshot(ctx, volume, snapshot.ID); deleteErr != nil {
+			return isilon.Snapshot{}, fmt.Errorf("%s; failed to delete isilon snapshot %d of %s with error %s", err, snapshot.ID, instanceID, deleteErr)
+		}
+		return isilon.Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+// DeleteInstanceSnapshot deletes one of the snapshots of an instance's
+// volume, returning isilon.ErrSnapshotNotFound if it has no such snapshot.
+func (b *Broker) DeleteInstanceSnapshot(ctx context.Context, instanceID string, snapshotID int64) error {
+	unlock, err := b.lockInstance(instanceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	zone, volume, err := b.snapshotVolume(instanceID)
+	if err != nil {
+		return err
+	}
+	err = zone.Client.DeleteSnapshot(ctx, volume, snapshotID)
+	if err == isilon.ErrSnapshotNotFound {
+		return err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete isilon snapshot %d of %s with error %s", snapshotID, instanceID, err)
+	}
+
+	return b.recordSnapshots(instanceID, func(ids []int64) []int64 {
+		kept := []int64{}
+		for _, id := range ids {
+			if id != snapshotID {
+				kept = append(kept, id)
+			}
+		}
+		return kept
+	})
+}
+
+// recordSnapshots changes the IDs of the snapshots recorded as taken by the
+// broker for an instance. Instances from before the broker recorded what it
+// created have nothing to change, as all of their snapshots go with them.
+func (b *Broker) recordSnapshots(instanceID string, change func([]int64) []int64) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	details, fp, err := b.retrieveInstanceLocked(instanceID)
+	if err != nil {
+		return err
+	}
+	if fp.Created == nil {
+		return nil
+	}
+	created := *fp.Created
+	created.Snapshots = change(created.Snapshots)
+	fp.Created = &created
+	if err := b.updateInstanceLocked(instanceID, details, fp); err != nil {
+		return fmt.Errorf("failed to store instance details %s with error %s", instanceID, err)
+	}
+	if err := b.store.Save(b.logger); err != nil {
+		return fmt.Errorf("failed to save state for instance %s with error %s", instanceID, err)
+	}
+	return nil
+}
+
+func (b *Broker) snapshotVolume(instanceID string) (*Zone, string, error) {
+	_, fp, err := b.retrieveInstance(instanceID)
+	if err != nil {
+		return nil, "", brokerapi.ErrInstanceDoesNotExist
+	}
+	_, zone, volume, err := b.instanceVolume(instanceID, fp)
+	return zone, volume, err
+}
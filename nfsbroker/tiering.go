@@ -0,0 +1,25 @@
+package nfsbroker
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+)
+
+// setStoragePool points the file pool policy of an instance at pool, or
+// removes it when pool is empty so that the instance is stored in the
+// cluster's default pool. Data already written only moves once a SmartPools
+// job runs.
+func setStoragePool(ctx context.Context, client isilon.Client, name string, pool string) error {
+	if pool == "" {
+		if err := client.ClearStoragePool(ctx, name); err != nil {
+			return fmt.Errorf("failed to delete isilon storage pool policy for %s with error %s", name, err)
+		}
+		return nil
+	}
+	if err := client.SetStoragePool(ctx, name, pool); err != nil {
+		return fmt.Errorf("failed to set isilon storage pool for %s with error %s", name, err)
+	}
+	return nil
+}
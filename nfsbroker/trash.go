@@ -0,0 +1,343 @@
+package nfsbroker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"time"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"code.cloudfoundry.org/service-broker-store/brokerstore"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+	"github.com/tedsuo/ifrit"
+)
+
+// trashIndexID is the store record listing the instances in the trash. Like
+// the instance index it exists because brokerstore cannot enumerate records.
+const trashIndexID = "isilon-nfs-broker-trash"
+
+// ErrTrashEntryNotFound is returned for an instance that is not in the trash,
+// either because it was never deleted or because it has been purged.
+var ErrTrashEntryNotFound = errors.New("instance is not in the trash")
+
+// TrashEntry is the directory of a deleted instance whose plan keeps deleted
+// instances. It stays in the cluster's trash path until Expires. Used is the
+// number of bytes the directory held when it was deleted, which its quota no
+// longer counts once it is in the trash.
+type TrashEntry struct {
+	InstanceID string    `json:"instance_id"`
+	OrgGUID    string    `json:"organization_guid"`
+	SpaceGUID  string    `json:"space_guid"`
+	PlanID     string    `json:"plan_id"`
+	Cluster    string    `json:"cluster"`
+	Path       string    `json:"path"`
+	Used       int64     `json:"used"`
+	Deleted    time.Time `json:"deleted"`
+	Expires    time.Time `json:"expires"`
+}
+
+// trashInstance is the deprovision of an instance whose plan keeps deleted
+// instances. Its replication policy, snapshots, export and quota go as
+// usual, but its directory is moved to the cluster's trash path and recorded
+// there.
+func (b *Broker) trashInstance(ctx context.Context, logger lager.Logger, cluster *Cluster, zone *Zone, instanceID, name string, details brokerstore.ServiceInstance, fp InstanceFingerprint, retention time.Duration) error {
+	// the quota goes with the other resources, so what it counts is read
+	// first; an earlier attempt may have removed it already
+	used, err := zone.Client.QuotaUsage(ctx, name)
+	if err != nil {
+		logger.Error("failed-to-read-usage", err, lager.Data{"instanceID": instanceID})
+	}
+
+	if err := b.releaseInstanceResources(ctx, zone, name, fp); err != nil {
+		return err
+	}
+
+	// Move Volume to Trash
+	trashPath := path.Join(cluster.TrashPath, instanceID)
+	err = zone.Client.MoveDirectory(ctx, zone.instancePath(name), trashPath)
+	if err == isilon.ErrDirectoryNotFound {
+		// an earlier attempt may have moved it already, so it is recorded all
+		// the same; purging an entry with no directory does no harm
+		logger.Info("volume-already-gone", lager.Data{"instanceID": instanceID})
+	} else if err != nil {
+		return fmt.Errorf("failed to move isilon volume %s to %s with error %s", instanceID, trashPath, err)
+	}
+
+	now := b.clock.Now()
+	return b.addTrashEntry(logger, TrashEntry{
+		InstanceID: instanceID,
+		OrgGUID:    details.OrganizationGUID,
+		SpaceGUID:  details.SpaceGUID,
+		PlanID:     details.PlanID,
+		Cluster:    cluster.Name,
+		Path:       trashPath,
+		Used:       used,
+		Deleted:    now,
+		Expires:    now.Add(retention),
+	})
+}
+
+// Trash lists the deleted instances that can still be undeleted.
+func (b *Broker) Trash() ([]TrashEntry, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.trashEntriesLocked()
+}
+
+// PurgeTrash removes the directories of the trash entries that have expired.
+// An entry that cannot be purged does not stop the others, and is tried again
+// next time, as is an entry that is being undeleted.
+func (b *Broker) PurgeTrash(ctx context.Context) error {
+	logger := b.logger.Session("purge-trash")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	entries, err := b.Trash()
+	if err != nil {
+		return err
+	}
+
+	now := b.clock.Now()
+	failed := 0
+	for _, entry := range entries {
+		if entry.Expires.After(now) {
+			continue
+		}
+		data := lager.Data{"instanceID": entry.InstanceID, "path": entry.Path}
+
+		if err := b.purgeTrashEntry(ctx, logger, entry); err == ErrConcurrentInstanceAccess {
+			logger.Info("busy", data)
+		} else if err != nil {
+			logger.Error("failed-to-purge", err, data)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to purge %d of the expired trash entries", failed)
+	}
+	return nil
+}
+
+// purgeTrashEntry removes the directory of an expired entry while holding the
+// lock UndeleteInstance takes on it, so that a directory being restored is
+// not purged.
+func (b *Broker) purgeTrashEntry(ctx context.Context, logger lager.Logger, entry TrashEntry) error {
+	unlock, err := b.lockInstance(entry.InstanceID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// an undelete that held the lock may have restored it
+	if _, err := b.trashEntry(entry.InstanceID); err == ErrTrashEntryNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	cluster, ok := b.clusters.Get(entry.Cluster)
+	if !ok {
+		return fmt.Errorf("cluster %s is not configured", entry.Cluster)
+	}
+	if err := cluster.Client.DeleteDirectory(ctx, entry.Path); err != nil {
+		return err
+	}
+	if err := b.removeTrashEntry(logger, entry.InstanceID); err != nil {
+		return err
+	}
+	logger.Info("purged", lager.Data{"instanceID": entry.InstanceID, "path": entry.Path})
+	return nil
+}
+
+// UndeleteInstance restores the directory of a deleted instance that has not
+// expired into another instance, which takes the place of the deleted one.
+// That instance must be empty, belong to the same org, on the same cluster,
+// and have a quota large enough for the deleted instance's data. Its own
+// export, quota and snapshot schedule are re-created around the restored
+// directory.
+func (b *Broker) UndeleteInstance(ctx context.Context, deletedID, instanceID string) error {
+	logger := b.logger.Session("undelete").WithData(lager.Data{"deletedID": deletedID, "instanceID": instanceID})
+	logger.Info("start")
+	defer logger.Info("end")
+
+	// the deleted instance is locked too, so that its directory is not
+	// restored into two instances at once
+	for _, id := range []string{instanceID, deletedID} {
+		unlock, err := b.lockInstance(id)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	entry, err := b.trashEntry(deletedID)
+	if err != nil {
+		return err
+	}
+	// the reaper purges an expired entry at any moment
+	if !entry.Expires.After(b.clock.Now()) {
+		return fmt.Errorf("deleted instance %s expired at %s and is about to be purged", deletedID, entry.Expires.Format(time.RFC3339))
+	}
+
+	details, fp, err := b.retrieveInstance(instanceID)
+	if err != nil {
+		return brokerapi.ErrInstanceDoesNotExist
+	}
+	if details.OrganizationGUID != entry.OrgGUID {
+		return fmt.Errorf("instance %s belongs to another org than deleted instance %s", instanceID, deletedID)
+	}
+	if err := checkProvisioned(instanceID, fp, "restored into"); err != nil {
+		return err
+	}
+	if fp.ImportPath != "" {
+		return fmt.Errorf("instance %s adopted directory %s, which cannot be replaced", instanceID, fp.ImportPath)
+	}
+
+	cluster, zone, name, err := b.instanceVolume(instanceID, fp)
+	if err != nil {
+		return err
+	}
+	if cluster.Name != entry.Cluster {
+		return fmt.Errorf("instance %s is on cluster %s, but deleted instance %s is in the trash of cluster %s", instanceID, cluster.Name, deletedID, entry.Cluster)
+	}
+
+	// the directory itself counts as one file
+	quota, err := zone.Client.Quota(ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to read isilon quota for %s with error %s", instanceID, err)
+	}
+	if quota.Files > 1 {
+		return fmt.Errorf("instance %s is not empty", instanceID)
+	}
+
+	spec, err := b.instanceSpec(details, fp)
+	if err != nil {
+		return err
+	}
+	if entry.Used > spec.limits.Hard {
+		return fmt.Errorf("deleted instance %s holds %d bytes, which do not fit in the %d bytes of instance %s", deletedID, entry.Used, spec.limits.Hard, instanceID)
+	}
+	if err := b.deleteInstanceResources(ctx, zone, name, fp); err != nil {
+		return err
+	}
+
+	spec.restoreSource = entry.Path
+	steps := &rollback{}
+	if err := b.createInstanceResources(ctx, zone, name, spec, steps); err != nil {
+		err = steps.run(logger, err)
+
+		// put the empty instance back so that it keeps working
+		spec.restoreSource = ""
+		if recreateErr := b.createInstanceResources(ctx, zone, name, spec, &rollback{}); recreateErr != nil {
+			return fmt.Errorf("%s; failed to re-create instance %s with error %s", err, instanceID, recreateErr)
+		}
+		return err
+	}
+
+	return b.removeTrashEntry(logger, deletedID)
+}
+
+// NewTrashReaper returns a runner that purges expired trash entries every
+// interval until it is signalled.
+func NewTrashReaper(logger lager.Logger, broker *Broker, clock clock.Clock, interval time.Duration) ifrit.Runner {
+	return ifrit.RunFunc(func(signals <-chan os.Signal, ready chan<- struct{}) error {
+		logger := logger.Session("trash-reaper")
+		ticker := clock.NewTicker(interval)
+		defer ticker.Stop()
+
+		close(ready)
+		for {
+			select {
+			case <-ticker.C():
+				if err := broker.PurgeTrash(context.Background()); err != nil {
+					logger.Error("failed-to-purge-trash", err)
+				}
+			case <-signals:
+				return nil
+			}
+		}
+	})
+}
+
+func (b *Broker) trashEntry(instanceID string) (TrashEntry, error) {
+	entries, err := b.Trash()
+	if err != nil {
+		return TrashEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.InstanceID == instanceID {
+			return entry, nil
+		}
+	}
+	return TrashEntry{}, ErrTrashEntryNotFound
+}
+
+func (b *Broker) addTrashEntry(logger lager.Logger, entry TrashEntry) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entries, err := b.trashEntriesLocked()
+	if err != nil {
+		return err
+	}
+	entries = append(withoutTrashEntry(entries, entry.InstanceID), entry)
+	if err := b.writeTrashLocked(entries); err != nil {
+		return fmt.Errorf("failed to record instance %s in the trash with error %s", entry.InstanceID, err)
+	}
+	return b.store.Save(logger)
+}
+
+func (b *Broker) removeTrashEntry(logger lager.Logger, instanceID string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entries, err := b.trashEntriesLocked()
+	if err != nil {
+		return err
+	}
+	if err := b.writeTrashLocked(withoutTrashEntry(entries, instanceID)); err != nil {
+		return fmt.Errorf("failed to remove instance %s from the trash with error %s", instanceID, err)
+	}
+	return b.store.Save(logger)
+}
+
+func (b *Broker) trashEntriesLocked() ([]TrashEntry, error) {
+	index, err := b.indexLocked(trashIndexID)
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return []TrashEntry{}, nil
+	}
+
+	bytes, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	entries := []TrashEntry{}
+	if err := json.Unmarshal(bytes, &entries); err != nil {
+		return nil, fmt.Errorf("failed to decode trash index with error %s", err)
+	}
+	return entries, nil
+}
+
+func (b *Broker) writeTrashLocked(entries []TrashEntry) error {
+	return b.replaceRecordLocked(trashIndexID, brokerstore.ServiceInstance{ServiceFingerPrint: entries})
+}
+
+func withoutTrashEntry(entries []TrashEntry, instanceID string) []TrashEntry {
+	remaining := []TrashEntry{}
+	for _, entry := range entries {
+		if entry.InstanceID != instanceID {
+			remaining = append(remaining, entry)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,150 @@
+package nfsbroker
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/nimbus-cloud/isilon-nfs-broker/isilon"
+	"github.com/pivotal-cf/brokerapi"
+)
+
+// InstanceUsage is how much of its quota an instance is using, as read from
+// its SmartQuota. Sizes are in bytes and Files counts inodes.
+//
+// Instances of replicated plans also report the state of their latest
+// replication job and when replication last succeeded, in seconds since the
+// epoch.
+type InstanceUsage struct {
+	InstanceID    string `json:"instance_id"`
+	OrgGUID       string `json:"organization_guid"`
+	SpaceGUID     string `json:"space_guid"`
+	PlanID        string `json:"plan_id"`
+	Plan          string `json:"plan"`
+	Cluster       string `json:"cluster"`
+	HardLimit     int64  `json:"hard_limit"`
+	AdvisoryLimit int64  `json:"advisory_limit,omitempty"`
+	SoftLimit     int64  `json:"soft_limit,omitempty"`
+	Logical       int64  `json:"logical"`
+	Physical      int64  `json:"physical"`
+	Files         int64  `json:"files"`
+
+	ReplicationState       string `json:"replication_state,omitempty"`
+	ReplicationLastSuccess int64  `json:"replication_last_success,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// Usage reads the quota of every instance. Instances that are still being
+// created or deleted are skipped. A quota that cannot be read does not stop
+// the others; check each result's Error.
+func (b *Broker) Usage(ctx context.Context) ([]InstanceUsage, error) {
+	logger := b.logger.Session("usage")
+	logger.Info("start")
+	defer logger.Info("end")
+
+	ids, err := b.instanceIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	results := []InstanceUsage{}
+	for _, instanceID := range ids {
+		details, fp, err := b.retrieveInstance(instanceID)
+		if err != nil {
+			continue
+		}
+		if op := fp.Operation; op != nil && (op.Type == operationDeprovision || op.State != brokerapi.Succeeded) {
+			continue
+		}
+
+		usage := InstanceUsage{
+			InstanceID: instanceID,
+			OrgGUID:    details.OrganizationGUID,
+			SpaceGUID:  details.SpaceGUID,
+			PlanID:     details.PlanID,
+			Cluster:    fp.Cluster,
+		}
+		plan, ok := b.catalog.plan(details.PlanID)
+		if ok {
+			usage.Plan = plan.Name
+		}
+
+		_, zone, name, err := b.instanceVolume(instanceID, fp)
+		if err != nil {
+			usage.Error = err.Error()
+			results = append(results, usage)
+			continue
+		}
+		if plan.Replication != nil {
+			status, err := zone.Client.ReplicationStatus(ctx, name)
+			switch {
+			case err == isilon.ErrReplicationPolicyNotFound:
+				usage.ReplicationState = ReplicationMissing
+			case err != nil:
+				logger.Error("failed-to-read-replication-status", err, lager.Data{"instanceID": instanceID})
+				usage.Error = fmt.Sprintf("failed to read isilon replication policy for %s with error %s", instanceID, err)
+				results = append(results, usage)
+				continue
+			case status.State == "":
+				usage.ReplicationState = ReplicationPending
+			default:
+				usage.ReplicationState = status.State
+				usage.ReplicationLastSuccess = status.LastSuccess
+			}
+		}
+
+		quota, err := zone.Client.Quota(ctx, name)
+		if err != nil {
+			logger.Error("failed-to-read-quota", err, lager.Data{"instanceID": instanceID})
+			usage.Error = fmt.Sprintf("failed to read isilon quota for %s with error %s", instanceID, err)
+			results = append(results, usage)
+			continue
+		}
+		usage.HardLimit = quota.Limits.Hard
+		usage.AdvisoryLimit = quota.Limits.Advisory
+		usage.SoftLimit = quota.Limits.Soft
+		usage.Logical = quota.Logical
+		usage.Physical = quota.Physical
+		usage.Files = quota.Files
+		results = append(results, usage)
+	}
+	return results, nil
+}
+
+var usageColumns = []string{
+	"instance_id", "organization_guid", "space_guid", "plan_id", "plan", "cluster",
+	"hard_limit", "advisory_limit", "soft_limit", "logical", "physical", "files",
+	"replication_state", "replication_last_success", "error",
+}
+
+// writeUsageCSV writes usage as CSV with a header row, using the same column
+// names as the JSON fields.
+func writeUsageCSV(w io.Writer, usage []InstanceUsage) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(usageColumns); err != nil {
+		return err
+	}
+	for _, u := range usage {
+		record := []string{
+			u.InstanceID, u.OrgGUID, u.SpaceGUID, u.PlanID, u.Plan, u.Cluster,
+			strconv.FormatInt(u.HardLimit, 10),
+			strconv.FormatInt(u.AdvisoryLimit, 10),
+			strconv.FormatInt(u.SoftLimit, 10),
+			strconv.FormatInt(u.Logical, 10),
+			strconv.FormatInt(u.Physical, 10),
+			strconv.FormatInt(u.Files, 10),
+			u.ReplicationState,
+			strconv.FormatInt(u.ReplicationLastSuccess, 10),
+			u.Error,
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"code.cloudfoundry.org/clock"
+	"code.cloudfoundry.org/lager"
+	"github.com/nimbus-cloud/isilon-nfs-broker/nfsbroker"
+)
+
+// runReconcile reconciles the store with the clusters once, without a running
+// broker, and writes the report to stdout. It returns the process exit code.
+func runReconcile(logger lager.Logger, stdout, stderr io.Writer, args []string) int {
+	mode := "report"
+	if len(args) > 0 {
+		mode = args[0]
+	}
+	if len(args) > 1 || mode != "report" && mode != "repair" {
+		fmt.Fprintln(stderr, "usage: isilon-nfs-broker [flags] reconcile [report|repair]")
+		return 2
+	}
+
+	broker := createBroker(logger, clock.NewClock(), nfsbroker.NewOffline)
+	report, err := broker.Reconcile(context.Background(), mode == "repair")
+	if err != nil {
+		fmt.Fprintf(stderr, "failed to reconcile with error %s\n", err)
+		return 1
+	}
+
+	if err := json.NewEncoder(stdout).Encode(report); err != nil {
+		fmt.Fprintf(stderr, "failed to write the report with error %s\n", err)
+		return 1
+	}
+	return 0
+}